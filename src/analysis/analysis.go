@@ -0,0 +1,249 @@
+// Package analysis runs passive checks on captured flows and reports what
+// they notice as findings: missing security headers, weak cookies, error
+// messages, directory listings, reflected parameters and mixed content,
+// and the secrets and personal data of the bodies, see Rules.
+//
+// Checks register themselves by id, the same way sinks do in package
+// capture, and an Analyzer runs them in the background on every flow
+// written through it:
+//
+//	a := analysis.New(sink, analysis.Options{})
+//	a.Write(flow)   // returns at once, findings go to sink later
+//
+// Checks only read the flow. They see it as stored, after redaction.
+package analysis
+
+import (
+    "capture"
+    "fmt"
+    "log"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// CheckFunc inspects a flow and returns what it found. Check, FlowID,
+// Method, URL and Date of the findings are filled in by the Analyzer.
+type CheckFunc func(f *capture.Response) []*capture.Finding
+
+var (
+    checksMu sync.Mutex
+    checks   = make(map[string]CheckFunc)
+)
+
+// Register makes a check available under id. It panics if called twice
+// with the same id.
+func Register(id string, check CheckFunc) {
+    checksMu.Lock()
+    defer checksMu.Unlock()
+    if check == nil {
+        panic("analysis: Register check is nil")
+    }
+    if _, dup := checks[id]; dup {
+        panic("analysis: Register called twice for check " + id)
+    }
+    checks[id] = check
+}
+
+// Checks returns the sorted ids of the registered checks.
+func Checks() []string {
+    checksMu.Lock()
+    defer checksMu.Unlock()
+    var list []string
+    for id := range checks {
+        list = append(list, id)
+    }
+    sort.Strings(list)
+    return list
+}
+
+// Options configures an Analyzer, zero fields take the defaults below.
+type Options struct {
+    // Checks are the ids of the checks to run, all of them when empty.
+    Checks []string
+    // Workers run checks in parallel.
+    Workers int
+    // QueueSize flows wait for a worker, the others are not analysed.
+    QueueSize int
+    // Rules replace the default rules of the secrets and pii checks.
+    Rules *Rules
+}
+
+const (
+    DefaultWorkers   = 2
+    DefaultQueueSize = 1024
+)
+
+// Analyzer is a CaptureSink that passes flows on to another sink and runs
+// the checks on them in the background, writing the findings to that sink
+// when it is a capture.FindingSink. It never slows the proxy down: flows
+// arriving while the queue is full are passed on unchecked.
+//
+// Static resources are stored without their body, the bodies they come
+// with are only there to be checked and are not passed on. Findings in
+// them keep the text around their evidence as their Context.
+type Analyzer struct {
+    next   capture.CaptureSink
+    checks []named
+    queue  chan *capture.Response
+    wg     sync.WaitGroup
+
+    // closed guards queue against sends after Close.
+    mu     sync.RWMutex
+    closed bool
+
+    skipped uint64
+}
+
+type named struct {
+    id    string
+    check CheckFunc
+}
+
+// New starts an Analyzer feeding next. It panics on an unknown check id,
+// see Validate.
+func New(next capture.CaptureSink, opts Options) *Analyzer {
+    if err := Validate(opts.Checks); err != nil {
+        panic(err)
+    }
+    if opts.Workers <= 0 {
+        opts.Workers = DefaultWorkers
+    }
+    if opts.QueueSize <= 0 {
+        opts.QueueSize = DefaultQueueSize
+    }
+    ids := opts.Checks
+    if len(ids) == 0 {
+        ids = Checks()
+    }
+    a := &Analyzer{next: next, queue: make(chan *capture.Response, opts.QueueSize)}
+    checksMu.Lock()
+    for _, id := range ids {
+        check := checks[id]
+        if kind, ok := kindChecks[id]; ok && opts.Rules != nil {
+            check = opts.Rules.check(kind)
+        }
+        a.checks = append(a.checks, named{id, check})
+    }
+    checksMu.Unlock()
+    for i := 0; i < opts.Workers; i++ {
+        a.wg.Add(1)
+        go a.work()
+    }
+    return a
+}
+
+// Validate tells if every id is a registered check.
+func Validate(ids []string) error {
+    checksMu.Lock()
+    defer checksMu.Unlock()
+    for _, id := range ids {
+        if _, ok := checks[id]; !ok {
+            return fmt.Errorf("analysis: unknown check %q", id)
+        }
+    }
+    return nil
+}
+
+// Write passes r on and queues it for the checks. r must not change
+// afterwards, it is read from other goroutines.
+func (a *Analyzer) Write(r *capture.Response) error {
+    // findings need the flow id to point back at the flow
+    if r.FlowID == "" {
+        r.FlowID = capture.NewFlowID()
+    }
+    stored := r
+    if r.Static && (r.Body != nil || r.RawBody != nil) {
+        flow := *r
+        flow.Body, flow.RawBody = nil, nil
+        flow.Truncated = flow.Truncated || len(r.Body) > 0
+        stored = &flow
+    }
+    err := a.next.Write(stored)
+    a.mu.RLock()
+    defer a.mu.RUnlock()
+    if a.closed {
+        return err
+    }
+    select {
+    case a.queue <- r:
+    default:
+        atomic.AddUint64(&a.skipped, 1)
+    }
+    return err
+}
+
+// WriteMessages passes messages on, if the next sink takes them.
+func (a *Analyzer) WriteMessages(msgs []*capture.Message) error {
+    if ms, ok := a.next.(capture.MessageSink); ok {
+        return ms.WriteMessages(msgs)
+    }
+    return nil
+}
+
+// Skipped counts the flows that found the queue full.
+func (a *Analyzer) Skipped() uint64 {
+    return atomic.LoadUint64(&a.skipped)
+}
+
+func (a *Analyzer) Flush() error {
+    return a.next.Flush()
+}
+
+// Close checks the flows still queued, then closes the next sink.
+func (a *Analyzer) Close() error {
+    a.mu.Lock()
+    if !a.closed {
+        a.closed = true
+        close(a.queue)
+    }
+    a.mu.Unlock()
+    a.wg.Wait()
+    return a.next.Close()
+}
+
+func (a *Analyzer) work() {
+    defer a.wg.Done()
+    fs, _ := a.next.(capture.FindingSink)
+    for r := range a.queue {
+        findings := a.Run(r)
+        if fs == nil || len(findings) == 0 {
+            continue
+        }
+        if err := fs.WriteFindings(findings); err != nil {
+            log.Printf("analysis: writing %d findings: %v", len(findings), err)
+        }
+    }
+}
+
+// Run runs the checks of a on r right away and returns their findings. A
+// check that panics is logged and skipped.
+func (a *Analyzer) Run(r *capture.Response) []*capture.Finding {
+    if r.Method == "CONNECT" || r.Status == 0 {
+        return nil
+    }
+    now := time.Now()
+    var all []*capture.Finding
+    for _, c := range a.checks {
+        for _, f := range run(c, r) {
+            f.Check, f.FlowID, f.Method, f.URL, f.Date = c.id, r.FlowID, r.Method, r.URL, now
+            all = append(all, f)
+        }
+    }
+    if r.Static {
+        // Write does not store the body, the findings carry their context
+        withContext(r.Body, capture.LocationResponseBody, all)
+    }
+    return all
+}
+
+func run(c named, r *capture.Response) (findings []*capture.Finding) {
+    defer func() {
+        if err := recover(); err != nil {
+            log.Printf("analysis: check %s on %s: %v", c.id, r.URL, err)
+            findings = nil
+        }
+    }()
+    return c.check(r)
+}
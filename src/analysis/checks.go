@@ -0,0 +1,269 @@
+package analysis
+
+import (
+    "capture"
+    "mime"
+    "net/http"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+func init() {
+    Register("security-headers", securityHeaders)
+    Register("cookie-flags", cookieFlags)
+    Register("error-disclosure", errorDisclosure)
+    Register("directory-listing", directoryListing)
+    Register("reflected-param", reflectedParams)
+    Register("mixed-content", mixedContent)
+}
+
+// maxEvidence bounds the evidence quoted from a body.
+const maxEvidence = 200
+
+func finding(severity, title, evidence string) *capture.Finding {
+    return &capture.Finding{Severity: severity, Title: title, Evidence: evidence}
+}
+
+// mediaType is the lower case media type of the response.
+func mediaType(f *capture.Response) string {
+    ctype := f.Header.Get("Content-Type")
+    if ctype == "" {
+        ctype = f.ContentType
+    }
+    mediatype, _, err := mime.ParseMediaType(ctype)
+    if err != nil {
+        return strings.ToLower(strings.TrimSpace(strings.Split(ctype, ";")[0]))
+    }
+    return mediatype
+}
+
+func isHTML(f *capture.Response) bool {
+    mt := mediaType(f)
+    return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// textBody is the response body when it is text a browser or a client
+// would read, "" otherwise.
+func textBody(f *capture.Response) string {
+    mt := mediaType(f)
+    text := strings.HasPrefix(mt, "text/") || strings.Contains(mt, "json") ||
+        strings.Contains(mt, "xml") || strings.Contains(mt, "javascript")
+    if !text || mt == "text/css" || !utf8.Valid(f.Body) {
+        return ""
+    }
+    return string(f.Body)
+}
+
+// around quotes body around body[start:end], on one line.
+func around(body string, start, end, context int) string {
+    from, to := start-context, end+context
+    if from < 0 {
+        from = 0
+    }
+    if to > len(body) {
+        to = len(body)
+    }
+    // whole runes only
+    for from > 0 && !utf8.RuneStart(body[from]) {
+        from--
+    }
+    for to < len(body) && !utf8.RuneStart(body[to]) {
+        to++
+    }
+    return strings.Join(strings.Fields(body[from:to]), " ")
+}
+
+// line quotes the line of body holding body[start:end].
+func line(body string, start, end int) string {
+    from := strings.LastIndexByte(body[:start], '\n') + 1
+    to := len(body)
+    if i := strings.IndexByte(body[end:], '\n'); i >= 0 {
+        to = end + i
+    }
+    if to-from > maxEvidence {
+        return around(body, start, end, (maxEvidence-(end-start))/2)
+    }
+    return strings.TrimSpace(body[from:to])
+}
+
+// securityHeaders reports the protections missing from HTML pages.
+func securityHeaders(f *capture.Response) []*capture.Finding {
+    if f.Status < 200 || f.Status > 299 || !isHTML(f) {
+        return nil
+    }
+    var findings []*capture.Finding
+    csp := f.Header.Get("Content-Security-Policy")
+    if f.Scheme == "https" && f.Header.Get("Strict-Transport-Security") == "" {
+        findings = append(findings, finding(capture.SeverityLow, "Strict-Transport-Security missing", ""))
+    }
+    if csp == "" {
+        findings = append(findings, finding(capture.SeverityLow, "Content-Security-Policy missing", ""))
+    }
+    if f.Header.Get("X-Frame-Options") == "" && !strings.Contains(strings.ToLower(csp), "frame-ancestors") {
+        findings = append(findings, finding(capture.SeverityLow, "Framing allowed, no X-Frame-Options nor frame-ancestors", ""))
+    }
+    if v := f.Header.Get("X-Content-Type-Options"); !strings.EqualFold(strings.TrimSpace(v), "nosniff") {
+        evidence := ""
+        if v != "" {
+            evidence = "X-Content-Type-Options: " + v
+        }
+        findings = append(findings, finding(capture.SeverityInfo, "X-Content-Type-Options nosniff missing", evidence))
+    }
+    return findings
+}
+
+// cookieFlags reports cookies set without Secure, HttpOnly or SameSite.
+func cookieFlags(f *capture.Response) []*capture.Finding {
+    var findings []*capture.Finding
+    for _, raw := range f.Header.Values("Set-Cookie") {
+        cookies := (&http.Response{Header: http.Header{"Set-Cookie": {raw}}}).Cookies()
+        if len(cookies) == 0 {
+            continue
+        }
+        c := cookies[0]
+        if c.Value == "" || c.MaxAge < 0 {
+            // a deletion
+            continue
+        }
+        // the value is left out of the evidence, it may be a session
+        evidence := c.Name
+        if i := strings.IndexByte(raw, ';'); i >= 0 {
+            evidence += raw[i:]
+        }
+        if f.Scheme == "https" && !c.Secure {
+            findings = append(findings, finding(capture.SeverityMedium, "Cookie "+c.Name+" without Secure", evidence))
+        }
+        if !c.HttpOnly {
+            findings = append(findings, finding(capture.SeverityLow, "Cookie "+c.Name+" without HttpOnly", evidence))
+        }
+        if c.SameSite == 0 || c.SameSite == http.SameSiteDefaultMode {
+            findings = append(findings, finding(capture.SeverityInfo, "Cookie "+c.Name+" without SameSite", evidence))
+        } else if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+            findings = append(findings, finding(capture.SeverityMedium, "Cookie "+c.Name+" with SameSite=None without Secure", evidence))
+        }
+    }
+    return findings
+}
+
+type bodyPattern struct {
+    severity string
+    title    string
+    re       *regexp.Regexp
+}
+
+var errorPatterns = []bodyPattern{
+    {capture.SeverityMedium, "SQL error message", regexp.MustCompile(`(?i)you have an error in your sql syntax|warning: mysqli?_|unclosed quotation mark after the character string|microsoft ole db provider for (sql server|odbc)|\bORA-\d{5}\b|PG::SyntaxError|pg_query\(\)|syntax error at or near "|SQLSTATE\[\w+\]|sqlite3?::|SQLite/JDBCDriver|System\.Data\.SqlClient\.SqlException|com\.mysql\.jdbc\.|org\.postgresql\.util\.PSQLException`)},
+    {capture.SeverityLow, "Java stack trace", regexp.MustCompile(`(?m)^\s*at [\w$.]+\.[\w$<>]+\([\w$]+\.java:\d+\)`)},
+    {capture.SeverityLow, "Python traceback", regexp.MustCompile(`Traceback \(most recent call last\):`)},
+    {capture.SeverityLow, "PHP error", regexp.MustCompile(`(?i)<b>(fatal error|warning|parse error|notice)</b>:.+ on line <b>\d+</b>|PHP (Fatal error|Warning|Parse error):.+ on line \d+`)},
+    {capture.SeverityLow, ".NET error page", regexp.MustCompile(`Server Error in '[^']*' Application|\[\w+(\.\w+)*Exception: .+\]\s*\n?\s*\w+(\.\w+)*\(`)},
+    {capture.SeverityLow, "Go panic", regexp.MustCompile(`(?m)^goroutine \d+ \[running\]:`)},
+    {capture.SeverityLow, "Node.js stack trace", regexp.MustCompile(`(?m)^\s*at .+ \((/|[A-Z]:\\|node:)[^)]+:\d+:\d+\)`)},
+    {capture.SeverityLow, "Ruby backtrace", regexp.MustCompile(`(?m)\.rb:\d+:in ` + "`")},
+}
+
+// errorDisclosure reports stack traces and database errors in bodies.
+func errorDisclosure(f *capture.Response) []*capture.Finding {
+    body := textBody(f)
+    if body == "" || mediaType(f) == "application/javascript" || mediaType(f) == "text/javascript" {
+        return nil
+    }
+    var findings []*capture.Finding
+    for _, p := range errorPatterns {
+        if loc := p.re.FindStringIndex(body); loc != nil {
+            findings = append(findings, finding(p.severity, p.title, line(body, loc[0], loc[1])))
+        }
+    }
+    return findings
+}
+
+var listingPattern = regexp.MustCompile(`(?i)<title>\s*(index of /|directory listing for /)[^<]*</title>|<h1>\s*index of /[^<]*</h1>|\[to parent directory\]`)
+
+// directoryListing reports pages listing the files of a directory.
+func directoryListing(f *capture.Response) []*capture.Finding {
+    if f.Status != http.StatusOK || !isHTML(f) {
+        return nil
+    }
+    body := textBody(f)
+    if loc := listingPattern.FindStringIndex(body); loc != nil {
+        return []*capture.Finding{finding(capture.SeverityLow, "Directory listing", body[loc[0]:loc[1]])}
+    }
+    return nil
+}
+
+// Parameters shorter than minReflected, or of the types below, are too
+// likely to appear in a body by chance.
+const (
+    minReflected = 4
+    maxReflected = 20
+)
+
+var reflectedTypes = map[string]bool{capture.ParamString: true, capture.ParamEmail: true, capture.ParamURL: true, capture.ParamJSON: true}
+
+// reflectedParams reports request parameters whose value appears as is in
+// the response body, the places to try injections first.
+func reflectedParams(f *capture.Response) []*capture.Finding {
+    body := textBody(f)
+    if body == "" {
+        return nil
+    }
+    var findings []*capture.Finding
+    seen := make(map[string]bool)
+    for _, p := range capture.Params(f) {
+        if p.Location == "cookie" || len(p.Value) < minReflected || !reflectedTypes[p.Type] || seen[p.Value] {
+            continue
+        }
+        i := strings.Index(body, p.Value)
+        if i < 0 {
+            continue
+        }
+        seen[p.Value] = true
+        findings = append(findings, finding(capture.SeverityInfo, "Parameter "+p.Name+" ("+p.Location+") reflected", around(body, i, i+len(p.Value), 40)))
+        if len(findings) == maxReflected {
+            break
+        }
+    }
+    return findings
+}
+
+var (
+    resourceTag = regexp.MustCompile(`(?is)<(script|iframe|frame|link|object|embed|form|img|audio|video|source)\b[^>]*>`)
+    insecureURL = regexp.MustCompile(`(?i)\s(?:src|href|action|data)\s*=\s*["']?(http://[^"'\s>]+)`)
+)
+
+// activeContent can act on the page, a man in the middle replacing it
+// takes the page over.
+var activeContent = map[string]bool{"script": true, "iframe": true, "frame": true, "link": true, "object": true, "embed": true, "form": true}
+
+// mixedContent reports HTTPS pages loading resources, or posting forms,
+// over plain HTTP.
+func mixedContent(f *capture.Response) []*capture.Finding {
+    if f.Scheme != "https" || !isHTML(f) {
+        return nil
+    }
+    body := textBody(f)
+    var findings []*capture.Finding
+    seen := make(map[string]bool)
+    for _, m := range resourceTag.FindAllStringSubmatch(body, -1) {
+        tag := strings.ToLower(m[1])
+        if tag == "link" && !strings.Contains(strings.ToLower(m[0]), "stylesheet") {
+            // alternate and canonical links are not loaded
+            continue
+        }
+        u := insecureURL.FindStringSubmatch(m[0])
+        if u == nil || seen[u[1]] {
+            continue
+        }
+        seen[u[1]] = true
+        severity, title := capture.SeverityLow, "Mixed content, "+tag+" loaded over HTTP"
+        if activeContent[tag] {
+            severity = capture.SeverityMedium
+        }
+        if tag == "form" {
+            title = "Form posted over HTTP"
+        }
+        findings = append(findings, finding(severity, title, u[1]))
+    }
+    return findings
+}
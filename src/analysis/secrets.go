@@ -0,0 +1,394 @@
+package analysis
+
+import (
+    "capture"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "math"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+// Kinds of Rule, each reported by the check of the same name.
+const (
+    KindSecret = "secret"
+    KindPII    = "pii"
+)
+
+// kindChecks are the ids of the checks running the rules of each kind.
+var kindChecks = map[string]string{"secrets": KindSecret, "pii": KindPII}
+
+func init() {
+    for id, kind := range kindChecks {
+        Register(id, defaultRules.check(kind))
+    }
+}
+
+// Rule finds a secret or personal data in request and response bodies.
+type Rule struct {
+    ID       string `json:"id"`
+    Kind     string `json:"kind"`
+    Title    string `json:"title"`
+    Severity string `json:"severity"`
+    Pattern  string `json:"pattern"`
+    // Group is the submatch reported, the whole match when zero.
+    Group int `json:"group,omitempty"`
+    // MinEntropy is the least Shannon entropy, in bits per byte, of what
+    // is reported; matches below it are taken for words and placeholders.
+    MinEntropy float64 `json:"min_entropy,omitempty"`
+    // Validate names a check digit the match must pass: luhn for card
+    // numbers, ssn for US social security numbers, cn_id for Chinese
+    // resident identity numbers.
+    Validate string `json:"validate,omitempty"`
+
+    re *regexp.Regexp
+}
+
+var validators = map[string]func(string) bool{"luhn": luhn, "ssn": ssn, "cn_id": cnID}
+
+// Rules are the rules of the secrets and pii checks, loaded from JSON:
+//
+//	{
+//	    "replace": false,
+//	    "rules": [{
+//	        "id": "internal-token", "kind": "secret", "title": "Internal API token",
+//	        "severity": "high", "pattern": "itk_([0-9a-f]{32})", "group": 1,
+//	        "min_entropy": 3
+//	    }]
+//	}
+//
+// The rules are added to DefaultRules, replacing those of the same id, or
+// replace them all with replace.
+type Rules struct {
+    Replace bool    `json:"replace"`
+    Rules   []*Rule `json:"rules"`
+
+    compiled []*Rule
+}
+
+// Limits of the matches reported in a body, per rule and for all the rules
+// of a kind. They count the matches that pass the entropy and validation
+// filters only.
+const (
+    maxRuleMatches = 10
+    maxFlowMatches = 50
+)
+
+// DefaultRules find the cloud and service keys, tokens and personal data
+// seen most often.
+var DefaultRules = []*Rule{
+    {ID: "aws-access-key", Kind: KindSecret, Title: "AWS access key id", Severity: capture.SeverityHigh,
+        Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+    {ID: "aws-secret-key", Kind: KindSecret, Title: "AWS secret access key", Severity: capture.SeverityHigh,
+        Pattern: `(?i)aws.{0,20}?(?:secret|key).{0,20}?["'=:\s]([A-Za-z0-9/+]{40})\b`, Group: 1, MinEntropy: 4},
+    {ID: "google-api-key", Kind: KindSecret, Title: "Google API key", Severity: capture.SeverityMedium,
+        Pattern: `\bAIza[0-9A-Za-z_\-]{35}\b`},
+    {ID: "github-token", Kind: KindSecret, Title: "GitHub token", Severity: capture.SeverityHigh,
+        Pattern: `\b(?:gh[pousr]_[0-9A-Za-z]{36}|github_pat_[0-9A-Za-z_]{82})\b`},
+    {ID: "slack-token", Kind: KindSecret, Title: "Slack token", Severity: capture.SeverityHigh,
+        Pattern: `\bxox[abprs]-[0-9A-Za-z-]{10,}\b`},
+    {ID: "stripe-key", Kind: KindSecret, Title: "Stripe live key", Severity: capture.SeverityHigh,
+        Pattern: `\b[rs]k_live_[0-9A-Za-z]{24,}\b`},
+    {ID: "private-key", Kind: KindSecret, Title: "Private key", Severity: capture.SeverityHigh,
+        Pattern: `-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`},
+    {ID: "jwt", Kind: KindSecret, Title: "JSON Web Token", Severity: capture.SeverityMedium,
+        Pattern: `\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{10,}`},
+    {ID: "generic-secret", Kind: KindSecret, Title: "High entropy secret", Severity: capture.SeverityLow,
+        Pattern: `(?i)(?:api[_-]?key|secret|token|passw(?:or)?d|access[_-]?key|client[_-]?secret)[\w-]{0,20}["']?\s*[:=]\s*["']([A-Za-z0-9+/_.=-]{16,})["']`,
+        Group:   1, MinEntropy: 3.5},
+    {ID: "email", Kind: KindPII, Title: "Email address", Severity: capture.SeverityInfo,
+        Pattern: `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`},
+    {ID: "phone", Kind: KindPII, Title: "Phone number", Severity: capture.SeverityInfo,
+        Pattern: `\+[1-9]\d{0,2}[ .-]?\(?\d{1,4}\)?[ .-]?\d{3,4}[ .-]?\d{3,4}\b`},
+    {ID: "cn-mobile", Kind: KindPII, Title: "Chinese mobile number", Severity: capture.SeverityInfo,
+        Pattern: `\b1[3-9]\d{9}\b`},
+    {ID: "us-ssn", Kind: KindPII, Title: "US social security number", Severity: capture.SeverityMedium,
+        Pattern: `\b\d{3}-\d{2}-\d{4}\b`, Validate: "ssn"},
+    {ID: "cn-resident-id", Kind: KindPII, Title: "Chinese resident identity number", Severity: capture.SeverityMedium,
+        Pattern: `\b\d{17}[\dXx]\b`, Validate: "cn_id"},
+    {ID: "uk-nino", Kind: KindPII, Title: "UK national insurance number", Severity: capture.SeverityLow,
+        Pattern: `\b[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`},
+    {ID: "card-number", Kind: KindPII, Title: "Payment card number", Severity: capture.SeverityMedium,
+        Pattern: `\b\d(?:[ -]?\d){12,18}\b`, Validate: "luhn"},
+}
+
+var defaultRules = mustRules(&Rules{})
+
+func mustRules(r *Rules) *Rules {
+    if err := r.Compile(); err != nil {
+        panic(err)
+    }
+    return r
+}
+
+// LoadRules reads a JSON rules file.
+func LoadRules(path string) (*Rules, error) {
+    b, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    r := new(Rules)
+    if err := json.Unmarshal(b, r); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if err := r.Compile(); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    return r, nil
+}
+
+// Compile checks the rules and prepares them, it must be called before
+// the rules are used when they were not loaded with LoadRules.
+func (r *Rules) Compile() error {
+    var all []*Rule
+    byID := make(map[string]int)
+    add := func(rule *Rule) {
+        if i, ok := byID[rule.ID]; ok {
+            all[i] = rule
+            return
+        }
+        byID[rule.ID] = len(all)
+        all = append(all, rule)
+    }
+    if !r.Replace {
+        for _, rule := range DefaultRules {
+            add(rule)
+        }
+    }
+    seen := make(map[string]bool)
+    for _, rule := range r.Rules {
+        if seen[rule.ID] {
+            return fmt.Errorf("rule %q given twice", rule.ID)
+        }
+        seen[rule.ID] = true
+        add(rule)
+    }
+    compiled := make([]*Rule, len(all))
+    for i, rule := range all {
+        c := *rule
+        if err := c.compile(); err != nil {
+            return err
+        }
+        compiled[i] = &c
+    }
+    r.compiled = compiled
+    return nil
+}
+
+func (rule *Rule) compile() error {
+    switch {
+    case rule.ID == "":
+        return fmt.Errorf("rule without an id")
+    case rule.Kind != KindSecret && rule.Kind != KindPII:
+        return fmt.Errorf("rule %s: kind must be %s or %s", rule.ID, KindSecret, KindPII)
+    case capture.SeverityRank(rule.Severity) == 0:
+        return fmt.Errorf("rule %s: severity must be info, low, medium or high", rule.ID)
+    case rule.Validate != "" && validators[rule.Validate] == nil:
+        return fmt.Errorf("rule %s: unknown validation %q", rule.ID, rule.Validate)
+    }
+    re, err := regexp.Compile(rule.Pattern)
+    if err != nil {
+        return fmt.Errorf("rule %s: %v", rule.ID, err)
+    }
+    if rule.Group < 0 || rule.Group > re.NumSubexp() {
+        return fmt.Errorf("rule %s: no group %d in the pattern", rule.ID, rule.Group)
+    }
+    if rule.Title == "" {
+        rule.Title = rule.ID
+    }
+    rule.re = re
+    return nil
+}
+
+// check returns the check running the rules of kind.
+func (r *Rules) check(kind string) CheckFunc {
+    return func(f *capture.Response) []*capture.Finding {
+        findings := r.Scan(f.RequestBody, capture.LocationRequestBody, kind)
+        return append(findings, r.Scan(f.Body, capture.LocationResponseBody, kind)...)
+    }
+}
+
+// Scan runs the rules of kind on body, found at location, and returns
+// findings with the offsets of the matches. The evidence is the match
+// masked, see mask, so that findings do not spread the secrets they find.
+func (r *Rules) Scan(body []byte, location, kind string) []*capture.Finding {
+    if len(body) == 0 {
+        return nil
+    }
+    var findings []*capture.Finding
+    for _, rule := range r.compiled {
+        if rule.Kind != kind {
+            continue
+        }
+        matched := 0
+        for _, loc := range rule.re.FindAllSubmatchIndex(body, -1) {
+            start, end := loc[2*rule.Group], loc[2*rule.Group+1]
+            if start < 0 {
+                continue
+            }
+            value := string(body[start:end])
+            if rule.MinEntropy > 0 && entropy(value) < rule.MinEntropy {
+                continue
+            }
+            if rule.Validate != "" && !validators[rule.Validate](value) {
+                continue
+            }
+            f := finding(rule.Severity, rule.Title, mask(value))
+            f.Location, f.Start, f.End = location, start, end
+            findings = append(findings, f)
+            if len(findings) == maxFlowMatches {
+                return findings
+            }
+            if matched++; matched == maxRuleMatches {
+                break
+            }
+        }
+    }
+    return findings
+}
+
+// mask hides the middle of a secret, keeping a quarter of it and at most
+// four characters at each end: "AKIA************MPLE".
+func mask(s string) string {
+    runes := []rune(s)
+    keep := len(runes) / 4
+    if keep > 4 {
+        keep = 4
+    }
+    return string(runes[:keep]) + strings.Repeat("*", len(runes)-2*keep) + string(runes[len(runes)-keep:])
+}
+
+// contextBytes of a body not stored are kept on each side of the evidence.
+const contextBytes = 40
+
+// withContext sets the Context of the findings at location in body, a body
+// that is not stored, and moves their offsets into it. The matches of all
+// the findings are masked in every context.
+func withContext(body []byte, location string, findings []*capture.Finding) {
+    var located []*capture.Finding
+    for _, f := range findings {
+        if f.Location == location && f.Start < f.End && f.End <= len(body) {
+            located = append(located, f)
+        }
+    }
+    contexts := make([]string, len(located))
+    starts, ends := make([]int, len(located)), make([]int, len(located))
+    for i, f := range located {
+        from, to := f.Start-contextBytes, f.End+contextBytes
+        if from < 0 {
+            from = 0
+        }
+        if to > len(body) {
+            to = len(body)
+        }
+        for from > 0 && !utf8.RuneStart(body[from]) {
+            from--
+        }
+        for to < len(body) && !utf8.RuneStart(body[to]) {
+            to++
+        }
+        before := hide(body, from, f.Start, located)
+        value := mask(string(body[f.Start:f.End]))
+        contexts[i] = before + value + hide(body, f.End, to, located)
+        starts[i], ends[i] = len(before), len(before)+len(value)
+    }
+    // the offsets of all of them are needed until every context is made
+    for i, f := range located {
+        f.Context, f.Start, f.End = contexts[i], starts[i], ends[i]
+    }
+}
+
+// hide returns body[from:to] with a star for every rune of the matches of
+// findings.
+func hide(body []byte, from, to int, findings []*capture.Finding) string {
+    var b strings.Builder
+    for i := from; i < to; {
+        r, size := utf8.DecodeRune(body[i:])
+        for _, f := range findings {
+            if i >= f.Start && i < f.End {
+                r = '*'
+                break
+            }
+        }
+        b.WriteRune(r)
+        i += size
+    }
+    return b.String()
+}
+
+// entropy is the Shannon entropy of s in bits per byte.
+func entropy(s string) float64 {
+    if s == "" {
+        return 0
+    }
+    var counts [256]int
+    for i := 0; i < len(s); i++ {
+        counts[s[i]]++
+    }
+    var h float64
+    for _, n := range counts {
+        if n > 0 {
+            p := float64(n) / float64(len(s))
+            h -= p * math.Log2(p)
+        }
+    }
+    return h
+}
+
+func digits(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r >= '0' && r <= '9' {
+            return r
+        }
+        return -1
+    }, s)
+}
+
+// luhn checks the check digit of a card number.
+func luhn(s string) bool {
+    d := digits(s)
+    if len(d) < 13 || len(d) > 19 {
+        return false
+    }
+    sum := 0
+    for i := range d {
+        n := int(d[len(d)-1-i] - '0')
+        if i%2 == 1 {
+            if n *= 2; n > 9 {
+                n -= 9
+            }
+        }
+        sum += n
+    }
+    return sum%10 == 0
+}
+
+// ssn leaves out the numbers never issued.
+func ssn(s string) bool {
+    d := digits(s)
+    if len(d) != 9 {
+        return false
+    }
+    area, group, serial := d[:3], d[3:5], d[5:]
+    return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// cnID checks the birth date and the check character of a resident
+// identity number.
+func cnID(s string) bool {
+    if len(s) != 18 {
+        return false
+    }
+    year, month, day := s[6:10], s[10:12], s[12:14]
+    if (year[:2] != "19" && year[:2] != "20") || month < "01" || month > "12" || day < "01" || day > "31" {
+        return false
+    }
+    weights := [17]int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+    sum := 0
+    for i, w := range weights {
+        sum += int(s[i]-'0') * w
+    }
+    return "10X98765432"[sum%11] == strings.ToUpper(s[17:])[0]
+}
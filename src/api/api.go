@@ -0,0 +1,518 @@
+// Package api serves the flows of a capture.FlowStore as JSON, so scripts
+// can query the captures without database credentials.
+//
+//	GET    /api/flows            list flows, newest first, without bodies
+//	GET    /api/flows/{id}       one flow with its bodies and messages
+//	DELETE /api/flows/{id}       delete one flow
+//	DELETE /api/flows?host=...   delete the flows matching the filters,
+//	                             ?all=1 deletes everything
+//	POST   /api/flows/{id}/replay
+//	                             send the request of a flow again, edited by
+//	                             a replay.Edits JSON body, and answer the
+//	                             replay.Result
+//	GET    /api/diff?a=ID&b=ID   compare the responses of two flows, see
+//	                             package diff; context=N lines around the
+//	                             changes, 0 for none, text=1 to compare
+//	                             JSON line by line, ignore=Date,Server for
+//	                             the headers to leave out, format=text for a
+//	                             unified diff instead of JSON
+//	GET    /api/findings         findings of the passive checks, newest
+//	                             first; flow_id=, check=, severity= for the
+//	                             least severity wanted, limit and offset;
+//	                             those found in a body give its location and
+//	                             their start and end byte offsets in it, or
+//	                             in their context when the body is not stored
+//
+// The flows of a capture.Live buffer, which the web UI polls, are served
+// as well, with their own ids:
+//
+//	GET    /api/live?after=ID    flows newer than ID, oldest first, without
+//	                             bodies, and "last", the id of the newest
+//	GET    /api/live/{id}        one flow while it is still in the buffer
+//
+// Lists and bulk deletes take these filters:
+//
+//	host          example.com, or *.example.com for subdomains as well
+//	method        GET, POST, ...
+//	status        404, or 4xx for a class
+//	content_type  prefix of the response content type, e.g. text/html
+//	since, until  RFC 3339 times bounding the start of the flows
+//	q             text searched in the URL, headers and bodies
+//	param         name of a request parameter the flows have, * matches
+//	              anything: id, *.id
+//	replay_of     flow_id of the flow whose replays are wanted
+//	limit, offset paging of lists, limit defaults to 100, at most 1000
+//
+// Errors are answered as {"error": "..."}.
+//
+// POST and DELETE change state, so a page browsed through the proxy must not
+// be able to send them: they are refused when Origin or Sec-Fetch-Site show
+// another site than the API or UI host, and any body they have must be sent
+// as application/json, which a cross-site form or no-cors fetch cannot do. A
+// replay must be sent as application/json even without edits.
+package api
+
+import (
+    "capture"
+    "crypto/subtle"
+    "diff"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "net/url"
+    "replay"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Prefix is the path under which Handler serves.
+const Prefix = "/api/"
+
+const (
+    DefaultLimit = 100
+    MaxLimit     = 1000
+)
+
+// Handler serves the API over a FlowStore and a Live buffer.
+type Handler struct {
+    store capture.FlowStore
+    live  *capture.Live
+    token string
+    // Replayer sends replays, they are refused when it is nil.
+    Replayer *replay.Replayer
+    // UIHost is the host of the web UI, browsers may send POST and DELETE
+    // from it besides the API's own origin.
+    UIHost string
+}
+
+// New returns a Handler over store and live, either may be nil and its
+// endpoints then answer 404. When token is not empty, requests must carry
+// it as "Authorization: Bearer <token>".
+func New(store capture.FlowStore, live *capture.Live, token string) *Handler {
+    return &Handler{store: store, live: live, token: token}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if !h.authorized(r) {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="wyproxy"`)
+        writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+        return
+    }
+    if r.Method == "POST" || r.Method == "DELETE" {
+        if status, err := h.checkWrite(r); err != nil {
+            writeError(w, status, err)
+            return
+        }
+    }
+    path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+    switch {
+    case (strings.HasPrefix(path, "flows") || path == "diff" || path == "findings") && h.store == nil:
+        writeError(w, http.StatusNotFound, errors.New("the sink cannot be queried"))
+    case path == "findings":
+        if r.Method != "GET" && r.Method != "HEAD" {
+            methodNotAllowed(w, "GET, HEAD")
+            return
+        }
+        h.findings(w, r)
+    case strings.HasPrefix(path, "live") && h.live == nil:
+        writeError(w, http.StatusNotFound, errors.New("no live buffer"))
+    case path == "live" || strings.HasPrefix(path, "live/"):
+        if r.Method != "GET" && r.Method != "HEAD" {
+            methodNotAllowed(w, "GET, HEAD")
+            return
+        }
+        h.liveFlows(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "live"), "/"))
+    case path == "diff":
+        if r.Method != "GET" && r.Method != "HEAD" {
+            methodNotAllowed(w, "GET, HEAD")
+            return
+        }
+        h.diff(w, r)
+    case path == "flows":
+        switch r.Method {
+        case "GET", "HEAD":
+            h.list(w, r)
+        case "DELETE":
+            h.deleteMatching(w, r)
+        default:
+            methodNotAllowed(w, "GET, HEAD, DELETE")
+        }
+    case strings.HasPrefix(path, "flows/") && strings.HasSuffix(path, "/replay"):
+        id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, "flows/"), "/replay"), 10, 64)
+        if err != nil || id <= 0 {
+            writeError(w, http.StatusNotFound, errors.New("no such flow"))
+            return
+        }
+        if r.Method != "POST" {
+            methodNotAllowed(w, "POST")
+            return
+        }
+        h.replay(w, r, id)
+    case strings.HasPrefix(path, "flows/"):
+        id, err := strconv.ParseInt(strings.TrimPrefix(path, "flows/"), 10, 64)
+        if err != nil || id <= 0 {
+            writeError(w, http.StatusNotFound, errors.New("no such flow"))
+            return
+        }
+        switch r.Method {
+        case "GET", "HEAD":
+            h.get(w, id)
+        case "DELETE":
+            h.delete(w, id)
+        default:
+            methodNotAllowed(w, "GET, HEAD, DELETE")
+        }
+    default:
+        writeError(w, http.StatusNotFound, fmt.Errorf("no API at %s", r.URL.Path))
+    }
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+    if h.token == "" {
+        return true
+    }
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") {
+        return false
+    }
+    return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(h.token)) == 1
+}
+
+// checkWrite refuses requests that change state when a browser sent them
+// from another site, or when their body is not JSON.
+func (h *Handler) checkWrite(r *http.Request) (int, error) {
+    switch site := r.Header.Get("Sec-Fetch-Site"); site {
+    case "", "same-origin", "none":
+    default:
+        return http.StatusForbidden, fmt.Errorf("refusing a %s request from a %s page", r.Method, site)
+    }
+    if origin := r.Header.Get("Origin"); origin != "" {
+        u, err := url.Parse(origin)
+        if err != nil || u.Host == "" || !strings.EqualFold(u.Host, r.Host) && !(h.UIHost != "" && strings.EqualFold(u.Hostname(), h.UIHost)) {
+            return http.StatusForbidden, fmt.Errorf("refusing a %s request from %s", r.Method, origin)
+        }
+    }
+    ctype := r.Header.Get("Content-Type")
+    if r.Method == "POST" || r.ContentLength != 0 || ctype != "" {
+        if mt, _, err := mime.ParseMediaType(ctype); err != nil || mt != "application/json" {
+            return http.StatusUnsupportedMediaType, errors.New("the body must be sent as application/json")
+        }
+    }
+    return 0, nil
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+    f, err := ParseFilter(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    flows, err := h.store.Query(f)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if flows == nil {
+        flows = []*capture.Response{}
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "flows":  flows,
+        "limit":  f.Limit,
+        "offset": f.Offset,
+    })
+}
+
+func (h *Handler) get(w http.ResponseWriter, id int64) {
+    flow, err := h.store.Get(id)
+    if err == capture.ErrNotFound {
+        writeError(w, http.StatusNotFound, errors.New("no such flow"))
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, flow)
+}
+
+func (h *Handler) delete(w http.ResponseWriter, id int64) {
+    n, err := h.store.Delete(capture.Filter{ID: id})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if n == 0 {
+        writeError(w, http.StatusNotFound, errors.New("no such flow"))
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]int64{"deleted": n})
+}
+
+func (h *Handler) deleteMatching(w http.ResponseWriter, r *http.Request) {
+    f, err := ParseFilter(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    if f.Empty() && r.URL.Query().Get("all") != "1" {
+        writeError(w, http.StatusBadRequest, errors.New("refusing to delete every flow without all=1"))
+        return
+    }
+    n, err := h.store.Delete(f)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]int64{"deleted": n})
+}
+
+func (h *Handler) replay(w http.ResponseWriter, r *http.Request, id int64) {
+    if h.Replayer == nil {
+        writeError(w, http.StatusNotFound, errors.New("replays are not available"))
+        return
+    }
+    var edits replay.Edits
+    if r.ContentLength != 0 {
+        dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, replay.MaxBody))
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&edits); err != nil && err != io.EOF {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("edits: %v", err))
+            return
+        }
+    }
+    flow, err := h.store.Get(id)
+    if err == capture.ErrNotFound {
+        writeError(w, http.StatusNotFound, errors.New("no such flow"))
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    // edits that cannot make a request are the caller's fault
+    req, err := replay.Request(flow, edits)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    req.Body.Close()
+    result, err := h.Replayer.Replay(flow, edits)
+    if err != nil {
+        writeError(w, http.StatusBadGateway, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) diff(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    var (
+        flows [2]*capture.Response
+        opts  = diff.Options{Text: q.Get("text") == "1"}
+        err   error
+    )
+    for i, name := range []string{"a", "b"} {
+        id, err := strconv.ParseInt(q.Get(name), 10, 64)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be a flow id, not %q", name, q.Get(name)))
+            return
+        }
+        if flows[i], err = h.store.Get(id); err == capture.ErrNotFound {
+            writeError(w, http.StatusNotFound, fmt.Errorf("no flow %d", id))
+            return
+        } else if err != nil {
+            writeError(w, http.StatusInternalServerError, err)
+            return
+        }
+    }
+    context, err := parseInt(q.Get("context"), "context", diff.DefaultContext)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    opts.Context = diff.ContextLines(context)
+    if ignore, ok := q["ignore"]; ok {
+        opts.IgnoreHeaders = []string{}
+        for _, v := range ignore {
+            for _, name := range strings.Split(v, ",") {
+                if name = strings.TrimSpace(name); name != "" {
+                    opts.IgnoreHeaders = append(opts.IgnoreHeaders, name)
+                }
+            }
+        }
+    }
+    result := diff.Flows(flows[0], flows[1], opts)
+    if q.Get("format") == "text" {
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        result.WriteText(w)
+        return
+    }
+    writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) findings(w http.ResponseWriter, r *http.Request) {
+    fs, ok := h.store.(capture.FindingStore)
+    if !ok {
+        writeError(w, http.StatusNotFound, errors.New("the sink does not store findings"))
+        return
+    }
+    q := r.URL.Query()
+    f := capture.FindingFilter{FlowID: q.Get("flow_id"), Check: q.Get("check"), Severity: q.Get("severity")}
+    if f.Severity != "" && capture.SeverityRank(f.Severity) == 0 {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("severity must be info, low, medium or high, not %q", f.Severity))
+        return
+    }
+    var err error
+    if f.Limit, err = parseInt(q.Get("limit"), "limit", DefaultLimit); err == nil && (f.Limit < 1 || f.Limit > MaxLimit) {
+        err = fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+    }
+    if err == nil {
+        if f.Offset, err = parseInt(q.Get("offset"), "offset", 0); err == nil && f.Offset < 0 {
+            err = errors.New("offset must not be negative")
+        }
+    }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    findings, err := fs.Findings(f)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if findings == nil {
+        findings = []*capture.Finding{}
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "findings": findings,
+        "limit":    f.Limit,
+        "offset":   f.Offset,
+    })
+}
+
+// liveFlows lists the flows of the Live buffer after the one given as
+// ?after=, or returns flow id when set.
+func (h *Handler) liveFlows(w http.ResponseWriter, r *http.Request, id string) {
+    if id != "" {
+        n, err := strconv.ParseInt(id, 10, 64)
+        flow := h.live.Get(n)
+        if err != nil || flow == nil {
+            writeError(w, http.StatusNotFound, errors.New("no such flow, or no longer kept"))
+            return
+        }
+        writeJSON(w, http.StatusOK, flow)
+        return
+    }
+    var after int64
+    if s := r.URL.Query().Get("after"); s != "" {
+        var err error
+        if after, err = strconv.ParseInt(s, 10, 64); err != nil {
+            writeError(w, http.StatusBadRequest, fmt.Errorf("after must be a number, not %q", s))
+            return
+        }
+    }
+    flows, last := h.live.After(after, MaxLimit)
+    if flows == nil {
+        flows = []*capture.Response{}
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "flows": flows,
+        "last":  last,
+    })
+}
+
+// ParseFilter reads the filters of the query string of r.
+func ParseFilter(r *http.Request) (capture.Filter, error) {
+    q := r.URL.Query()
+    f := capture.Filter{
+        Host:        q.Get("host"),
+        Method:      q.Get("method"),
+        ContentType: q.Get("content_type"),
+        Search:      q.Get("q"),
+        Param:       q.Get("param"),
+        ReplayOf:    q.Get("replay_of"),
+        Limit:       DefaultLimit,
+    }
+    var err error
+    if s := q.Get("status"); s != "" {
+        if f.StatusMin, f.StatusMax, err = parseStatus(s); err != nil {
+            return f, err
+        }
+    }
+    if f.Since, err = parseTime(q, "since"); err != nil {
+        return f, err
+    }
+    if f.Until, err = parseTime(q, "until"); err != nil {
+        return f, err
+    }
+    if f.Limit, err = parseInt(q.Get("limit"), "limit", DefaultLimit); err != nil {
+        return f, err
+    }
+    if f.Limit < 1 || f.Limit > MaxLimit {
+        return f, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+    }
+    if f.Offset, err = parseInt(q.Get("offset"), "offset", 0); err != nil {
+        return f, err
+    }
+    if f.Offset < 0 {
+        return f, errors.New("offset must not be negative")
+    }
+    return f, nil
+}
+
+// parseStatus reads "404" or a class such as "4xx".
+func parseStatus(s string) (int, int, error) {
+    if len(s) == 3 && strings.ToLower(s[1:]) == "xx" && s[0] >= '1' && s[0] <= '5' {
+        class := int(s[0]-'0') * 100
+        return class, class + 99, nil
+    }
+    status, err := strconv.Atoi(s)
+    if err != nil || status < 100 || status > 999 {
+        return 0, 0, fmt.Errorf("status must be a code such as 404 or a class such as 4xx, not %q", s)
+    }
+    return status, status, nil
+}
+
+func parseTime(q url.Values, name string) (time.Time, error) {
+    v := q.Get(name)
+    if v == "" {
+        return time.Time{}, nil
+    }
+    t, err := time.Parse(time.RFC3339, v)
+    if err != nil {
+        return t, fmt.Errorf("%s must be an RFC 3339 time such as 2006-01-02T15:04:05Z, not %q", name, v)
+    }
+    return t, nil
+}
+
+func parseInt(s, name string, def int) (int, error) {
+    if s == "" {
+        return def, nil
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, fmt.Errorf("%s must be a number, not %q", name, s)
+    }
+    return n, nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+    w.Header().Set("Allow", allow)
+    writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+    writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(v)
+}
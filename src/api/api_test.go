@@ -0,0 +1,254 @@
+package api_test
+
+import (
+    . "api"
+    "capture"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// memStore keeps flows in memory and records the filters it is given.
+type memStore struct {
+    flows    map[int64]*capture.Response
+    queried  capture.Filter
+    deleted  *capture.Filter
+    findings capture.FindingFilter
+}
+
+func (s *memStore) Query(f capture.Filter) ([]*capture.Response, error) {
+    s.queried = f
+    var flows []*capture.Response
+    for _, r := range s.flows {
+        flows = append(flows, r)
+    }
+    return flows, nil
+}
+
+func (s *memStore) Get(id int64) (*capture.Response, error) {
+    if r, ok := s.flows[id]; ok {
+        return r, nil
+    }
+    return nil, capture.ErrNotFound
+}
+
+func (s *memStore) Delete(f capture.Filter) (int64, error) {
+    s.deleted = &f
+    if f.ID != 0 {
+        if _, ok := s.flows[f.ID]; !ok {
+            return 0, nil
+        }
+        delete(s.flows, f.ID)
+        return 1, nil
+    }
+    n := int64(len(s.flows))
+    s.flows = map[int64]*capture.Response{}
+    return n, nil
+}
+
+func (s *memStore) Findings(f capture.FindingFilter) ([]*capture.Finding, error) {
+    s.findings = f
+    return []*capture.Finding{{FlowID: "f1", Check: "cookie-flags", Severity: capture.SeverityLow}}, nil
+}
+
+func newStore() *memStore {
+    return &memStore{flows: map[int64]*capture.Response{
+        1: {ID: 1, Host: "example.com", Status: 200, Body: []byte("hello")},
+    }}
+}
+
+func do(h http.Handler, method, target, token string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, target, nil)
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, req)
+    return w
+}
+
+func TestListFilters(t *testing.T) {
+    store := newStore()
+    w := do(New(store, nil, ""), "GET", "/api/flows?host=*.example.com&method=post&status=4xx&content_type=text/html&since=2020-01-02T03:04:05Z&q=token&limit=10&offset=20", "")
+    if w.Code != 200 {
+        t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+    }
+    expected := capture.Filter{
+        Host: "*.example.com", Method: "post", StatusMin: 400, StatusMax: 499,
+        ContentType: "text/html", Since: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+        Search: "token", Limit: 10, Offset: 20,
+    }
+    if store.queried != expected {
+        t.Errorf("Expected filter %+v, got %+v", expected, store.queried)
+    }
+    var body struct {
+        Flows []*capture.Response `json:"flows"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Flows) != 1 || body.Flows[0].Host != "example.com" {
+        t.Errorf("Unexpected list %s (%v)", w.Body, err)
+    }
+}
+
+func TestBadFilters(t *testing.T) {
+    for _, query := range []string{"status=6xx", "status=abc", "since=yesterday", "limit=0", "limit=5000", "offset=-1"} {
+        if w := do(New(newStore(), nil, ""), "GET", "/api/flows?"+query, ""); w.Code != 400 {
+            t.Errorf("Expected 400 for %s, got %d", query, w.Code)
+        }
+    }
+}
+
+func TestGetAndDelete(t *testing.T) {
+    store := newStore()
+    h := New(store, nil, "")
+    if w := do(h, "GET", "/api/flows/1", ""); w.Code != 200 {
+        t.Errorf("Expected 200, got %d", w.Code)
+    }
+    if w := do(h, "GET", "/api/flows/2", ""); w.Code != 404 {
+        t.Errorf("Expected 404, got %d", w.Code)
+    }
+    if w := do(h, "DELETE", "/api/flows/1", ""); w.Code != 200 || len(store.flows) != 0 {
+        t.Errorf("Expected flow deleted, got %d", w.Code)
+    }
+    if w := do(h, "DELETE", "/api/flows/1", ""); w.Code != 404 {
+        t.Errorf("Expected 404 deleting twice, got %d", w.Code)
+    }
+}
+
+func TestDeleteEverythingNeedsAll(t *testing.T) {
+    store := newStore()
+    h := New(store, nil, "")
+    if w := do(h, "DELETE", "/api/flows", ""); w.Code != 400 || store.deleted != nil {
+        t.Errorf("Expected unfiltered delete refused, got %d", w.Code)
+    }
+    if w := do(h, "DELETE", "/api/flows?all=1", ""); w.Code != 200 || len(store.flows) != 0 {
+        t.Errorf("Expected everything deleted, got %d", w.Code)
+    }
+}
+
+func TestToken(t *testing.T) {
+    h := New(newStore(), nil, "secret")
+    if w := do(h, "GET", "/api/flows", ""); w.Code != 401 {
+        t.Errorf("Expected 401 without token, got %d", w.Code)
+    }
+    if w := do(h, "GET", "/api/flows", "wrong"); w.Code != 401 {
+        t.Errorf("Expected 401 with a wrong token, got %d", w.Code)
+    }
+    if w := do(h, "GET", "/api/flows", "secret"); w.Code != 200 {
+        t.Errorf("Expected 200 with the token, got %d", w.Code)
+    }
+}
+
+func TestLive(t *testing.T) {
+    live := capture.NewLive(2)
+    h := New(nil, live, "")
+    for _, host := range []string{"a.com", "b.com", "c.com"} {
+        live.Write(&capture.Response{Host: host, Body: []byte("body")})
+    }
+    var body struct {
+        Flows []*capture.Response `json:"flows"`
+        Last  int64               `json:"last"`
+    }
+    w := do(h, "GET", "/api/live?after=0", "")
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+        t.Fatal(err)
+    }
+    if body.Last != 3 || len(body.Flows) != 2 || body.Flows[0].Host != "b.com" || body.Flows[0].ID != 2 || body.Flows[0].Body != nil {
+        t.Errorf("Expected the 2 latest flows without bodies, got %s", w.Body)
+    }
+    if w := do(h, "GET", "/api/live/3", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"body": "Ym9keQ=="`) {
+        t.Errorf("Expected flow 3 with its body, got %d %s", w.Code, w.Body)
+    }
+    if w := do(h, "GET", "/api/live/1", ""); w.Code != 404 {
+        t.Errorf("Expected flow 1 forgotten, got %d", w.Code)
+    }
+    if w := do(h, "GET", "/api/flows", ""); w.Code != 404 {
+        t.Errorf("Expected no stored flows without a store, got %d", w.Code)
+    }
+}
+
+func TestDiff(t *testing.T) {
+    store := newStore()
+    store.flows[2] = &capture.Response{ID: 2, Host: "example.com", Status: 403, Body: []byte("denied")}
+    h := New(store, nil, "")
+    w := do(h, "GET", "/api/diff?a=1&b=2&format=text", "")
+    if w.Code != 200 || !strings.Contains(w.Body.String(), "status 200 -> 403\n") || !strings.Contains(w.Body.String(), "-hello\n+denied\n") {
+        t.Errorf("Unexpected diff %d %s", w.Code, w.Body)
+    }
+    if w := do(h, "GET", "/api/diff?a=1&b=3", ""); w.Code != 404 {
+        t.Errorf("Expected 404 for a missing flow, got %d", w.Code)
+    }
+    // context=0 means none, as diff -U 0 and wyproxy diff -U 0 do
+    store.flows[4] = &capture.Response{ID: 4, Status: 200, ContentType: "text/plain", Body: []byte("a\nb\nc\n")}
+    store.flows[5] = &capture.Response{ID: 5, Status: 200, ContentType: "text/plain", Body: []byte("a\nB\nc\n")}
+    if w := do(h, "GET", "/api/diff?a=4&b=5&format=text", ""); !strings.Contains(w.Body.String(), " a\n-b\n+B\n c\n") {
+        t.Errorf("Expected context by default, got %s", w.Body)
+    }
+    if w := do(h, "GET", "/api/diff?a=4&b=5&format=text&context=0", ""); strings.Contains(w.Body.String(), " a\n") || !strings.Contains(w.Body.String(), "-b\n+B\n") {
+        t.Errorf("Expected no context, got %s", w.Body)
+    }
+}
+
+func TestFindings(t *testing.T) {
+    store := newStore()
+    h := New(store, nil, "")
+    w := do(h, "GET", "/api/findings?flow_id=f1&severity=low&limit=5", "")
+    expected := capture.FindingFilter{FlowID: "f1", Severity: "low", Limit: 5}
+    if w.Code != 200 || store.findings != expected || !strings.Contains(w.Body.String(), `"check": "cookie-flags"`) {
+        t.Errorf("Unexpected findings %d %s for %+v", w.Code, w.Body, store.findings)
+    }
+    if w := do(h, "GET", "/api/findings?severity=critical", ""); w.Code != 400 {
+        t.Errorf("Expected 400 for an unknown severity, got %d", w.Code)
+    }
+}
+
+func TestCrossSiteWrites(t *testing.T) {
+    store := newStore()
+    h := New(store, nil, "")
+    h.UIHost = "wyproxy"
+    send := func(method, target string, header http.Header) int {
+        var body io.Reader
+        if method == "POST" {
+            body = strings.NewReader("{}")
+        }
+        req := httptest.NewRequest(method, target, body)
+        req.Host = "wyproxy"
+        for name, values := range header {
+            req.Header[name] = values
+        }
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, req)
+        return w.Code
+    }
+    for _, test := range []struct {
+        method, target string
+        header         http.Header
+        expected       int
+    }{
+        // a no-cors fetch or a form from a browsed page
+        {"POST", "/api/flows/1/replay", http.Header{"Content-Type": {"text/plain"}}, 415},
+        {"POST", "/api/flows/1/replay", nil, 415},
+        {"POST", "/api/flows/1/replay", http.Header{"Content-Type": {"application/json"}, "Origin": {"http://evil.example"}}, 403},
+        {"POST", "/api/flows/1/replay", http.Header{"Content-Type": {"application/json"}, "Sec-Fetch-Site": {"cross-site"}}, 403},
+        {"POST", "/api/flows/1/replay", http.Header{"Content-Type": {"application/json"}, "Origin": {"null"}}, 403},
+        {"DELETE", "/api/flows/1", http.Header{"Origin": {"http://evil.example"}}, 403},
+        {"DELETE", "/api/flows?all=1", http.Header{"Sec-Fetch-Site": {"same-site"}}, 403},
+        {"DELETE", "/api/flows/1", http.Header{"Content-Type": {"text/plain"}}, 415},
+        // replays are not available, but the request got through
+        {"POST", "/api/flows/1/replay", http.Header{"Content-Type": {"application/json; charset=utf-8"}}, 404},
+        {"POST", "/api/flows/1/replay", http.Header{"Content-Type": {"application/json"}, "Origin": {"https://wyproxy"}, "Sec-Fetch-Site": {"same-origin"}}, 404},
+    } {
+        if code := send(test.method, test.target, test.header); code != test.expected {
+            t.Errorf("%s %s %v: expected %d, got %d", test.method, test.target, test.header, test.expected, code)
+        }
+    }
+    if len(store.flows) != 1 || store.deleted != nil {
+        t.Fatalf("Expected nothing deleted, got %v", store.deleted)
+    }
+    if code := send("DELETE", "/api/flows/1", http.Header{"Origin": {"http://wyproxy"}}); code != 200 {
+        t.Errorf("Expected a delete from the UI to pass, got %d", code)
+    }
+}
@@ -0,0 +1,214 @@
+// Package cacert serves the certificate of the CA signing the intercepted
+// hosts, so that phones, browsers and VMs can be set up to trust the proxy
+// without digging the PEM file out of the source tree:
+//
+//	/                 a page with the fingerprints and install notes
+//	/ca.pem           PEM, for Firefox, Linux and most tools
+//	/ca.cer           DER, for Windows and Android
+//	/ca.mobileconfig  configuration profile, for iOS and macOS
+//
+// Links are relative, the handler can be mounted under any prefix.
+package cacert
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "html"
+    "html/template"
+    "net/http"
+    "strings"
+    texttemplate "text/template"
+    "time"
+)
+
+// Handler serves the CA certificate cert, DER encoded.
+func Handler(cert []byte) (http.Handler, error) {
+    parsed, err := x509.ParseCertificate(cert)
+    if err != nil {
+        return nil, fmt.Errorf("cacert: %v", err)
+    }
+    return &handler{der: cert, cert: parsed}, nil
+}
+
+type handler struct {
+    der  []byte
+    cert *x509.Certificate
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var (
+        body  []byte
+        ctype string
+    )
+    switch r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:] {
+    case "", "index.html":
+        body, ctype = h.page(), "text/html; charset=utf-8"
+    case "ca.pem":
+        body, ctype = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: h.der}), "application/x-pem-file"
+    case "ca.cer":
+        body, ctype = h.der, "application/x-x509-ca-cert"
+    case "ca.mobileconfig":
+        body, ctype = h.mobileconfig(), "application/x-apple-aspen-config"
+    default:
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", ctype)
+    w.Header().Set("Cache-Control", "no-store")
+    w.Write(body)
+}
+
+// fingerprint formats a digest as browsers show it, AB:CD:...
+func fingerprint(sum []byte) string {
+    s := strings.ToUpper(hex.EncodeToString(sum))
+    var pairs []string
+    for i := 0; i < len(s); i += 2 {
+        pairs = append(pairs, s[i:i+2])
+    }
+    return strings.Join(pairs, ":")
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>wyproxy CA certificate</title>
+<style>
+body { font: 15px sans-serif; color: #222; max-width: 760px; margin: 20px auto; padding: 0 12px; }
+h1 { font-size: 20px; } h2 { font-size: 16px; margin-top: 24px; }
+a.button { display: inline-block; margin: 4px 8px 4px 0; padding: 8px 14px; background: #2d3e50; color: #fff; text-decoration: none; border-radius: 3px; }
+code { font-size: 12px; word-break: break-all; }
+td { padding: 2px 10px 2px 0; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>wyproxy CA certificate</h1>
+<p>Install and trust this certificate on the device to browse HTTPS sites through the proxy without warnings.
+Anyone holding the matching private key can intercept the device's traffic: remove it once done testing.</p>
+<p>
+<a class="button" href="ca.pem">PEM (ca.pem)</a>
+<a class="button" href="ca.cer">DER (ca.cer)</a>
+<a class="button" href="ca.mobileconfig">iOS / macOS profile</a>
+</p>
+<table>
+<tr><td>Subject</td><td>{{.Subject}}</td></tr>
+<tr><td>Valid until</td><td>{{.NotAfter}}</td></tr>
+<tr><td>SHA-256</td><td><code>{{.SHA256}}</code></td></tr>
+<tr><td>SHA-1</td><td><code>{{.SHA1}}</code></td></tr>
+</table>
+<h2>iOS</h2>
+<p>Open this page in Safari and download the profile, install it from Settings, General, VPN &amp; Device Management,
+then turn on full trust in Settings, General, About, Certificate Trust Settings.</p>
+<h2>Android</h2>
+<p>Download ca.cer and install it from Settings, Security, Encryption &amp; credentials, Install a certificate, CA certificate.
+Apps targeting Android 7 or later only trust user CAs when their network security configuration allows it.</p>
+<h2>macOS</h2>
+<p>Install the profile from System Settings, Privacy &amp; Security, Profiles, or add ca.pem to the System keychain with
+<code>sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain ca.pem</code>.</p>
+<h2>Windows</h2>
+<p>Open ca.cer, Install Certificate, Local Machine, and place it in Trusted Root Certification Authorities, or run
+<code>certutil -addstore -f Root ca.cer</code> as an administrator.</p>
+<h2>Linux</h2>
+<p>Debian and Ubuntu: <code>sudo cp ca.pem /usr/local/share/ca-certificates/wyproxy.crt &amp;&amp; sudo update-ca-certificates</code>.
+Fedora: <code>sudo cp ca.pem /etc/pki/ca-trust/source/anchors/wyproxy.pem &amp;&amp; sudo update-ca-trust</code>.</p>
+<h2>Firefox</h2>
+<p>Firefox keeps its own store: Settings, Privacy &amp; Security, Certificates, View Certificates, Authorities, Import ca.pem,
+and trust it to identify websites.</p>
+</body>
+</html>
+`))
+
+func (h *handler) page() []byte {
+    sha256sum, sha1sum := sha256.Sum256(h.der), sha1.Sum(h.der)
+    var b bytes.Buffer
+    page.Execute(&b, map[string]string{
+        "Subject":  h.cert.Subject.String(),
+        "NotAfter": h.cert.NotAfter.UTC().Format(time.RFC1123),
+        "SHA256":   fingerprint(sha256sum[:]),
+        "SHA1":     fingerprint(sha1sum[:]),
+    })
+    return b.Bytes()
+}
+
+// uuid derives a UUID from the certificate, so that installing the
+// profile of the same CA again replaces the previous one.
+func (h *handler) uuid(salt string) string {
+    sum := sha256.Sum256(append([]byte(salt), h.der...))
+    sum[6] = sum[6]&0x0f | 0x50
+    sum[8] = sum[8]&0x3f | 0x80
+    s := hex.EncodeToString(sum[:16])
+    return strings.ToUpper(s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:])
+}
+
+// profile is XML, its values are escaped by mobileconfig.
+var profile = texttemplate.Must(texttemplate.New("profile").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>PayloadContent</key>
+    <array>
+        <dict>
+            <key>PayloadCertificateFileName</key>
+            <string>wyproxy-ca.cer</string>
+            <key>PayloadContent</key>
+            <data>{{.Data}}</data>
+            <key>PayloadDescription</key>
+            <string>Adds the wyproxy CA certificate</string>
+            <key>PayloadDisplayName</key>
+            <string>{{.Name}}</string>
+            <key>PayloadIdentifier</key>
+            <string>wyproxy.ca.{{.CertUUID}}</string>
+            <key>PayloadType</key>
+            <string>com.apple.security.root</string>
+            <key>PayloadUUID</key>
+            <string>{{.CertUUID}}</string>
+            <key>PayloadVersion</key>
+            <integer>1</integer>
+        </dict>
+    </array>
+    <key>PayloadDescription</key>
+    <string>Trusts the CA of the wyproxy intercepting proxy. Remove it once done testing.</string>
+    <key>PayloadDisplayName</key>
+    <string>wyproxy CA</string>
+    <key>PayloadIdentifier</key>
+    <string>wyproxy.profile.{{.ProfileUUID}}</string>
+    <key>PayloadRemovalDisallowed</key>
+    <false/>
+    <key>PayloadType</key>
+    <string>Configuration</string>
+    <key>PayloadUUID</key>
+    <string>{{.ProfileUUID}}</string>
+    <key>PayloadVersion</key>
+    <integer>1</integer>
+</dict>
+</plist>
+`))
+
+// mobileconfig is an Apple configuration profile holding the certificate
+// as a root payload.
+func (h *handler) mobileconfig() []byte {
+    name := h.cert.Subject.CommonName
+    if name == "" {
+        name = "wyproxy CA"
+    }
+    var b bytes.Buffer
+    profile.Execute(&b, map[string]string{
+        "Data":        base64.StdEncoding.EncodeToString(h.der),
+        "Name":        html.EscapeString(name),
+        "CertUUID":    h.uuid("payload"),
+        "ProfileUUID": h.uuid("profile"),
+    })
+    return b.Bytes()
+}
@@ -0,0 +1,82 @@
+package cacert_test
+
+import (
+    "bytes"
+    . "cacert"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/pem"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testCA(t *testing.T) []byte {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "Test <CA>"},
+        NotBefore:             time.Now(),
+        NotAfter:              time.Now().Add(time.Hour),
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageCertSign,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return der
+}
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+    return w
+}
+
+func TestFormats(t *testing.T) {
+    der := testCA(t)
+    h, err := Handler(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if w := get(h, "/ca.cer"); !bytes.Equal(w.Body.Bytes(), der) || w.Header().Get("Content-Type") != "application/x-x509-ca-cert" {
+        t.Errorf("Expected the DER certificate, got %s", w.Header().Get("Content-Type"))
+    }
+    if block, _ := pem.Decode(get(h, "/ca.pem").Body.Bytes()); block == nil || !bytes.Equal(block.Bytes, der) {
+        t.Error("Expected the PEM certificate")
+    }
+    profile := get(h, "/ca.mobileconfig").Body.String()
+    if !strings.Contains(profile, "<data>"+base64.StdEncoding.EncodeToString(der)+"</data>") ||
+        !strings.Contains(profile, "<string>Test &lt;CA&gt;</string>") ||
+        !strings.Contains(profile, "com.apple.security.root") {
+        t.Errorf("Unexpected profile\n%s", profile)
+    }
+    if again := get(h, "/ca.mobileconfig").Body.String(); again != profile {
+        t.Error("Expected the same profile, with the same UUIDs, every time")
+    }
+    page := get(h, "/").Body.String()
+    if !strings.Contains(page, `href="ca.mobileconfig"`) || !strings.Contains(page, `CN=Test \&lt;CA\&gt;`) {
+        t.Errorf("Unexpected page\n%s", page)
+    }
+    if w := get(h, "/ca.key"); w.Code != 404 {
+        t.Errorf("Expected 404, got %d", w.Code)
+    }
+}
+
+func TestBadCertificate(t *testing.T) {
+    if _, err := Handler([]byte("not a certificate")); err == nil {
+        t.Error("Expected an error")
+    }
+}
@@ -0,0 +1,321 @@
+package capture
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// BatchSink is implemented by sinks that can store several flows at once
+// more cheaply than one by one.
+type BatchSink interface {
+    CaptureSink
+    WriteBatch(flows []*Response) error
+}
+
+// PartialError is returned by a WriteBatch that stored all the flows but
+// Flows, which it dropped or could not write.
+type PartialError struct {
+    Flows []*Response
+    // Err is why the first of Flows was refused.
+    Err error
+}
+
+func (e *PartialError) Error() string {
+    return fmt.Sprintf("capture: %d flows dropped: %v", len(e.Flows), e.Err)
+}
+
+// FullPolicy decides what a BatchWriter does when its queue is full.
+type FullPolicy int
+
+const (
+    // Block makes Write wait for room in the queue, slowing the proxy down
+    // to the speed of the sink.
+    Block FullPolicy = iota
+    // Drop discards the flow and counts it in BatchStats.Dropped.
+    Drop
+)
+
+// BatchOptions configures a BatchWriter, zero fields take the defaults below.
+type BatchOptions struct {
+    QueueSize     int
+    BatchSize     int
+    FlushInterval time.Duration
+    Policy        FullPolicy
+}
+
+const (
+    DefaultQueueSize     = 4096
+    DefaultBatchSize     = 100
+    DefaultFlushInterval = time.Second
+)
+
+// BatchStats are the running counters of a BatchWriter, messages and
+// findings are counted with the flows.
+type BatchStats struct {
+    Queued  int    `json:"queued"`
+    Written uint64 `json:"written"`
+    Dropped uint64 `json:"dropped"`
+    Failed  uint64 `json:"failed"`
+}
+
+// ErrSinkClosed is returned by writes to a closed BatchWriter.
+var ErrSinkClosed = errors.New("capture: sink closed")
+
+// BatchWriter is a CaptureSink that queues flows and hands them to another
+// sink from a single goroutine, in batches of up to BatchSize flows or
+// every FlushInterval, whichever comes first. It is a MessageSink and a
+// FindingSink as well, messages and findings share the queue and are
+// passed on if the other sink takes them.
+type BatchWriter struct {
+    next  CaptureSink
+    opts  BatchOptions
+    queue chan queued
+    flush chan chan error
+    done  chan struct{}
+
+    // closed guards queue against sends after Close.
+    mu     sync.RWMutex
+    closed bool
+
+    written, dropped, failed uint64
+}
+
+// NewBatchWriter starts a writer feeding next.
+func NewBatchWriter(next CaptureSink, opts BatchOptions) *BatchWriter {
+    if opts.QueueSize <= 0 {
+        opts.QueueSize = DefaultQueueSize
+    }
+    if opts.BatchSize <= 0 {
+        opts.BatchSize = DefaultBatchSize
+    }
+    if opts.FlushInterval <= 0 {
+        opts.FlushInterval = DefaultFlushInterval
+    }
+    w := &BatchWriter{
+        next:  next,
+        opts:  opts,
+        queue: make(chan queued, opts.QueueSize),
+        flush: make(chan chan error),
+        done:  make(chan struct{}),
+    }
+    go w.loop()
+    return w
+}
+
+// queued is a flow, a message or a finding waiting in the queue.
+type queued struct {
+    flow    *Response
+    msg     *Message
+    finding *Finding
+}
+
+// Write queues r, see FullPolicy for what happens when the queue is full.
+func (w *BatchWriter) Write(r *Response) error {
+    return w.enqueue(queued{flow: r})
+}
+
+// WriteMessages queues msgs like flows.
+func (w *BatchWriter) WriteMessages(msgs []*Message) error {
+    for _, m := range msgs {
+        if err := w.enqueue(queued{msg: m}); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// WriteFindings queues findings like flows.
+func (w *BatchWriter) WriteFindings(findings []*Finding) error {
+    for _, f := range findings {
+        if err := w.enqueue(queued{finding: f}); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (w *BatchWriter) enqueue(q queued) error {
+    w.mu.RLock()
+    defer w.mu.RUnlock()
+    if w.closed {
+        return ErrSinkClosed
+    }
+    if w.opts.Policy == Drop {
+        select {
+        case w.queue <- q:
+        default:
+            atomic.AddUint64(&w.dropped, 1)
+        }
+        return nil
+    }
+    w.queue <- q
+    return nil
+}
+
+// Flush writes everything queued so far and flushes the underlying sink.
+func (w *BatchWriter) Flush() error {
+    w.mu.RLock()
+    defer w.mu.RUnlock()
+    if w.closed {
+        return ErrSinkClosed
+    }
+    reply := make(chan error)
+    w.flush <- reply
+    return <-reply
+}
+
+// Close drains the queue and closes the underlying sink.
+func (w *BatchWriter) Close() error {
+    w.mu.Lock()
+    if w.closed {
+        w.mu.Unlock()
+        return ErrSinkClosed
+    }
+    w.closed = true
+    close(w.queue)
+    w.mu.Unlock()
+    <-w.done
+    return w.next.Close()
+}
+
+// Stats returns a snapshot of the writer's counters.
+func (w *BatchWriter) Stats() BatchStats {
+    return BatchStats{
+        Queued:  len(w.queue),
+        Written: atomic.LoadUint64(&w.written),
+        Dropped: atomic.LoadUint64(&w.dropped),
+        Failed:  atomic.LoadUint64(&w.failed),
+    }
+}
+
+func (w *BatchWriter) loop() {
+    defer close(w.done)
+    ticker := time.NewTicker(w.opts.FlushInterval)
+    defer ticker.Stop()
+
+    batch := make([]queued, 0, w.opts.BatchSize)
+    for {
+        select {
+        case q, ok := <-w.queue:
+            if !ok {
+                w.writeBatch(batch)
+                return
+            }
+            batch = append(batch, q)
+            if len(batch) >= w.opts.BatchSize {
+                w.writeBatch(batch)
+                batch = batch[:0]
+            }
+        case <-ticker.C:
+            w.writeBatch(batch)
+            batch = batch[:0]
+            if err := w.next.Flush(); err != nil {
+                log.Printf("capture: flushing sink: %v", err)
+            }
+        case reply := <-w.flush:
+            // Take whatever is already queued so Flush covers every Write
+            // that returned before it.
+            for n := len(w.queue); n > 0; n-- {
+                batch = append(batch, <-w.queue)
+            }
+            err := w.writeBatch(batch)
+            batch = batch[:0]
+            if ferr := w.next.Flush(); err == nil {
+                err = ferr
+            }
+            reply <- err
+        }
+    }
+}
+
+// writeBatch writes the flows of batch, then its messages and findings.
+func (w *BatchWriter) writeBatch(queue []queued) error {
+    var (
+        batch    []*Response
+        msgs     []*Message
+        findings []*Finding
+    )
+    for _, q := range queue {
+        switch {
+        case q.flow != nil:
+            batch = append(batch, q.flow)
+        case q.msg != nil:
+            msgs = append(msgs, q.msg)
+        default:
+            findings = append(findings, q.finding)
+        }
+    }
+    err := w.writeFlows(batch)
+    if merr := w.writeMessages(msgs); err == nil {
+        err = merr
+    }
+    if ferr := w.writeFindings(findings); err == nil {
+        err = ferr
+    }
+    return err
+}
+
+func (w *BatchWriter) writeMessages(msgs []*Message) error {
+    ms, ok := w.next.(MessageSink)
+    if !ok || len(msgs) == 0 {
+        return nil
+    }
+    err := ms.WriteMessages(msgs)
+    if err != nil {
+        atomic.AddUint64(&w.failed, uint64(len(msgs)))
+        log.Printf("capture: writing %d messages: %v", len(msgs), err)
+    } else {
+        atomic.AddUint64(&w.written, uint64(len(msgs)))
+    }
+    return err
+}
+
+func (w *BatchWriter) writeFindings(findings []*Finding) error {
+    fs, ok := w.next.(FindingSink)
+    if !ok || len(findings) == 0 {
+        return nil
+    }
+    err := fs.WriteFindings(findings)
+    if err != nil {
+        atomic.AddUint64(&w.failed, uint64(len(findings)))
+        log.Printf("capture: writing %d findings: %v", len(findings), err)
+    } else {
+        atomic.AddUint64(&w.written, uint64(len(findings)))
+    }
+    return err
+}
+
+func (w *BatchWriter) writeFlows(batch []*Response) error {
+    if len(batch) == 0 {
+        return nil
+    }
+    var err error
+    if bs, ok := w.next.(BatchSink); ok {
+        err = bs.WriteBatch(batch)
+        if pe, ok := err.(*PartialError); ok {
+            atomic.AddUint64(&w.failed, uint64(len(pe.Flows)))
+            atomic.AddUint64(&w.written, uint64(len(batch)-len(pe.Flows)))
+        } else if err != nil {
+            atomic.AddUint64(&w.failed, uint64(len(batch)))
+        } else {
+            atomic.AddUint64(&w.written, uint64(len(batch)))
+        }
+    } else {
+        for _, r := range batch {
+            if werr := w.next.Write(r); werr != nil {
+                err = werr
+                atomic.AddUint64(&w.failed, 1)
+            } else {
+                atomic.AddUint64(&w.written, 1)
+            }
+        }
+    }
+    if err != nil {
+        log.Printf("capture: writing %d flows: %v", len(batch), err)
+    }
+    return err
+}
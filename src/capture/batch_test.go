@@ -0,0 +1,50 @@
+package capture_test
+
+import (
+    . "capture"
+    "errors"
+    "testing"
+)
+
+// refusingSink stores the flows of a batch except those whose URL is in
+// refused, as the MySQL sink does for rows the server will not take.
+type refusingSink struct {
+    stored  []*Response
+    refused map[string]bool
+}
+
+func (s *refusingSink) Write(r *Response) error { return s.WriteBatch([]*Response{r}) }
+func (s *refusingSink) Flush() error            { return nil }
+func (s *refusingSink) Close() error            { return nil }
+func (s *refusingSink) WriteBatch(flows []*Response) error {
+    var partial *PartialError
+    for _, r := range flows {
+        if !s.refused[r.URL] {
+            s.stored = append(s.stored, r)
+            continue
+        }
+        if partial == nil {
+            partial = &PartialError{Err: errors.New("duplicate flow_id")}
+        }
+        partial.Flows = append(partial.Flows, r)
+    }
+    if partial != nil {
+        return partial
+    }
+    return nil
+}
+
+func TestBatchWriterPartialFailure(t *testing.T) {
+    sink := &refusingSink{refused: map[string]bool{"http://a.com/bad": true}}
+    w := NewBatchWriter(sink, BatchOptions{BatchSize: 10})
+    for _, u := range []string{"http://a.com/1", "http://a.com/bad", "http://a.com/2"} {
+        w.Write(&Response{URL: u})
+    }
+    w.Close()
+    if stats := w.Stats(); stats.Written != 2 || stats.Failed != 1 {
+        t.Errorf("Expected 2 flows written and 1 failed, got %+v", stats)
+    }
+    if len(sink.stored) != 2 {
+        t.Errorf("Expected the good flows stored, got %d", len(sink.stored))
+    }
+}
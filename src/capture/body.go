@@ -0,0 +1,191 @@
+package capture
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+)
+
+// BodyRecorder passes a body through unchanged while keeping a copy of its
+// first Limit bytes, so large transfers stream to the client instead of
+// being buffered for the capture.
+type BodyRecorder struct {
+    rc    io.ReadCloser
+    limit int64
+    done  func(*BodyRecorder)
+    once  sync.Once
+
+    // the body is read by the proxy while the capture side may already be
+    // looking at what was recorded
+    mu   sync.Mutex
+    buf  bytes.Buffer
+    size int64
+    eof  bool
+    err  error
+}
+
+// NewBodyRecorder wraps rc, keeping up to limit bytes, or everything when
+// limit is negative. done, if not nil, is called once when the body has been
+// read to the end or closed, whichever happens first.
+func NewBodyRecorder(rc io.ReadCloser, limit int64, done func(*BodyRecorder)) *BodyRecorder {
+    return &BodyRecorder{rc: rc, limit: limit, done: done}
+}
+
+func (b *BodyRecorder) Read(p []byte) (int, error) {
+    n, err := b.rc.Read(p)
+    if n > 0 {
+        b.mu.Lock()
+        keep := int64(n)
+        if b.limit >= 0 {
+            if room := b.limit - int64(b.buf.Len()); room < keep {
+                keep = room
+            }
+        }
+        if keep > 0 {
+            b.buf.Write(p[:keep])
+        }
+        b.size += int64(n)
+        b.mu.Unlock()
+    }
+    if err != nil {
+        b.mu.Lock()
+        if err == io.EOF {
+            b.eof = true
+        } else if b.err == nil {
+            b.err = err
+        }
+        b.mu.Unlock()
+    }
+    if err == io.EOF {
+        b.finish()
+    }
+    return n, err
+}
+
+func (b *BodyRecorder) Close() error {
+    err := b.rc.Close()
+    b.mu.Lock()
+    if !b.eof && b.err == nil {
+        b.err = ErrBodyAborted
+    }
+    b.mu.Unlock()
+    b.finish()
+    return err
+}
+
+func (b *BodyRecorder) finish() {
+    b.once.Do(func() {
+        if b.done != nil {
+            b.done(b)
+        }
+    })
+}
+
+// Bytes returns the recorded prefix of the body, nil if nothing was kept.
+func (b *BodyRecorder) Bytes() []byte {
+    if b == nil {
+        return nil
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.buf.Len() == 0 {
+        return nil
+    }
+    return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Size is the number of bytes that went through so far.
+func (b *BodyRecorder) Size() int64 {
+    if b == nil {
+        return 0
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.size
+}
+
+// Truncated reports whether more went through than was recorded.
+func (b *BodyRecorder) Truncated() bool {
+    if b == nil {
+        return false
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.size > int64(b.buf.Len())
+}
+
+// Err returns the error that interrupted the body, ErrBodyAborted if it
+// was closed before the end, nil if it went through completely.
+func (b *BodyRecorder) Err() error {
+    if b == nil {
+        return nil
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.err
+}
+
+// BodyLimits are the recording caps per content type.
+type BodyLimits struct {
+    // Default applies to content types without their own cap, negative
+    // means no cap.
+    Default int64
+    // ByType is keyed by full media type ("text/html") or by top level type
+    // ("image"), the full type wins.
+    ByType map[string]int64
+}
+
+const DefaultBodyLimit = 1 << 20
+
+// ParseBodyLimits parses a comma separated list of caps such as
+//
+//	1M,image=0,video=0,text/html=4M
+//
+// The entry without a content type is the default, DefaultBodyLimit if none
+// is given.
+func ParseBodyLimits(spec string) (BodyLimits, error) {
+    l := BodyLimits{Default: DefaultBodyLimit, ByType: make(map[string]int64)}
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        ctype, size := "", entry
+        if i := strings.IndexByte(entry, '='); i >= 0 {
+            ctype, size = strings.TrimSpace(entry[:i]), entry[i+1:]
+        }
+        n, err := parseLimit(size)
+        if err != nil {
+            return l, fmt.Errorf("capture: body limit %q: %v", entry, err)
+        }
+        if ctype == "" {
+            l.Default = n
+        } else {
+            l.ByType[strings.TrimSuffix(strings.ToLower(ctype), "/*")] = n
+        }
+    }
+    return l, nil
+}
+
+func parseLimit(s string) (int64, error) {
+    if strings.TrimSpace(s) == "-1" {
+        return -1, nil
+    }
+    return ParseSize(s)
+}
+
+// For returns the cap for a media type without parameters.
+func (l BodyLimits) For(contentType string) int64 {
+    contentType = strings.ToLower(contentType)
+    if n, ok := l.ByType[contentType]; ok {
+        return n
+    }
+    if i := strings.IndexByte(contentType, '/'); i > 0 {
+        if n, ok := l.ByType[contentType[:i]]; ok {
+            return n
+        }
+    }
+    return l.Default
+}
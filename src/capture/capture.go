@@ -0,0 +1,153 @@
+// Package capture defines the flow record produced by wyproxy and the sinks
+// that persist it.
+//
+// A sink is selected by name, the same way database/sql selects a driver:
+//
+//	sink, err := capture.OpenSink("mysql", "root:@tcp(localhost:3306)/test?charset=utf8mb4")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer sink.Close()
+//	sink.Write(resp)
+//
+// Backends living outside this package register themselves with RegisterSink
+// from an init function.
+package capture
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Response is a single captured request/response pair.
+type Response struct {
+    // ID is assigned by sinks that can be read back, zero otherwise.
+    ID int64 `json:"id,omitempty" db:",json"`
+    // FlowID identifies the flow across sinks and the tables of one sink.
+    FlowID        string      `json:"flow_id,omitempty" db:",json"`
+    Origin        string      `json:"origin" db:",json"`
+    Method        string      `json:"method" db:",json"`
+    Status        int         `json:"status" db:",json"`
+    ContentType   string      `json:"content_type" db:",json"`
+    ContentLength uint        `json:"content_length" db:",json"`
+    Host          string      `json:"host" db:",json"`
+    Port          string      `json:"port" db:",json"`
+    URL           string      `json:"url" db:",json"`
+    Scheme        string      `json:"scheme" db:",json"`
+    Path          string      `json:"path" db:",path"`
+    Extension     string      `json:"ext" db:",path"`
+    Static        bool        `json:"static_resource" db:",json"`
+    Header        http.Header `json:"header,omitempty" db:",json"`
+    Body          []byte      `json:"body,omitempty" db:",json"`
+    RequestHeader http.Header `json:"request_header,omitempty" db:",json"`
+    RequestBody   []byte      `json:"request_body,omitempty" db:",json"`
+    // Bodies are recorded up to a per content type cap, these tell what
+    // went over the wire. For CONNECT tunnels passed through they count the
+    // bytes sent by the server and by the client.
+    Truncated           bool  `json:"truncated" db:",json"`
+    OriginalSize        int64 `json:"original_size" db:",json"`
+    RequestTruncated    bool  `json:"request_truncated" db:",json"`
+    RequestOriginalSize int64 `json:"request_original_size" db:",json"`
+    // RawBody is the body as received when Decode changed it and was asked
+    // to keep the original.
+    RawBody []byte `json:"raw_body,omitempty" db:",json"`
+    // Signature groups requests that only differ in parameter values, Hits
+    // counts them when the sink deduplicates.
+    Signature string `json:"signature,omitempty" db:",json"`
+    Hits      int    `json:"hits,omitempty" db:",json"`
+    // Error is set on flows that failed, Status is zero when no response
+    // was received at all. ErrorClass is one of the Error* constants.
+    Error      string `json:"error,omitempty" db:",json"`
+    ErrorClass string `json:"error_class,omitempty" db:",json"`
+    // RemoteIP is the server the request went to, Timing how long each
+    // phase of the round trip took. Both are missing when nothing was
+    // measured.
+    RemoteIP string  `json:"remote_ip,omitempty" db:",json"`
+    Timing   *Timing `json:"timing,omitempty" db:",json"`
+    // TLS is set for flows of intercepted TLS tunnels.
+    TLS *TLSInfo `json:"tls,omitempty" db:",json"`
+    // CloseReason tells which side ended a CONNECT tunnel, "client" or
+    // "server", Error is set as well when it ended with an error.
+    CloseReason string `json:"close_reason,omitempty" db:",json"`
+    // ReplayOf is the FlowID of the flow this one replays.
+    ReplayOf string `json:"replay_of,omitempty" db:",json"`
+    // Messages are the WebSocket messages of an upgraded flow. They are
+    // stored apart, through MessageSink, and only filled in when reading
+    // flows back.
+    Messages []*Message `json:"messages,omitempty" db:"-"`
+    // Params are the request parameters as a sink that stores them apart
+    // reads them back, see Params to compute them.
+    Params []Param `json:"params,omitempty" db:"-"`
+    // Findings are those of the checks of package analysis, read back like
+    // Params.
+    Findings  []*Finding `json:"findings,omitempty" db:"-"`
+    DateStart time.Time  `json:"date_start" db:",json"`
+    DateEnd   time.Time  `json:"date_end" db:",json"`
+}
+
+// NewFlowID returns a random 32 character hex flow id.
+func NewFlowID() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// CaptureSink receives every flow the proxy records.
+//
+// Write may be called from many goroutines at once. Flush pushes anything the
+// sink buffers to its backend, Close flushes and releases the backend.
+type CaptureSink interface {
+    Write(r *Response) error
+    Flush() error
+    Close() error
+}
+
+// OpenFunc creates a sink from a backend specific data source string.
+type OpenFunc func(dsn string) (CaptureSink, error)
+
+var (
+    sinksMu sync.Mutex
+    sinks   = make(map[string]OpenFunc)
+)
+
+// RegisterSink makes a sink backend available under name. It panics if
+// called twice with the same name.
+func RegisterSink(name string, open OpenFunc) {
+    sinksMu.Lock()
+    defer sinksMu.Unlock()
+    if open == nil {
+        panic("capture: RegisterSink open func is nil")
+    }
+    if _, dup := sinks[name]; dup {
+        panic("capture: RegisterSink called twice for sink " + name)
+    }
+    sinks[name] = open
+}
+
+// Sinks returns the sorted names of the registered sink backends.
+func Sinks() []string {
+    sinksMu.Lock()
+    defer sinksMu.Unlock()
+    var list []string
+    for name := range sinks {
+        list = append(list, name)
+    }
+    sort.Strings(list)
+    return list
+}
+
+// OpenSink opens the sink backend registered under name.
+func OpenSink(name, dsn string) (CaptureSink, error) {
+    sinksMu.Lock()
+    open, ok := sinks[name]
+    sinksMu.Unlock()
+    if !ok {
+        return nil, fmt.Errorf("capture: unknown sink %q (forgotten import?)", name)
+    }
+    return open(dsn)
+}
@@ -0,0 +1,277 @@
+package capture
+
+import (
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
+    "fmt"
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/japanese"
+    "golang.org/x/text/encoding/korean"
+    "golang.org/x/text/encoding/simplifiedchinese"
+    "golang.org/x/text/encoding/traditionalchinese"
+    "io"
+    "io/ioutil"
+    "regexp"
+    "strings"
+    "sync"
+    "unicode/utf8"
+)
+
+// CharsetDecoder converts text in some character set to UTF-8.
+type CharsetDecoder func(b []byte) ([]byte, error)
+
+var (
+    charsetsMu sync.RWMutex
+    charsets   = map[string]CharsetDecoder{
+        "utf-8":        decodeUTF8,
+        "us-ascii":     decodeUTF8,
+        "iso-8859-1":   decodeLatin1,
+        "windows-1252": decodeWindows1252,
+        "gbk":          decodeWith(simplifiedchinese.GBK),
+        "gb18030":      decodeWith(simplifiedchinese.GB18030),
+        "hz-gb-2312":   decodeWith(simplifiedchinese.HZGB2312),
+        "big5":         decodeWith(traditionalchinese.Big5),
+        "shift_jis":    decodeWith(japanese.ShiftJIS),
+        "euc-jp":       decodeWith(japanese.EUCJP),
+        "iso-2022-jp":  decodeWith(japanese.ISO2022JP),
+        "euc-kr":       decodeWith(korean.EUCKR),
+    }
+    charsetAliases = map[string]string{
+        "utf8":      "utf-8",
+        "ascii":     "us-ascii",
+        "latin1":    "iso-8859-1",
+        "latin-1":   "iso-8859-1",
+        "l1":        "iso-8859-1",
+        "iso8859-1": "iso-8859-1",
+        "cp1252":    "windows-1252",
+        // GB2312 pages are decoded as GBK, its superset, as browsers do
+        "gb2312":         "gbk",
+        "gb_2312-80":     "gbk",
+        "x-gbk":          "gbk",
+        "cp936":          "gbk",
+        "windows-936":    "gbk",
+        "big5-hkscs":     "big5",
+        "x-x-big5":       "big5",
+        "cn-big5":        "big5",
+        "shift-jis":      "shift_jis",
+        "sjis":           "shift_jis",
+        "x-sjis":         "shift_jis",
+        "ms_kanji":       "shift_jis",
+        "windows-31j":    "shift_jis",
+        "cp932":          "shift_jis",
+        "eucjp":          "euc-jp",
+        "x-euc-jp":       "euc-jp",
+        "euckr":          "euc-kr",
+        "ks_c_5601-1987": "euc-kr",
+        "windows-949":    "euc-kr",
+        "cp949":          "euc-kr",
+    }
+)
+
+// RegisterCharset adds or replaces the decoder used for a character set.
+// Besides UTF-8 and the Latin sets the Chinese, Japanese and Korean sets
+// from golang.org/x/text/encoding are known; others can be added here.
+func RegisterCharset(name string, dec CharsetDecoder) {
+    charsetsMu.Lock()
+    defer charsetsMu.Unlock()
+    charsets[strings.ToLower(name)] = dec
+}
+
+func lookupCharset(name string) CharsetDecoder {
+    name = strings.ToLower(strings.Trim(strings.TrimSpace(name), `"'`))
+    if alias, ok := charsetAliases[name]; ok {
+        name = alias
+    }
+    charsetsMu.RLock()
+    defer charsetsMu.RUnlock()
+    return charsets[name]
+}
+
+// Decode replaces r.Body with its decompressed, UTF-8 form. The content
+// encoding comes from r.Header, the character set from charset, typically
+// ProxyCtx.Charset(), or else from a <meta> tag or XML declaration in the
+// body. With keepRaw the original bytes are kept in r.RawBody when they
+// change. Decode keeps as much as it can of truncated bodies; it returns an
+// error for encodings it does not know, leaving r.Body as it was.
+//
+// At most limit bytes are decompressed, all of them when limit is negative.
+// A body cut there is marked Truncated, OriginalSize remaining its size on
+// the wire.
+func Decode(r *Response, charset string, keepRaw bool, limit int64) error {
+    if len(r.Body) == 0 {
+        return nil
+    }
+    raw := r.Body
+    body, cut, err := decompress(raw, r.Header.Get("Content-Encoding"), limit)
+    if err != nil {
+        return err
+    }
+    if cut && !r.Truncated {
+        r.Truncated = true
+        if r.OriginalSize == 0 {
+            r.OriginalSize = int64(len(raw))
+        }
+    }
+    if isText(r.ContentType) {
+        if charset == "" {
+            charset = sniffCharset(body)
+        }
+        if charset != "" {
+            dec := lookupCharset(charset)
+            if dec == nil {
+                err = fmt.Errorf("capture: no decoder for charset %q", charset)
+            } else if text, derr := dec(body); derr != nil {
+                err = derr
+            } else {
+                body = text
+            }
+        }
+    }
+    if !bytes.Equal(body, raw) {
+        r.Body = body
+        if keepRaw {
+            r.RawBody = raw
+        }
+    }
+    return err
+}
+
+// decompress undoes contentEncoding, keeping at most limit bytes of the
+// result, all of them when limit is negative. cut tells if it went further.
+func decompress(body []byte, contentEncoding string, limit int64) (_ []byte, cut bool, err error) {
+    codings := strings.Split(contentEncoding, ",")
+    // codings are listed in the order they were applied
+    for i := len(codings) - 1; i >= 0; i-- {
+        var (
+            zr  io.Reader
+            err error
+        )
+        switch strings.ToLower(strings.TrimSpace(codings[i])) {
+        case "", "identity":
+            continue
+        case "gzip", "x-gzip":
+            zr, err = gzip.NewReader(bytes.NewReader(body))
+        case "deflate":
+            // "deflate" is zlib wrapped deflate, though many servers send
+            // raw deflate
+            if zr, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+                zr, err = flate.NewReader(bytes.NewReader(body)), nil
+            }
+        case "zlib":
+            zr, err = zlib.NewReader(bytes.NewReader(body))
+        default:
+            return body, false, fmt.Errorf("capture: unsupported content encoding %q", codings[i])
+        }
+        if err != nil {
+            return body, false, err
+        }
+        if limit >= 0 {
+            // a small body can expand to gigabytes
+            zr = io.LimitReader(zr, limit+1)
+        }
+        out, err := ioutil.ReadAll(zr)
+        if err != nil && len(out) == 0 {
+            return body, false, err
+        }
+        if limit >= 0 && int64(len(out)) > limit {
+            out, cut = out[:limit], true
+        }
+        body = out
+    }
+    return body, cut, nil
+}
+
+func isText(ctype string) bool {
+    ctype = strings.ToLower(ctype)
+    return strings.HasPrefix(ctype, "text/") ||
+        strings.Contains(ctype, "json") ||
+        strings.Contains(ctype, "javascript") ||
+        strings.Contains(ctype, "xml") ||
+        ctype == "application/x-www-form-urlencoded"
+}
+
+var (
+    metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([\w.:-]+)`)
+    xmlEncoding = regexp.MustCompile(`(?i)^\s*<\?xml[^>]+encoding\s*=\s*["']([\w.:-]+)`)
+)
+
+// sniffCharset looks for a declared character set in the first kilobyte.
+func sniffCharset(body []byte) string {
+    head := body
+    if len(head) > 1024 {
+        head = head[:1024]
+    }
+    if m := xmlEncoding.FindSubmatch(head); m != nil {
+        return string(m[1])
+    }
+    if m := metaCharset.FindSubmatch(head); m != nil {
+        return string(m[1])
+    }
+    return ""
+}
+
+// decodeWith adapts a golang.org/x/text encoding. Invalid and truncated
+// sequences become U+FFFD rather than failing the whole body.
+func decodeWith(e encoding.Encoding) CharsetDecoder {
+    return func(b []byte) ([]byte, error) {
+        if isASCII(b) {
+            return b, nil
+        }
+        return e.NewDecoder().Bytes(b)
+    }
+}
+
+func decodeUTF8(b []byte) ([]byte, error) {
+    return b, nil
+}
+
+func decodeLatin1(b []byte) ([]byte, error) {
+    if isASCII(b) {
+        return b, nil
+    }
+    out := make([]byte, 0, len(b)+len(b)/4)
+    for _, c := range b {
+        out = appendRune(out, rune(c))
+    }
+    return out, nil
+}
+
+// windows1252 maps 0x80-0x9F, the rest of the set is Latin-1.
+var windows1252 = [32]rune{
+    0x20AC, 0xFFFD, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+    0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0xFFFD, 0x017D, 0xFFFD,
+    0xFFFD, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+    0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0xFFFD, 0x017E, 0x0178,
+}
+
+func decodeWindows1252(b []byte) ([]byte, error) {
+    if isASCII(b) {
+        return b, nil
+    }
+    out := make([]byte, 0, len(b)+len(b)/4)
+    for _, c := range b {
+        if c >= 0x80 && c < 0xA0 {
+            out = appendRune(out, windows1252[c-0x80])
+        } else {
+            out = appendRune(out, rune(c))
+        }
+    }
+    return out, nil
+}
+
+func isASCII(b []byte) bool {
+    for _, c := range b {
+        if c >= utf8.RuneSelf {
+            return false
+        }
+    }
+    return true
+}
+
+func appendRune(b []byte, r rune) []byte {
+    var buf [utf8.UTFMax]byte
+    n := utf8.EncodeRune(buf[:], r)
+    return append(b, buf[:n]...)
+}
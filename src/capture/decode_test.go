@@ -0,0 +1,73 @@
+package capture_test
+
+import (
+    "bytes"
+    . "capture"
+    "compress/gzip"
+    "net/http"
+    "testing"
+)
+
+func TestDecodeCharsets(t *testing.T) {
+    for _, test := range []struct {
+        charset  string
+        body     []byte
+        expected string
+    }{
+        {"GBK", []byte{0xd6, 0xd0, 0xce, 0xc4, 0xcd, 0xf8, 0xd2, 0xb3}, "中文网页"},
+        {"gb2312", []byte{0xd6, 0xd0, 0xce, 0xc4, 0xcd, 0xf8, 0xd2, 0xb3}, "中文网页"},
+        {"GB18030", []byte{0xd6, 0xd0, 0xce, 0xc4, 0xcd, 0xf8, 0xd2, 0xb3}, "中文网页"},
+        {"Big5", []byte{0xa4, 0xa4, 0xa4, 0xe5, 0xba, 0xf4, 0xad, 0xb6}, "中文網頁"},
+        {"Shift_JIS", []byte{0x83, 0x65, 0x83, 0x58, 0x83, 0x67}, "テスト"},
+        {"euc-kr", []byte{0xc7, 0xd1, 0xb1, 0xb9, 0xbe, 0xee}, "한국어"},
+        {"windows-1252", []byte{0x80, 0x20, 0xe9}, "€ é"},
+    } {
+        r := &Response{ContentType: "text/html", Header: http.Header{}, Body: test.body}
+        if err := Decode(r, test.charset, true, -1); err != nil {
+            t.Errorf("%s: %v", test.charset, err)
+            continue
+        }
+        if string(r.Body) != test.expected {
+            t.Errorf("%s: body %q, expected %q", test.charset, r.Body, test.expected)
+        }
+        if string(r.RawBody) != string(test.body) {
+            t.Errorf("%s: raw body %x, expected %x", test.charset, r.RawBody, test.body)
+        }
+    }
+}
+
+func TestDecodeSniffedCharset(t *testing.T) {
+    body := append([]byte(`<html><head><meta charset="gbk"></head><body>`), 0xd6, 0xd0, 0xce, 0xc4)
+    r := &Response{ContentType: "text/html", Header: http.Header{}, Body: body}
+    if err := Decode(r, "", false, -1); err != nil {
+        t.Fatal(err)
+    }
+    if expected := `<html><head><meta charset="gbk"></head><body>中文`; string(r.Body) != expected {
+        t.Errorf("body %q, expected %q", r.Body, expected)
+    }
+}
+
+func TestDecodeTruncated(t *testing.T) {
+    // a body cut in the middle of a double-byte character keeps the rest
+    r := &Response{ContentType: "text/plain", Header: http.Header{}, Body: []byte{0xd6, 0xd0, 0xce}}
+    if err := Decode(r, "gbk", false, -1); err != nil {
+        t.Fatal(err)
+    }
+    if expected := "中�"; string(r.Body) != expected {
+        t.Errorf("body %q, expected %q", r.Body, expected)
+    }
+}
+
+func TestDecodeLimit(t *testing.T) {
+    var gz bytes.Buffer
+    zw := gzip.NewWriter(&gz)
+    zw.Write(make([]byte, 16<<20))
+    zw.Close()
+    r := &Response{ContentType: "application/octet-stream", Header: http.Header{"Content-Encoding": {"gzip"}}, Body: gz.Bytes(), OriginalSize: int64(gz.Len())}
+    if err := Decode(r, "", false, 1<<20); err != nil {
+        t.Fatal(err)
+    }
+    if len(r.Body) != 1<<20 || !r.Truncated || r.OriginalSize != int64(gz.Len()) {
+        t.Errorf("Expected the body cut at the limit, got %d bytes, truncated %v, original size %d", len(r.Body), r.Truncated, r.OriginalSize)
+    }
+}
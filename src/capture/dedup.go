@@ -0,0 +1,220 @@
+package capture
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "net/url"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+)
+
+var (
+    numericSegment = regexp.MustCompile(`^-?\d+$`)
+    uuidSegment    = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+    hexSegment     = regexp.MustCompile(`^(?i)[0-9a-f]*\d[0-9a-f]*$`)
+)
+
+// PathTemplate replaces the path segments that look like identifiers, so
+// /item/12/edit and /item/13/edit share the template /item/{int}/edit.
+func PathTemplate(path string) string {
+    segments := strings.Split(path, "/")
+    for i, seg := range segments {
+        switch {
+        case seg == "":
+        case numericSegment.MatchString(seg):
+            segments[i] = "{int}"
+        case uuidSegment.MatchString(seg):
+            segments[i] = "{uuid}"
+        case len(seg) >= 16 && hexSegment.MatchString(seg):
+            segments[i] = "{hex}"
+        }
+    }
+    return strings.Join(segments, "/")
+}
+
+// ParamNames returns the sorted, distinct names of the parameters a request
+// carries in its query string, urlencoded or multipart form and JSON body.
+// JSON keys are flattened to paths such as user.address.zip; array indexes
+// are left out so lists of any length give the same names.
+func ParamNames(r *Response) []string {
+    names := make(map[string]bool)
+    if u, err := url.Parse(r.URL); err == nil {
+        for name := range u.Query() {
+            names["query:"+name] = true
+        }
+    }
+    for _, p := range bodyParams(r) {
+        names[p.Location+":"+p.Name] = true
+    }
+    list := make([]string, 0, len(names))
+    for name := range names {
+        list = append(list, name)
+    }
+    sort.Strings(list)
+    return list
+}
+
+// Signature identifies requests that differ only in parameter values: it
+// hashes the method, host, port, PathTemplate and ParamNames.
+func Signature(r *Response) string {
+    h := sha1.New()
+    parts := []string{r.Method, strings.ToLower(r.Host), r.Port, PathTemplate(r.Path)}
+    parts = append(parts, ParamNames(r)...)
+    h.Write([]byte(strings.Join(parts, "\n")))
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// HitCounter is implemented by sinks that can count repeats of an already
+// stored signature instead of storing the flow again. AddHits adds all the
+// hits or, when it fails, none of them.
+type HitCounter interface {
+    AddHits(hits map[string]int) error
+}
+
+// SignatureLister is implemented by sinks that can tell which signatures
+// they already hold, so deduplication survives a restart.
+type SignatureLister interface {
+    Signatures() ([]string, error)
+}
+
+// DedupSink passes on the first flow of every signature and counts the
+// repeats, handing the counts to the next sink on Flush if it is a
+// HitCounter. Flows without a Signature are always passed on.
+type DedupSink struct {
+    next CaptureSink
+
+    mu      sync.Mutex
+    seen    map[string]bool
+    pending map[string]int
+}
+
+// NewDedupSink wraps next, loading the signatures it already holds.
+func NewDedupSink(next CaptureSink) (*DedupSink, error) {
+    d := &DedupSink{next: next, seen: make(map[string]bool), pending: make(map[string]int)}
+    if lister, ok := next.(SignatureLister); ok {
+        sigs, err := lister.Signatures()
+        if err != nil {
+            return nil, err
+        }
+        for _, sig := range sigs {
+            d.seen[sig] = true
+        }
+    }
+    return d, nil
+}
+
+// filter returns the flows of batch seeing their signature for the first
+// time, counting the others.
+func (d *DedupSink) filter(batch []*Response) []*Response {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    var fresh []*Response
+    for _, r := range batch {
+        switch {
+        case r.Signature == "":
+            fresh = append(fresh, r)
+        case d.seen[r.Signature]:
+            d.pending[r.Signature]++
+        default:
+            d.seen[r.Signature] = true
+            r.Hits = 1
+            fresh = append(fresh, r)
+        }
+    }
+    return fresh
+}
+
+// forget undoes filter for flows the next sink did not store, so that the
+// next flow of their signature is stored rather than counted. The repeats
+// counted since were counted against them and are dropped.
+func (d *DedupSink) forget(flows []*Response) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for _, r := range flows {
+        if r.Signature != "" {
+            delete(d.seen, r.Signature)
+            delete(d.pending, r.Signature)
+        }
+    }
+}
+
+func (d *DedupSink) Write(r *Response) error {
+    if fresh := d.filter([]*Response{r}); len(fresh) > 0 {
+        if err := d.next.Write(r); err != nil {
+            d.forget(fresh)
+            return err
+        }
+    }
+    return nil
+}
+
+func (d *DedupSink) WriteBatch(batch []*Response) error {
+    fresh := d.filter(batch)
+    if len(fresh) == 0 {
+        return nil
+    }
+    if bs, ok := d.next.(BatchSink); ok {
+        err := bs.WriteBatch(fresh)
+        if pe, ok := err.(*PartialError); ok {
+            d.forget(pe.Flows)
+        } else if err != nil {
+            d.forget(fresh)
+        }
+        return err
+    }
+    for i, r := range fresh {
+        if err := d.next.Write(r); err != nil {
+            d.forget(fresh[i:])
+            return err
+        }
+    }
+    return nil
+}
+
+// WriteMessages passes messages on untouched, if the next sink takes them.
+func (d *DedupSink) WriteMessages(msgs []*Message) error {
+    if ms, ok := d.next.(MessageSink); ok {
+        return ms.WriteMessages(msgs)
+    }
+    return nil
+}
+
+// WriteFindings passes findings on, if the next sink takes them. Those of
+// the flows left out are kept, they still tell about the endpoint.
+func (d *DedupSink) WriteFindings(findings []*Finding) error {
+    if fs, ok := d.next.(FindingSink); ok {
+        return fs.WriteFindings(findings)
+    }
+    return nil
+}
+
+// Flush hands the pending hit counts to the next sink, then flushes it.
+// Counts the sink fails to add are kept for the next Flush.
+func (d *DedupSink) Flush() error {
+    d.mu.Lock()
+    hits := d.pending
+    d.pending = make(map[string]int)
+    d.mu.Unlock()
+
+    if hc, ok := d.next.(HitCounter); ok && len(hits) > 0 {
+        if err := hc.AddHits(hits); err != nil {
+            d.mu.Lock()
+            for sig, n := range hits {
+                d.pending[sig] += n
+            }
+            d.mu.Unlock()
+            return err
+        }
+    }
+    return d.next.Flush()
+}
+
+func (d *DedupSink) Close() error {
+    err := d.Flush()
+    if cerr := d.next.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
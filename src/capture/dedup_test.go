@@ -0,0 +1,130 @@
+package capture_test
+
+import (
+    . "capture"
+    "errors"
+    "net/http"
+    "testing"
+)
+
+func TestPathTemplate(t *testing.T) {
+    for path, expected := range map[string]string{
+        "/item/12/edit": "/item/{int}/edit",
+        "/u/3f2504e0-4f89-11d3-9a0c-0305e82c3301": "/u/{uuid}",
+        "/blob/0123456789abcdef0123":              "/blob/{hex}",
+        "/static/app.js":                          "/static/app.js",
+        "/deadbeefdeadbeef/":                      "/deadbeefdeadbeef/",
+    } {
+        if actual := PathTemplate(path); actual != expected {
+            t.Errorf("PathTemplate(%q) = %q, expected %q", path, actual, expected)
+        }
+    }
+}
+
+func TestSignatureIgnoresValues(t *testing.T) {
+    form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+    json := http.Header{"Content-Type": {"application/json"}}
+    a := &Response{Method: "POST", Host: "a.com", Port: "80", Path: "/item/1", URL: "http://a.com/item/1?id=1&x=2",
+        RequestHeader: form, RequestBody: []byte("name=a&pw=b")}
+    b := &Response{Method: "POST", Host: "A.com", Port: "80", Path: "/item/2", URL: "http://a.com/item/2?x=9&id=3",
+        RequestHeader: form, RequestBody: []byte("pw=c&name=d")}
+    if Signature(a) != Signature(b) {
+        t.Error("Requests differing only in values have different signatures")
+    }
+    b.RequestBody = []byte("pw=c")
+    if Signature(a) == Signature(b) {
+        t.Error("Requests with different form fields have the same signature")
+    }
+
+    c := &Response{Method: "PUT", Path: "/u", URL: "http://a.com/u", RequestHeader: json,
+        RequestBody: []byte(`{"user":{"address":{"zip":"1"}},"tags":[1,2]}`)}
+    names := ParamNames(c)
+    if len(names) != 2 || names[0] != "json:tags" || names[1] != "json:user.address.zip" {
+        t.Error("Unexpected JSON parameter names", names)
+    }
+}
+
+type memorySink struct {
+    flows []*Response
+    hits  map[string]int
+    // hitsErr fails AddHits
+    hitsErr error
+}
+
+func (s *memorySink) Write(r *Response) error { s.flows = append(s.flows, r); return nil }
+func (s *memorySink) Flush() error            { return nil }
+func (s *memorySink) Close() error            { return nil }
+func (s *memorySink) AddHits(hits map[string]int) error {
+    if s.hitsErr != nil {
+        return s.hitsErr
+    }
+    for sig, n := range hits {
+        s.hits[sig] += n
+    }
+    return nil
+}
+
+func TestDedupSink(t *testing.T) {
+    mem := &memorySink{hits: make(map[string]int)}
+    d, err := NewDedupSink(mem)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.Write(&Response{Signature: "a"})
+    d.WriteBatch([]*Response{{Signature: "a"}, {Signature: "b"}, {Signature: "a"}, {}})
+    if err := d.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    if len(mem.flows) != 3 {
+        t.Errorf("Stored %d flows, expected 3", len(mem.flows))
+    }
+    if mem.hits["a"] != 2 || mem.hits["b"] != 0 {
+        t.Error("Unexpected hit counts", mem.hits)
+    }
+}
+
+func TestDedupSinkFailedHits(t *testing.T) {
+    mem := &memorySink{hits: make(map[string]int), hitsErr: errors.New("connection lost")}
+    d, err := NewDedupSink(mem)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.WriteBatch([]*Response{{Signature: "a"}, {Signature: "a"}, {Signature: "a"}})
+    if err := d.Flush(); err == nil {
+        t.Fatal("Expected the failed hit counts reported")
+    }
+    mem.hitsErr = nil
+    d.Write(&Response{Signature: "a"})
+    if err := d.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    if mem.hits["a"] != 3 {
+        t.Errorf("Expected the hits of the failed flush kept, got %d", mem.hits["a"])
+    }
+}
+
+func TestDedupSinkFailedWrite(t *testing.T) {
+    sink := &refusingSink{refused: map[string]bool{"http://a.com/1": true}}
+    d, err := NewDedupSink(sink)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = d.WriteBatch([]*Response{
+        {Signature: "a", URL: "http://a.com/1"},
+        {Signature: "a", URL: "http://a.com/2"},
+        {Signature: "b", URL: "http://a.com/3"},
+    })
+    if _, ok := err.(*PartialError); !ok {
+        t.Fatalf("Expected a partial error, got %v", err)
+    }
+    // the first flow of a was lost, the next one is stored in its place
+    d.Write(&Response{Signature: "a", URL: "http://a.com/4"})
+    d.Write(&Response{Signature: "b", URL: "http://a.com/5"})
+    var urls []string
+    for _, r := range sink.stored {
+        urls = append(urls, r.URL)
+    }
+    if len(urls) != 2 || urls[0] != "http://a.com/3" || urls[1] != "http://a.com/4" {
+        t.Errorf("Unexpected flows stored %v", urls)
+    }
+}
@@ -0,0 +1,81 @@
+package capture
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "io"
+    "net"
+    "strings"
+    "syscall"
+)
+
+// Error classes stored in Response.ErrorClass.
+const (
+    ErrorDNS     = "dns"
+    ErrorRefused = "refused"
+    ErrorTimeout = "timeout"
+    ErrorTLS     = "tls"
+    ErrorReset   = "reset"
+    ErrorEOF     = "eof"
+    ErrorAborted = "aborted"
+    ErrorOther   = "other"
+)
+
+// ErrBodyAborted is reported by a BodyRecorder closed before the body was
+// read to the end, usually because the client went away.
+var ErrBodyAborted = errors.New("capture: body closed before the end")
+
+// ClassifyError tells what kind of failure err is, "" for a nil err.
+func ClassifyError(err error) string {
+    if err == nil {
+        return ""
+    }
+    var (
+        dnsErr   *net.DNSError
+        netErr   net.Error
+        recErr   tls.RecordHeaderError
+        alertErr tls.AlertError
+        authErr  x509.UnknownAuthorityError
+        hostErr  x509.HostnameError
+        certErr  x509.CertificateInvalidError
+    )
+    switch {
+    case errors.Is(err, ErrBodyAborted):
+        return ErrorAborted
+    case errors.As(err, &dnsErr):
+        return ErrorDNS
+    case errors.Is(err, syscall.ECONNREFUSED):
+        return ErrorRefused
+    case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+        return ErrorTimeout
+    case errors.As(err, &recErr), errors.As(err, &alertErr), errors.As(err, &authErr),
+        errors.As(err, &hostErr), errors.As(err, &certErr):
+        return ErrorTLS
+    case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+        return ErrorReset
+    case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+        return ErrorEOF
+    }
+    // http.Transport flattens some errors into strings
+    msg := err.Error()
+    switch {
+    case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+        return ErrorTLS
+    case strings.Contains(msg, "connection reset"):
+        return ErrorReset
+    case strings.Contains(msg, "EOF"):
+        return ErrorEOF
+    }
+    return ErrorOther
+}
+
+// SetError records err and its class on r.
+func (r *Response) SetError(err error) {
+    if err == nil {
+        r.Error, r.ErrorClass = "", ""
+        return
+    }
+    r.Error, r.ErrorClass = err.Error(), ClassifyError(err)
+}
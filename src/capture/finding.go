@@ -0,0 +1,76 @@
+package capture
+
+import (
+    "time"
+)
+
+// Severities of a Finding, from the least to the most severe.
+const (
+    SeverityInfo   = "info"
+    SeverityLow    = "low"
+    SeverityMedium = "medium"
+    SeverityHigh   = "high"
+)
+
+var severityRanks = map[string]int{SeverityInfo: 1, SeverityLow: 2, SeverityMedium: 3, SeverityHigh: 4}
+
+// SeverityRank orders severities, it is zero for unknown ones.
+func SeverityRank(severity string) int {
+    return severityRanks[severity]
+}
+
+// Finding is something a check noticed in the flow FlowID, see package
+// analysis.
+type Finding struct {
+    // ID is assigned by sinks that can be read back, zero otherwise.
+    ID     int64  `json:"id,omitempty"`
+    FlowID string `json:"flow_id"`
+    // Check is the id of the check that reported it.
+    Check    string `json:"check"`
+    Severity string `json:"severity"`
+    Title    string `json:"title"`
+    // Evidence is the part of the flow that shows the problem, such as the
+    // header or the line of the body. Secrets and personal data are masked.
+    Evidence string `json:"evidence,omitempty"`
+    // Location is where the evidence is, one of the Location* constants,
+    // and Start and End its byte offsets in that body as stored. Location
+    // is empty for findings about the flow as a whole.
+    Location string `json:"location,omitempty"`
+    Start    int    `json:"start,omitempty"`
+    End      int    `json:"end,omitempty"`
+    // Context is set when the body is not stored, as for static resources:
+    // it is the text around the evidence, masked the same way, and Start
+    // and End are offsets in Context instead.
+    Context string `json:"context,omitempty"`
+    // Method and URL repeat the flow's, findings outlive flows left out by
+    // deduplication.
+    Method string    `json:"method"`
+    URL    string    `json:"url"`
+    Date   time.Time `json:"date"`
+}
+
+// Locations of the evidence of a Finding.
+const (
+    LocationRequestBody  = "request_body"
+    LocationResponseBody = "response_body"
+)
+
+// FindingSink is implemented by sinks that store findings.
+type FindingSink interface {
+    WriteFindings(findings []*Finding) error
+}
+
+// FindingFilter selects findings, its zero fields match everything.
+type FindingFilter struct {
+    FlowID string
+    Check  string
+    // Severity is the least severity listed.
+    Severity string
+    Limit    int
+    Offset   int
+}
+
+// FindingStore is implemented by sinks that can read findings back.
+type FindingStore interface {
+    Findings(f FindingFilter) ([]*Finding, error)
+}
@@ -0,0 +1,369 @@
+package capture
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "io"
+    "mime"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// HAR is a HTTP Archive 1.2 document, see
+// http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+    Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+    Version string     `json:"version"`
+    Creator HARCreator `json:"creator"`
+    Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+    Name    string `json:"name"`
+    Version string `json:"version"`
+}
+
+type HAREntry struct {
+    StartedDateTime string      `json:"startedDateTime"`
+    Time            float64     `json:"time"`
+    Request         HARRequest  `json:"request"`
+    Response        HARResponse `json:"response"`
+    Cache           struct{}    `json:"cache"`
+    Timings         HARTimings  `json:"timings"`
+    ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+    Comment         string      `json:"comment,omitempty"`
+    // WebSocketMessages is the custom field browsers export WebSocket
+    // traffic in.
+    WebSocketMessages []HARWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+// HARWebSocketMessage is a message as Chrome's HAR export writes it: type
+// is "send" or "receive", time in seconds since the epoch, binary data
+// base64 encoded.
+type HARWebSocketMessage struct {
+    Type   string  `json:"type"`
+    Time   float64 `json:"time"`
+    Opcode int     `json:"opcode"`
+    Data   string  `json:"data"`
+    // Truncated and OriginalSize are set when Data was cut, see Message.
+    Truncated    bool  `json:"_truncated,omitempty"`
+    OriginalSize int64 `json:"_originalSize,omitempty"`
+}
+
+type HARRequest struct {
+    Method      string         `json:"method"`
+    URL         string         `json:"url"`
+    HTTPVersion string         `json:"httpVersion"`
+    Cookies     []HARCookie    `json:"cookies"`
+    Headers     []HARNameValue `json:"headers"`
+    QueryString []HARNameValue `json:"queryString"`
+    PostData    *HARPostData   `json:"postData,omitempty"`
+    HeadersSize int            `json:"headersSize"`
+    BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+    Status      int            `json:"status"`
+    StatusText  string         `json:"statusText"`
+    HTTPVersion string         `json:"httpVersion"`
+    Cookies     []HARCookie    `json:"cookies"`
+    Headers     []HARNameValue `json:"headers"`
+    Content     HARContent     `json:"content"`
+    RedirectURL string         `json:"redirectURL"`
+    HeadersSize int            `json:"headersSize"`
+    BodySize    int            `json:"bodySize"`
+    // Error is a custom field, in the style of the browsers' HAR exports,
+    // set for flows that failed.
+    Error string `json:"_error,omitempty"`
+}
+
+type HARNameValue struct {
+    Name  string `json:"name"`
+    Value string `json:"value"`
+}
+
+type HARCookie struct {
+    Name     string `json:"name"`
+    Value    string `json:"value"`
+    Path     string `json:"path,omitempty"`
+    Domain   string `json:"domain,omitempty"`
+    Expires  string `json:"expires,omitempty"`
+    HTTPOnly bool   `json:"httpOnly,omitempty"`
+    Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+    MimeType string         `json:"mimeType"`
+    Params   []HARNameValue `json:"params"`
+    Text     string         `json:"text"`
+    // Encoding is not part of HAR 1.2 but understood by most readers, it is
+    // set to "base64" for binary request bodies.
+    Encoding string `json:"encoding,omitempty"`
+}
+
+type HARContent struct {
+    // Size is the length of the whole decoded body, Compression the bytes
+    // the content encoding saved on the wire.
+    Size        int    `json:"size"`
+    Compression int    `json:"compression,omitempty"`
+    MimeType    string `json:"mimeType"`
+    Text        string `json:"text,omitempty"`
+    Encoding    string `json:"encoding,omitempty"`
+}
+
+// HARTimings are in milliseconds, -1 marks a phase that does not apply or
+// was not measured.
+type HARTimings struct {
+    Blocked float64 `json:"blocked"`
+    DNS     float64 `json:"dns"`
+    Connect float64 `json:"connect"`
+    Send    float64 `json:"send"`
+    Wait    float64 `json:"wait"`
+    Receive float64 `json:"receive"`
+    SSL     float64 `json:"ssl"`
+}
+
+// NewHAR converts captured flows into a HAR document, in the given order.
+func NewHAR(flows []*Response, creatorVersion string) *HAR {
+    h := &HAR{Log: HARLog{
+        Version: "1.2",
+        Creator: HARCreator{Name: "wyproxy", Version: creatorVersion},
+        Entries: make([]HAREntry, 0, len(flows)),
+    }}
+    for _, r := range flows {
+        h.Log.Entries = append(h.Log.Entries, NewHAREntry(r))
+    }
+    return h
+}
+
+// WriteHAR encodes flows as an indented HAR document to w.
+func WriteHAR(w io.Writer, flows []*Response, creatorVersion string) error {
+    js, err := json.MarshalIndent(NewHAR(flows, creatorVersion), "", "  ")
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(append(js, '\n'))
+    return err
+}
+
+// NewHAREntry converts a single flow.
+func NewHAREntry(r *Response) HAREntry {
+    wait := float64(r.DateEnd.Sub(r.DateStart)) / float64(time.Millisecond)
+    if wait < 0 {
+        wait = 0
+    }
+    e := HAREntry{
+        StartedDateTime: r.DateStart.Format(time.RFC3339Nano),
+        Time:            wait,
+        Request: HARRequest{
+            Method:      r.Method,
+            URL:         r.URL,
+            HTTPVersion: "HTTP/1.1",
+            Cookies:     harCookies((&http.Request{Header: r.RequestHeader}).Cookies()),
+            Headers:     harHeaders(r.RequestHeader),
+            QueryString: harQuery(r.URL),
+            PostData:    harPostData(r),
+            HeadersSize: -1,
+            BodySize:    wireSize(r.RequestBody, r.RequestTruncated, r.RequestOriginalSize),
+        },
+        Response: HARResponse{
+            Status:      r.Status,
+            StatusText:  http.StatusText(r.Status),
+            HTTPVersion: "HTTP/1.1",
+            Cookies:     harCookies((&http.Response{Header: r.Header}).Cookies()),
+            Headers:     harHeaders(r.Header),
+            Content:     harContent(r),
+            RedirectURL: r.Header.Get("Location"),
+            HeadersSize: -1,
+            BodySize:    wireSize(r.Body, r.Truncated, r.OriginalSize),
+            Error:       r.Error,
+        },
+        Timings:         harTimings(r.Timing, wait),
+        ServerIPAddress: r.RemoteIP,
+    }
+    var comment []string
+    if r.Origin != "" {
+        comment = append(comment, "client "+r.Origin)
+    }
+    if r.ReplayOf != "" {
+        comment = append(comment, "replay of "+r.ReplayOf)
+    }
+    e.Comment = strings.Join(comment, ", ")
+    for _, m := range r.Messages {
+        hm := HARWebSocketMessage{
+            Type:   "receive",
+            Time:   float64(m.Date.UnixNano()) / float64(time.Second),
+            Opcode: m.Opcode,
+            Data:   string(m.Payload),
+        }
+        if m.Truncated {
+            hm.Truncated, hm.OriginalSize = true, m.OriginalSize
+        }
+        if m.Direction == "client" {
+            hm.Type = "send"
+        }
+        if m.Opcode != 1 {
+            hm.Data = base64.StdEncoding.EncodeToString(m.Payload)
+        }
+        e.WebSocketMessages = append(e.WebSocketMessages, hm)
+    }
+    return e
+}
+
+// harTimings converts measured phases, HAR counts the TLS handshake in
+// connect as well. Without measurements the whole flow is taken as wait.
+func harTimings(t *Timing, total float64) HARTimings {
+    if t == nil {
+        return HARTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: total, Receive: 0, SSL: -1}
+    }
+    connect := t.Connect
+    if connect >= 0 && t.TLS >= 0 {
+        connect += t.TLS
+    }
+    return HARTimings{
+        Blocked: -1,
+        DNS:     t.DNS,
+        Connect: connect,
+        SSL:     t.TLS,
+        Send:    nonNegative(t.Send),
+        Wait:    nonNegative(t.TTFB),
+        Receive: nonNegative(t.Transfer),
+    }
+}
+
+// nonNegative is for the HAR timings that cannot be -1.
+func nonNegative(ms float64) float64 {
+    if ms < 0 {
+        return 0
+    }
+    return ms
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+    list := []HARNameValue{}
+    var keys []string
+    for k := range h {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        for _, v := range h[k] {
+            list = append(list, HARNameValue{k, v})
+        }
+    }
+    return list
+}
+
+func harValues(v url.Values) []HARNameValue {
+    list := []HARNameValue{}
+    var keys []string
+    for k := range v {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        for _, vv := range v[k] {
+            list = append(list, HARNameValue{k, vv})
+        }
+    }
+    return list
+}
+
+func harQuery(rawurl string) []HARNameValue {
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return []HARNameValue{}
+    }
+    q, _ := url.ParseQuery(u.RawQuery)
+    return harValues(q)
+}
+
+func harCookies(cookies []*http.Cookie) []HARCookie {
+    list := []HARCookie{}
+    for _, c := range cookies {
+        hc := HARCookie{
+            Name:     c.Name,
+            Value:    c.Value,
+            Path:     c.Path,
+            Domain:   c.Domain,
+            HTTPOnly: c.HttpOnly,
+            Secure:   c.Secure,
+        }
+        if !c.Expires.IsZero() {
+            hc.Expires = c.Expires.Format(time.RFC3339)
+        }
+        list = append(list, hc)
+    }
+    return list
+}
+
+func harPostData(r *Response) *HARPostData {
+    if len(r.RequestBody) == 0 {
+        return nil
+    }
+    ctype := r.RequestHeader.Get("Content-Type")
+    pd := &HARPostData{MimeType: ctype, Params: []HARNameValue{}}
+    if mt, _, _ := mime.ParseMediaType(ctype); mt == "application/x-www-form-urlencoded" {
+        if form, err := url.ParseQuery(string(r.RequestBody)); err == nil {
+            pd.Params = harValues(form)
+        }
+    }
+    pd.Text, pd.Encoding = harText(r.RequestBody)
+    return pd
+}
+
+// maxHARDecoded bounds the decompression of bodies stored as received, done
+// only to measure them.
+const maxHARDecoded = 64 << 20
+
+func harContent(r *Response) HARContent {
+    c := HARContent{MimeType: r.Header.Get("Content-Type")}
+    if c.MimeType == "" {
+        c.MimeType = r.ContentType
+    }
+    if c.MimeType == "" {
+        c.MimeType = "x-unknown"
+    }
+    wire := wireSize(r.Body, r.Truncated, r.OriginalSize)
+    c.Size = wire
+    if enc := r.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") && !r.Truncated {
+        // the decoded length of a truncated body is not known, nor that of
+        // one expanding past maxHARDecoded
+        c.Size = len(r.Body)
+        if r.RawBody == nil && len(r.Body) == wire {
+            // stored as received, not decoded
+            if body, cut, err := decompress(r.Body, enc, maxHARDecoded); err == nil && !cut {
+                c.Size = len(body)
+            }
+        }
+        if c.Size > wire {
+            c.Compression = c.Size - wire
+        }
+    }
+    c.Text, c.Encoding = harText(r.Body)
+    return c
+}
+
+// wireSize is the length of a body as sent, which the flow records apart
+// when it was cut or decoded.
+func wireSize(body []byte, truncated bool, originalSize int64) int {
+    if truncated || originalSize > 0 {
+        return int(originalSize)
+    }
+    return len(body)
+}
+
+// harText returns body as text, base64 encoded unless it is valid UTF-8.
+func harText(body []byte) (text, encoding string) {
+    if utf8.Valid(body) && !strings.ContainsRune(string(body), 0) {
+        return string(body), ""
+    }
+    return base64.StdEncoding.EncodeToString(body), "base64"
+}
@@ -0,0 +1,37 @@
+package capture_test
+
+import (
+    "bytes"
+    . "capture"
+    "compress/gzip"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestHARContentSize(t *testing.T) {
+    text := strings.Repeat("hello ", 1000)
+    var gz bytes.Buffer
+    zw := gzip.NewWriter(&gz)
+    zw.Write([]byte(text))
+    zw.Close()
+    gzipped := http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"text/plain"}}
+    for _, test := range []struct {
+        name                    string
+        flow                    *Response
+        size, compression, wire int
+    }{
+        {"plain", &Response{Header: http.Header{}, Body: []byte(text)}, len(text), 0, len(text)},
+        {"truncated", &Response{Header: http.Header{}, Body: []byte(text[:100]), Truncated: true, OriginalSize: int64(len(text))}, len(text), 0, len(text)},
+        {"decoded", &Response{Header: gzipped, Body: []byte(text), RawBody: gz.Bytes(), OriginalSize: int64(gz.Len())}, len(text), len(text) - gz.Len(), gz.Len()},
+        {"decoded without raw", &Response{Header: gzipped, Body: []byte(text), OriginalSize: int64(gz.Len())}, len(text), len(text) - gz.Len(), gz.Len()},
+        {"stored compressed", &Response{Header: gzipped, Body: gz.Bytes(), OriginalSize: int64(gz.Len())}, len(text), len(text) - gz.Len(), gz.Len()},
+        {"compressed and truncated", &Response{Header: gzipped, Body: gz.Bytes()[:10], Truncated: true, OriginalSize: int64(gz.Len())}, gz.Len(), 0, gz.Len()},
+    } {
+        e := NewHAREntry(test.flow)
+        if c := e.Response.Content; c.Size != test.size || c.Compression != test.compression || e.Response.BodySize != test.wire {
+            t.Errorf("%s: size %d, compression %d, bodySize %d, expected %d, %d, %d", test.name,
+                c.Size, c.Compression, e.Response.BodySize, test.size, test.compression, test.wire)
+        }
+    }
+}
@@ -0,0 +1,312 @@
+package capture
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const DefaultJSONLPath = "requests.jsonl"
+
+func init() {
+    RegisterSink("jsonl", func(dsn string) (CaptureSink, error) {
+        return NewJSONLSink(dsn)
+    })
+}
+
+// JSONLOptions controls where a JSONLSink writes and when it starts a new
+// segment.
+type JSONLOptions struct {
+    // Path of the active segment, closed segments are renamed next to it.
+    Path string
+    // Rotate once the active segment grows past MaxSize bytes, 0 disables.
+    MaxSize int64
+    // Rotate when the wall clock hour changes.
+    Hourly bool
+    // Gzip closed segments in the background.
+    Compress bool
+}
+
+// ParseJSONLDSN parses a data source of the form
+//
+//	path/to/requests.jsonl?max_size=100M&rotate=hourly&gzip=true
+//
+// An empty path means DefaultJSONLPath.
+func ParseJSONLDSN(dsn string) (JSONLOptions, error) {
+    opts := JSONLOptions{Path: dsn}
+    if i := strings.IndexByte(dsn, '?'); i >= 0 {
+        opts.Path = dsn[:i]
+        params, err := url.ParseQuery(dsn[i+1:])
+        if err != nil {
+            return opts, fmt.Errorf("capture: invalid jsonl dsn %q: %v", dsn, err)
+        }
+        for key, values := range params {
+            value := values[len(values)-1]
+            switch key {
+            case "max_size":
+                if opts.MaxSize, err = ParseSize(value); err != nil {
+                    return opts, err
+                }
+            case "rotate":
+                switch value {
+                case "hourly", "hour":
+                    opts.Hourly = true
+                case "", "none", "size":
+                default:
+                    return opts, fmt.Errorf("capture: unknown jsonl rotation %q", value)
+                }
+            case "gzip":
+                if opts.Compress, err = strconv.ParseBool(value); err != nil {
+                    return opts, fmt.Errorf("capture: invalid jsonl gzip value %q", value)
+                }
+            default:
+                return opts, fmt.Errorf("capture: unknown jsonl parameter %q", key)
+            }
+        }
+    }
+    if opts.Path == "" {
+        opts.Path = DefaultJSONLPath
+    }
+    return opts, nil
+}
+
+// ParseSize parses a byte count with an optional K, M or G suffix.
+func ParseSize(s string) (int64, error) {
+    mult := int64(1)
+    num := strings.ToUpper(strings.TrimSpace(s))
+    num = strings.TrimSuffix(num, "B")
+    switch {
+    case strings.HasSuffix(num, "K"):
+        mult, num = 1<<10, num[:len(num)-1]
+    case strings.HasSuffix(num, "M"):
+        mult, num = 1<<20, num[:len(num)-1]
+    case strings.HasSuffix(num, "G"):
+        mult, num = 1<<30, num[:len(num)-1]
+    }
+    n, err := strconv.ParseInt(num, 10, 64)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("capture: invalid size %q", s)
+    }
+    return n * mult, nil
+}
+
+// JSONLSink writes one JSON encoded Response per line.
+type JSONLSink struct {
+    opts JSONLOptions
+
+    mu     sync.Mutex
+    f      *os.File
+    w      *bufio.Writer
+    size   int64
+    opened time.Time
+    gzips  sync.WaitGroup
+}
+
+// NewJSONLSink opens the sink described by dsn, see ParseJSONLDSN.
+func NewJSONLSink(dsn string) (*JSONLSink, error) {
+    opts, err := ParseJSONLDSN(dsn)
+    if err != nil {
+        return nil, err
+    }
+    return NewJSONLSinkOptions(opts)
+}
+
+// NewJSONLSinkOptions opens a JSONLSink, appending to an existing segment.
+func NewJSONLSinkOptions(opts JSONLOptions) (*JSONLSink, error) {
+    s := &JSONLSink{opts: opts}
+    if err := s.open(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *JSONLSink) open() error {
+    f, err := os.OpenFile(s.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    s.f, s.w, s.size, s.opened = f, bufio.NewWriter(f), fi.Size(), time.Now()
+    return nil
+}
+
+func (s *JSONLSink) Write(r *Response) error {
+    line, err := json.Marshal(r)
+    if err != nil {
+        return err
+    }
+    return s.writeLine(append(line, '\n'))
+}
+
+// messageLine is how a WebSocket message is written, type tells it apart
+// from the flows.
+type messageLine struct {
+    Type string `json:"type"`
+    *Message
+}
+
+const messageLineType = "websocket_message"
+
+// WriteMessages writes one line per message, between the flows.
+func (s *JSONLSink) WriteMessages(msgs []*Message) error {
+    for _, m := range msgs {
+        line, err := json.Marshal(messageLine{messageLineType, m})
+        if err != nil {
+            return err
+        }
+        if err := s.writeLine(append(line, '\n')); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// findingLine is how a finding is written, like messageLine.
+type findingLine struct {
+    Type string `json:"type"`
+    *Finding
+}
+
+const findingLineType = "finding"
+
+// WriteFindings writes one line per finding, between the flows.
+func (s *JSONLSink) WriteFindings(findings []*Finding) error {
+    for _, f := range findings {
+        line, err := json.Marshal(findingLine{findingLineType, f})
+        if err != nil {
+            return err
+        }
+        if err := s.writeLine(append(line, '\n')); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *JSONLSink) writeLine(line []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.f == nil {
+        return os.ErrClosed
+    }
+    if s.shouldRotate(int64(len(line))) {
+        if err := s.rotate(); err != nil {
+            return err
+        }
+    }
+    n, err := s.w.Write(line)
+    s.size += int64(n)
+    return err
+}
+
+func (s *JSONLSink) shouldRotate(next int64) bool {
+    if s.size == 0 {
+        return false
+    }
+    if s.opts.MaxSize > 0 && s.size+next > s.opts.MaxSize {
+        return true
+    }
+    return s.opts.Hourly && !s.opened.Truncate(time.Hour).Equal(time.Now().Truncate(time.Hour))
+}
+
+// rotate closes the active segment, renames it with a timestamp and opens a
+// fresh one. Must be called with s.mu held.
+func (s *JSONLSink) rotate() error {
+    if err := s.closeFile(); err != nil {
+        return err
+    }
+    ext := filepath.Ext(s.opts.Path)
+    base := strings.TrimSuffix(s.opts.Path, ext)
+    closed := fmt.Sprintf("%s-%s%s", base, s.opened.Format("20060102T150405"), ext)
+    for i := 1; fileExists(closed) || fileExists(closed+".gz"); i++ {
+        closed = fmt.Sprintf("%s-%s.%d%s", base, s.opened.Format("20060102T150405"), i, ext)
+    }
+    if err := os.Rename(s.opts.Path, closed); err != nil {
+        return err
+    }
+    if s.opts.Compress {
+        s.gzips.Add(1)
+        go func() {
+            defer s.gzips.Done()
+            if err := gzipFile(closed); err != nil {
+                log.Printf("capture: cannot compress %s: %v", closed, err)
+            }
+        }()
+    }
+    return s.open()
+}
+
+func (s *JSONLSink) closeFile() error {
+    err := s.w.Flush()
+    if cerr := s.f.Close(); err == nil {
+        err = cerr
+    }
+    s.f, s.w = nil, nil
+    return err
+}
+
+func (s *JSONLSink) Flush() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.f == nil {
+        return nil
+    }
+    return s.w.Flush()
+}
+
+// Close flushes the active segment and waits for pending compressions.
+func (s *JSONLSink) Close() error {
+    s.mu.Lock()
+    var err error
+    if s.f != nil {
+        err = s.closeFile()
+    }
+    s.mu.Unlock()
+    s.gzips.Wait()
+    return err
+}
+
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+    in, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+    if err != nil {
+        return err
+    }
+    zw := gzip.NewWriter(out)
+    zw.Name = filepath.Base(path)
+    if _, err = io.Copy(zw, in); err == nil {
+        err = zw.Close()
+    }
+    if cerr := out.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(path + ".gz")
+        return err
+    }
+    return os.Remove(path)
+}
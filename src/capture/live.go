@@ -0,0 +1,182 @@
+package capture
+
+import (
+    "sync"
+)
+
+// DefaultLiveSize is the number of flows a Live buffer keeps by default.
+const DefaultLiveSize = 1000
+
+// A Live buffer keeps at most MaxLiveBody bytes of each body, and forgets
+// its oldest flows when their bodies and messages come to more than
+// MaxLiveBytes; the stored flows keep their whole bodies.
+const (
+    MaxLiveBody  = 256 << 10
+    MaxLiveBytes = 64 << 20
+)
+
+// Live keeps the latest flows in memory so they can be watched as they
+// arrive. Each flow is given an ID from a counter of its own, unrelated to
+// the IDs of a database sink; older flows are forgotten once the buffer is
+// full.
+type Live struct {
+    mu    sync.Mutex
+    flows []*Response
+    // last is the ID of the newest flow, flows[(last-1)%size] holds it
+    last int64
+    // first is the ID of the last flow forgotten to stay under MaxLiveBytes
+    first int64
+    bytes int
+}
+
+// NewLive keeps the size latest flows, DefaultLiveSize when size is not
+// positive.
+func NewLive(size int) *Live {
+    if size <= 0 {
+        size = DefaultLiveSize
+    }
+    return &Live{flows: make([]*Response, size)}
+}
+
+// Write keeps a copy of r with its bodies cut at MaxLiveBody, it never
+// fails.
+func (l *Live) Write(r *Response) error {
+    flow := *r
+    if len(flow.Body) > MaxLiveBody {
+        if !flow.Truncated {
+            flow.Truncated, flow.OriginalSize = true, int64(len(flow.Body))
+        }
+        flow.Body = flow.Body[:MaxLiveBody]
+    }
+    if len(flow.RequestBody) > MaxLiveBody {
+        if !flow.RequestTruncated {
+            flow.RequestTruncated, flow.RequestOriginalSize = true, int64(len(flow.RequestBody))
+        }
+        flow.RequestBody = flow.RequestBody[:MaxLiveBody]
+    }
+    // the raw body is not shown
+    flow.RawBody = nil
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.last++
+    flow.ID = l.last
+    i := (l.last - 1) % int64(len(l.flows))
+    if old := l.flows[i]; old != nil {
+        l.bytes -= liveSize(old)
+    }
+    l.flows[i] = &flow
+    l.bytes += liveSize(&flow)
+    l.trim()
+    return nil
+}
+
+// trim forgets the oldest flows but the newest while the buffer holds more
+// than MaxLiveBytes.
+func (l *Live) trim() {
+    for l.bytes > MaxLiveBytes && l.oldest() < l.last-1 {
+        l.first = l.oldest() + 1
+        i := (l.first - 1) % int64(len(l.flows))
+        l.bytes -= liveSize(l.flows[i])
+        l.flows[i] = nil
+    }
+}
+
+func liveSize(r *Response) int {
+    n := len(r.Body) + len(r.RequestBody)
+    for _, m := range r.Messages {
+        n += len(m.Payload)
+    }
+    return n
+}
+
+// WriteMessages attaches WebSocket messages to their flow while it is
+// still in the buffer.
+func (l *Live) WriteMessages(msgs []*Message) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, m := range msgs {
+        if r := l.find(m.FlowID); r != nil {
+            r.Messages = append(r.Messages, m)
+            l.bytes += len(m.Payload)
+        }
+    }
+    l.trim()
+    return nil
+}
+
+// WriteFindings attaches findings to their flow like WriteMessages.
+func (l *Live) WriteFindings(findings []*Finding) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, f := range findings {
+        if r := l.find(f.FlowID); r != nil {
+            r.Findings = append(r.Findings, f)
+        }
+    }
+    return nil
+}
+
+// find returns the kept flow flowID, nil if there is none. Messages and
+// findings follow their flow closely, it looks from the newest.
+func (l *Live) find(flowID string) *Response {
+    for id := l.last; id > l.oldest(); id-- {
+        if r := l.at(id); r.FlowID == flowID {
+            return r
+        }
+    }
+    return nil
+}
+
+// oldest is the ID before the oldest flow kept.
+func (l *Live) oldest() int64 {
+    if l.last-l.first <= int64(len(l.flows)) {
+        return l.first
+    }
+    return l.last - int64(len(l.flows))
+}
+
+func (l *Live) at(id int64) *Response {
+    return l.flows[(id-1)%int64(len(l.flows))]
+}
+
+// After returns up to max flows whose ID is greater than id, oldest first,
+// with their bodies, messages and findings left out, and the ID of the
+// newest flow.
+func (l *Live) After(id int64, max int) ([]*Response, int64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if id < l.oldest() {
+        id = l.oldest()
+    }
+    if max > 0 && l.last-id > int64(max) {
+        id = l.last - int64(max)
+    }
+    var flows []*Response
+    for id++; id <= l.last; id++ {
+        flow := *l.at(id)
+        flow.Body, flow.RequestBody, flow.RawBody, flow.Messages, flow.Findings = nil, nil, nil, nil, nil
+        flows = append(flows, &flow)
+    }
+    return flows, l.last
+}
+
+// Get returns the flow id if it is still kept, nil otherwise.
+func (l *Live) Get(id int64) *Response {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if id <= l.oldest() || id > l.last {
+        return nil
+    }
+    flow := *l.at(id)
+    flow.Messages = append([]*Message(nil), flow.Messages...)
+    flow.Findings = append([]*Finding(nil), flow.Findings...)
+    return &flow
+}
+
+func (l *Live) Flush() error {
+    return nil
+}
+
+func (l *Live) Close() error {
+    return nil
+}
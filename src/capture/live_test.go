@@ -0,0 +1,28 @@
+package capture_test
+
+import (
+    . "capture"
+    "testing"
+)
+
+func TestLiveBounds(t *testing.T) {
+    live := NewLive(1000)
+    body := make([]byte, 1<<20)
+    for i := 0; i < 300; i++ {
+        live.Write(&Response{Body: body, RequestBody: []byte("small")})
+    }
+    flow := live.Get(300)
+    if flow == nil || len(flow.Body) != MaxLiveBody || !flow.Truncated || flow.OriginalSize != 1<<20 {
+        t.Fatalf("Expected the newest body cut at %d bytes", MaxLiveBody)
+    }
+    if string(flow.RequestBody) != "small" || flow.RequestTruncated {
+        t.Error("Expected the small request body kept whole")
+    }
+    flows, last := live.After(0, 0)
+    if kept := MaxLiveBytes / (MaxLiveBody + 5); last != 300 || len(flows) != kept || flows[0].ID != int64(300-kept+1) {
+        t.Errorf("Expected the %d newest flows kept, got %d from %d", kept, len(flows), flows[0].ID)
+    }
+    if live.Get(1) != nil {
+        t.Error("Expected the oldest flows forgotten")
+    }
+}
@@ -0,0 +1,28 @@
+package capture
+
+import (
+    "time"
+)
+
+// Message is a WebSocket message relayed after the upgrade of the flow
+// FlowID, control frames included.
+type Message struct {
+    FlowID string `json:"flow_id"`
+    // Seq orders the messages of a connection, both directions together.
+    Seq int `json:"seq"`
+    // Direction is the sender, "client" or "server".
+    Direction string    `json:"direction"`
+    Opcode    int       `json:"opcode"`
+    Payload   []byte    `json:"payload,omitempty"`
+    Date      time.Time `json:"date"`
+    // Truncated tells that Payload was cut at the body limit, OriginalSize
+    // is then its length as sent.
+    Truncated    bool  `json:"truncated"`
+    OriginalSize int64 `json:"original_size"`
+}
+
+// MessageSink is implemented by sinks that store WebSocket messages, the
+// others only get the upgrade flow.
+type MessageSink interface {
+    WriteMessages(msgs []*Message) error
+}
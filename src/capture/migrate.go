@@ -0,0 +1,449 @@
+package capture
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// SchemaTable records which migrations have been applied to a database.
+const SchemaTable = `schema_version`
+
+// MessageTable holds the WebSocket messages of the flows in DefaultTable,
+// linked by flow_id.
+const MessageTable = `websocket_message`
+
+// BodyTable holds the bodies of the flows in DefaultTable, one row per flow
+// that has any.
+const BodyTable = DefaultTable + `_body`
+
+// ParamTable holds the request parameters of the flows in DefaultTable,
+// one row per parameter, see Params.
+const ParamTable = DefaultTable + `_param`
+
+// FindingTable holds the findings of package analysis, linked to the flows
+// by flow_id.
+const FindingTable = `finding`
+
+// migration is one step of the MySQL schema. DDL is not transactional in
+// MySQL, so every step checks what is already there and can be run again
+// after an interrupted upgrade.
+type migration struct {
+    version     int
+    description string
+    up          func(db execer) error
+}
+
+type execer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var migrations = []migration{
+    {1, "legacy capture table", createLegacyTable},
+    {2, "body caps, raw bodies and deduplication", addCaptureColumns},
+    {3, "InnoDB, flow ids and indexes", convertInnoDB},
+    {4, "bodies in " + BodyTable, splitBodies},
+    {5, "failed flows", addErrorColumns},
+    {6, "remote address and timing", addTimingColumns},
+    {7, "TLS metadata", addTLSColumns},
+    {8, "tunnels", addTunnelColumns},
+    {9, "WebSocket messages", createMessageTable},
+    {10, "replays", addReplayColumns},
+    {11, "request parameters, of the flows recorded from now on", createParamTable},
+    {12, "passive check findings", createFindingTable},
+    {13, "offsets of findings in bodies", addFindingOffsets},
+    {14, "utf8mb4 everywhere", convertUTF8MB4},
+    {15, "context of findings in bodies not stored", addFindingContext},
+    {16, "truncation of WebSocket messages", addMessageTruncation},
+}
+
+// SchemaVersion is the version NewMySQLSink upgrades databases to.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// Migrate brings the schema of db up to SchemaVersion and returns the
+// version it started from, 0 for an empty database. Databases created before
+// versioning, with or without the later capture columns, are recognised and
+// upgraded in place. Concurrent callers wait for each other.
+func Migrate(db *sql.DB) (int, error) {
+    ctx := context.Background()
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK('wyproxy_migrate', 60)").Scan(&locked); err != nil {
+        return 0, err
+    }
+    if locked.Int64 != 1 {
+        return 0, fmt.Errorf("capture: timed out waiting for another migration")
+    }
+    defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK('wyproxy_migrate')")
+
+    if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+SchemaTable+` (
+    version int(11) NOT NULL,
+    description varchar(255) DEFAULT NULL,
+    applied_at datetime NOT NULL,
+    PRIMARY KEY (version)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`); err != nil {
+        return 0, err
+    }
+    from, err := currentVersion(conn)
+    if err != nil {
+        return 0, err
+    }
+    for _, m := range migrations {
+        if m.version <= from {
+            continue
+        }
+        if err := m.up(conn); err != nil {
+            return from, fmt.Errorf("capture: migration %d (%s): %v", m.version, m.description, err)
+        }
+        if _, err := conn.ExecContext(ctx, "INSERT INTO "+SchemaTable+" (version, description, applied_at) VALUES (?, ?, ?)", m.version, m.description, time.Now().UTC()); err != nil {
+            return from, err
+        }
+    }
+    return from, nil
+}
+
+// checkColumns fails when table lacks any of the comma separated columns.
+// Columns are only ever added by migrations, so a schema they did not
+// bring up to date stops the sink from starting instead of failing every
+// INSERT it makes.
+func checkColumns(db *sql.DB, table, columns string) error {
+    rows, err := db.Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    have := make(map[string]bool)
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return err
+        }
+        have[strings.ToLower(name)] = true
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    var missing []string
+    for _, c := range strings.Split(columns, ",") {
+        if c = strings.TrimSpace(c); !have[c] {
+            missing = append(missing, c)
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("capture: table %s has no column %s, its schema is not at version %d", table, strings.Join(missing, ", "), SchemaVersion)
+    }
+    return nil
+}
+
+// CurrentSchemaVersion returns the latest migration applied to db, 0 when
+// it has never been migrated.
+func CurrentSchemaVersion(db *sql.DB) (int, error) {
+    var exists int
+    err := db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", SchemaTable).Scan(&exists)
+    if err != nil || exists == 0 {
+        return 0, err
+    }
+    return currentVersion(db)
+}
+
+func currentVersion(db execer) (int, error) {
+    var v sql.NullInt64
+    err := db.QueryRowContext(context.Background(), "SELECT MAX(version) FROM "+SchemaTable).Scan(&v)
+    return int(v.Int64), err
+}
+
+func exec(db execer, statements ...string) error {
+    for _, stmt := range statements {
+        if _, err := db.ExecContext(context.Background(), stmt); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func count(db execer, query string, args ...interface{}) (int, error) {
+    var n int
+    err := db.QueryRowContext(context.Background(), query, args...).Scan(&n)
+    return n, err
+}
+
+func hasColumn(db execer, table, column string) (bool, error) {
+    n, err := count(db, "SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column)
+    return n > 0, err
+}
+
+func hasIndex(db execer, table, index string) (bool, error) {
+    n, err := count(db, "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?", table, index)
+    return n > 0, err
+}
+
+// addColumns adds the columns of table that are missing, in order.
+func addColumns(db execer, table string, columns [][2]string) error {
+    for _, c := range columns {
+        ok, err := hasColumn(db, table, c[0])
+        if err != nil {
+            return err
+        }
+        if !ok {
+            if err := exec(db, "ALTER TABLE "+table+" ADD COLUMN "+c[0]+" "+c[1]); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// addIndexes adds the indexes of table that are missing, each given as its
+// name and definition.
+func addIndexes(db execer, table string, indexes [][2]string) error {
+    for _, idx := range indexes {
+        ok, err := hasIndex(db, table, idx[0])
+        if err != nil {
+            return err
+        }
+        if !ok {
+            if err := exec(db, "ALTER TABLE "+table+" ADD "+idx[1]); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// createLegacyTable is the table wyproxy has always created, it is left
+// alone when it already exists.
+func createLegacyTable(db execer) error {
+    return exec(db, `CREATE TABLE IF NOT EXISTS `+DefaultTable+` (
+    id int(10) unsigned NOT NULL AUTO_INCREMENT,
+    static_resource tinyint(1) DEFAULT NULL,
+    method char(10) DEFAULT NULL,
+    status_code int(6) DEFAULT NULL,
+    content_type varchar(50) DEFAULT NULL,
+    content_length int(11) DEFAULT NULL,
+    host varchar(255) DEFAULT NULL,
+    port char(6) DEFAULT NULL,
+    url text,
+    scheme char(10) DEFAULT NULL,
+    path text,
+    header mediumtext,
+    content mediumblob,
+    request_header mediumtext,
+    request_content mediumblob,
+    date_start datetime DEFAULT NULL,
+    date_end datetime DEFAULT NULL,
+    extension char(32) DEFAULT NULL,
+    PRIMARY KEY (id)
+) ENGINE=MyISAM DEFAULT CHARSET=utf8mb4`)
+}
+
+// addCaptureColumns adds the columns of body caps, raw bodies and
+// deduplication to tables created before them, whether or not some of them
+// are already there.
+func addCaptureColumns(db execer) error {
+    return addColumns(db, DefaultTable, [][2]string{
+        {"truncated", "tinyint(1) DEFAULT NULL"},
+        {"original_size", "bigint(20) DEFAULT NULL"},
+        {"request_truncated", "tinyint(1) DEFAULT NULL"},
+        {"request_original_size", "bigint(20) DEFAULT NULL"},
+        {"raw_content", "mediumblob"},
+        {"signature", "char(40) DEFAULT NULL"},
+        {"hits", "int(11) NOT NULL DEFAULT 1"},
+    })
+}
+
+// convertInnoDB moves the table to InnoDB and utf8mb4, gives existing
+// flows a flow_id and indexes the columns flows are looked up by.
+func convertInnoDB(db execer) error {
+    var engine sql.NullString
+    err := db.QueryRowContext(context.Background(), "SELECT ENGINE FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", DefaultTable).Scan(&engine)
+    if err != nil {
+        return err
+    }
+    if engine.String != "InnoDB" {
+        if err := exec(db, "ALTER TABLE "+DefaultTable+" ENGINE=InnoDB"); err != nil {
+            return err
+        }
+    }
+    // utf8 is utf8mb3, which refuses emoji and other 4-byte characters
+    if err := toUTF8MB4(db, DefaultTable); err != nil {
+        return err
+    }
+    if err := addColumns(db, DefaultTable, [][2]string{{"flow_id", "char(32) DEFAULT NULL AFTER id"}}); err != nil {
+        return err
+    }
+    if err := exec(db, "UPDATE "+DefaultTable+" SET flow_id = REPLACE(UUID(), '-', '') WHERE flow_id IS NULL"); err != nil {
+        return err
+    }
+    return addIndexes(db, DefaultTable, [][2]string{
+        {"flow_id", "UNIQUE KEY flow_id (flow_id)"},
+        {"host", "KEY host (host)"},
+        {"status_code", "KEY status_code (status_code)"},
+        {"date_start", "KEY date_start (date_start)"},
+        {"signature", "KEY signature (signature)"},
+    })
+}
+
+// splitBodies moves the bodies out of the capture table, keeping it small
+// enough to scan and list quickly.
+func splitBodies(db execer) error {
+    err := exec(db, `CREATE TABLE IF NOT EXISTS `+BodyTable+` (
+    capture_id int(10) unsigned NOT NULL,
+    content mediumblob,
+    request_content mediumblob,
+    raw_content mediumblob,
+    PRIMARY KEY (capture_id),
+    CONSTRAINT `+BodyTable+`_capture FOREIGN KEY (capture_id) REFERENCES `+DefaultTable+` (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+    if err != nil {
+        return err
+    }
+    ok, err := hasColumn(db, DefaultTable, "content")
+    if err != nil || !ok {
+        return err
+    }
+    return exec(db,
+        "INSERT IGNORE INTO "+BodyTable+" (capture_id, content, request_content, raw_content) SELECT id, content, request_content, raw_content FROM "+DefaultTable+" WHERE content IS NOT NULL OR request_content IS NOT NULL OR raw_content IS NOT NULL",
+        "ALTER TABLE "+DefaultTable+" DROP COLUMN content, DROP COLUMN request_content, DROP COLUMN raw_content",
+    )
+}
+
+func addErrorColumns(db execer) error {
+    err := addColumns(db, DefaultTable, [][2]string{
+        {"error_message", "text"},
+        {"error_class", "varchar(16) DEFAULT NULL"},
+    })
+    if err != nil {
+        return err
+    }
+    return addIndexes(db, DefaultTable, [][2]string{{"error_class", "KEY error_class (error_class)"}})
+}
+
+func addTimingColumns(db execer) error {
+    return addColumns(db, DefaultTable, [][2]string{
+        {"remote_ip", "varchar(45) DEFAULT NULL"},
+        {"dns_ms", "double DEFAULT NULL"},
+        {"connect_ms", "double DEFAULT NULL"},
+        {"tls_ms", "double DEFAULT NULL"},
+        {"send_ms", "double DEFAULT NULL"},
+        {"ttfb_ms", "double DEFAULT NULL"},
+        {"transfer_ms", "double DEFAULT NULL"},
+    })
+}
+
+// addTLSColumns keeps the whole TLSInfo as JSON, and the upstream values
+// audits look for in their own columns.
+func addTLSColumns(db execer) error {
+    return addColumns(db, DefaultTable, [][2]string{
+        {"tls_version", "varchar(16) DEFAULT NULL"},
+        {"tls_cipher", "varchar(64) DEFAULT NULL"},
+        {"tls_cert_not_after", "datetime DEFAULT NULL"},
+        {"tls_info", "mediumtext"},
+    })
+}
+
+func addTunnelColumns(db execer) error {
+    return addColumns(db, DefaultTable, [][2]string{{"close_reason", "varchar(16) DEFAULT NULL"}})
+}
+
+func addReplayColumns(db execer) error {
+    if err := addColumns(db, DefaultTable, [][2]string{{"replay_of", "char(32) DEFAULT NULL"}}); err != nil {
+        return err
+    }
+    return addIndexes(db, DefaultTable, [][2]string{{"replay_of", "KEY replay_of (replay_of)"}})
+}
+
+func createParamTable(db execer) error {
+    return exec(db, `CREATE TABLE IF NOT EXISTS `+ParamTable+` (
+    id bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+    capture_id int(10) unsigned NOT NULL,
+    location varchar(16) NOT NULL,
+    name varchar(255) NOT NULL,
+    value text,
+    type varchar(16) NOT NULL,
+    PRIMARY KEY (id),
+    KEY capture_id (capture_id),
+    KEY name (name, location),
+    CONSTRAINT `+ParamTable+`_capture FOREIGN KEY (capture_id) REFERENCES `+DefaultTable+` (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+}
+
+func createFindingTable(db execer) error {
+    return exec(db, `CREATE TABLE IF NOT EXISTS `+FindingTable+` (
+    id bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+    flow_id char(32) NOT NULL,
+    check_id varchar(64) NOT NULL,
+    severity varchar(8) NOT NULL,
+    title varchar(255) NOT NULL,
+    evidence text,
+    method varchar(16) DEFAULT NULL,
+    url text,
+    date datetime(6) NOT NULL,
+    PRIMARY KEY (id),
+    KEY flow_id (flow_id),
+    KEY check_id (check_id),
+    KEY severity (severity)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+}
+
+// convertUTF8MB4 converts the tables created as utf8 before version 14.
+func convertUTF8MB4(db execer) error {
+    return toUTF8MB4(db, SchemaTable, DefaultTable, BodyTable, MessageTable, ParamTable, FindingTable)
+}
+
+// toUTF8MB4 converts the tables, and their text columns, that are in
+// another character set.
+func toUTF8MB4(db execer, tables ...string) error {
+    for _, table := range tables {
+        n, err := count(db, "SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND TABLE_COLLATION NOT LIKE 'utf8mb4%'", table)
+        if err != nil {
+            return err
+        }
+        if n > 0 {
+            if err := exec(db, "ALTER TABLE "+table+" CONVERT TO CHARACTER SET utf8mb4"); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func addFindingOffsets(db execer) error {
+    return addColumns(db, FindingTable, [][2]string{
+        {"location", "varchar(16) DEFAULT NULL"},
+        {"start_offset", "int(11) DEFAULT NULL"},
+        {"end_offset", "int(11) DEFAULT NULL"},
+    })
+}
+
+func addFindingContext(db execer) error {
+    return addColumns(db, FindingTable, [][2]string{{"context", "text"}})
+}
+
+func addMessageTruncation(db execer) error {
+    return addColumns(db, MessageTable, [][2]string{
+        {"truncated", "tinyint(1) DEFAULT NULL"},
+        {"original_size", "bigint(20) DEFAULT NULL"},
+    })
+}
+
+func createMessageTable(db execer) error {
+    return exec(db, `CREATE TABLE IF NOT EXISTS `+MessageTable+` (
+    id bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+    flow_id char(32) NOT NULL,
+    seq int(11) NOT NULL,
+    direction char(6) NOT NULL,
+    opcode tinyint(4) NOT NULL,
+    payload mediumblob,
+    date datetime(6) DEFAULT NULL,
+    PRIMARY KEY (id),
+    KEY flow_id (flow_id, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+}
@@ -0,0 +1,695 @@
+package capture
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "mysql"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+const (
+    DefaultMySQLDSN = "root:@tcp(localhost:3306)/test?charset=utf8mb4"
+    DefaultTable    = `capture`
+)
+
+const insertColumns = "flow_id, content_length, static_resource, extension, url, status_code, host, port, header, content_type, path, scheme, method, request_header, date_start, date_end, truncated, original_size, request_truncated, request_original_size, signature, hits, error_message, error_class, remote_ip, dns_ms, connect_ms, tls_ms, send_ms, ttfb_ms, transfer_ms, tls_version, tls_cipher, tls_cert_not_after, tls_info, close_reason, replay_of"
+
+// insertValues lists r's fields in insertColumns order.
+func insertValues(r *Response) []interface{} {
+    values := []interface{}{r.FlowID, r.ContentLength, r.Static, r.Extension, r.URL, r.Status, r.Host, r.Port, toJsonHeader(r.Header), r.ContentType, r.Path, r.Scheme, r.Method, toJsonHeader(r.RequestHeader), r.DateStart, r.DateEnd, r.Truncated, r.OriginalSize, r.RequestTruncated, r.RequestOriginalSize, nullString(r.Signature), hitCount(r), nullString(r.Error), nullString(r.ErrorClass), nullString(r.RemoteIP)}
+    var phases [6]interface{}
+    if t := r.Timing; t != nil {
+        for i, ms := range []float64{t.DNS, t.Connect, t.TLS, t.Send, t.TTFB, t.Transfer} {
+            if ms >= 0 {
+                phases[i] = ms
+            }
+        }
+    }
+    values = append(values, phases[:]...)
+
+    var version, cipher, notAfter, info interface{}
+    if r.TLS != nil {
+        if up := r.TLS.Upstream; up != nil {
+            version, cipher = up.Version, up.CipherSuite
+            if leaf := up.Leaf(); leaf != nil {
+                notAfter = leaf.NotAfter
+            }
+        }
+        info = toJsonHeader(r.TLS)
+    }
+    return append(values, version, cipher, notAfter, info, nullString(r.CloseReason), nullString(r.ReplayOf))
+}
+
+// bodyRow inserts the bodies of a flow, finding the capture row it belongs
+// to by flow_id.
+const bodyRow = "((SELECT id FROM " + DefaultTable + " WHERE flow_id = ?), ?, ?, ?)"
+
+// paramRow inserts a parameter of a flow, found by flow_id like bodyRow.
+const paramRow = "((SELECT id FROM " + DefaultTable + " WHERE flow_id = ?), ?, ?, ?, ?)"
+
+// Parameters stored per flow, and bytes per value; values are complete in
+// the request body.
+const (
+    maxParams     = 1000
+    maxParamValue = 4096
+)
+
+// maxBatchBytes keeps a multi-row INSERT below the server's default
+// max_allowed_packet.
+const maxBatchBytes = 4 << 20
+
+func init() {
+    RegisterSink("mysql", func(dsn string) (CaptureSink, error) {
+        return NewMySQLSink(dsn)
+    })
+}
+
+// MySQLSink stores flows in the capture table of a MySQL database, their
+// bodies in BodyTable.
+type MySQLSink struct {
+    db *sql.DB
+}
+
+// NewMySQLSink connects to dsn and creates or upgrades the schema with
+// Migrate, then checks the capture table has every column it writes. An
+// empty dsn means DefaultMySQLDSN.
+func NewMySQLSink(dsn string) (*MySQLSink, error) {
+    if dsn == "" {
+        dsn = DefaultMySQLDSN
+    }
+    db, err := sql.Open("mysql", dsn)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := Migrate(db); err != nil {
+        db.Close()
+        return nil, err
+    }
+    if err := checkColumns(db, DefaultTable, insertColumns); err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &MySQLSink{db: db}, nil
+}
+
+// DB returns the underlying database handle.
+func (s *MySQLSink) DB() *sql.DB {
+    return s.db
+}
+
+func (s *MySQLSink) Write(r *Response) error {
+    return s.WriteBatch([]*Response{r})
+}
+
+// WriteBatch stores flows with as few multi-row INSERTs as the packet size
+// allows. When the server refuses an INSERT, because of a single bad row
+// most often, its flows are stored one by one and those refused again are
+// logged and dropped; they are returned in a *PartialError. So are the flows
+// left when another error, such as a lost connection, stops WriteBatch after
+// some were stored.
+func (s *MySQLSink) WriteBatch(flows []*Response) error {
+    var partial *PartialError
+    stored := 0
+    // stop fails the flows from the i-th on, and those dropped before
+    stop := func(i int, err error) error {
+        if stored == 0 && partial == nil {
+            return err
+        }
+        if partial == nil {
+            partial = &PartialError{Err: err}
+        }
+        partial.Flows = append(partial.Flows, flows[i:]...)
+        return partial
+    }
+    for len(flows) > 0 {
+        n, size := 0, 0
+        for n < len(flows) && (n == 0 || size+flowSize(flows[n]) <= maxBatchBytes) {
+            size += flowSize(flows[n])
+            n++
+        }
+        err := s.insert(flows[:n])
+        if _, refused := err.(*mysql.MySQLError); refused {
+            for i, r := range flows[:n] {
+                rerr := err
+                if n > 1 {
+                    rerr = s.insert([]*Response{r})
+                }
+                if rerr == nil {
+                    stored++
+                    continue
+                }
+                if _, refused := rerr.(*mysql.MySQLError); !refused {
+                    return stop(i, rerr)
+                }
+                log.Printf("capture: dropping flow %s %s: %v", r.FlowID, r.URL, rerr)
+                if partial == nil {
+                    partial = &PartialError{Err: rerr}
+                }
+                partial.Flows = append(partial.Flows, r)
+            }
+        } else if err != nil {
+            return stop(0, err)
+        } else {
+            stored += n
+        }
+        flows = flows[n:]
+    }
+    if partial != nil {
+        return partial
+    }
+    return nil
+}
+
+// insert stores flows and their bodies in one transaction, giving flows
+// without a FlowID a new one.
+func (s *MySQLSink) insert(flows []*Response) error {
+    row := "(" + strings.Repeat("?, ", strings.Count(insertColumns, ",")) + "?)"
+    rows := make([]string, len(flows))
+    var (
+        args      []interface{}
+        bodies    []string
+        bodyArgs  []interface{}
+        paramArgs []interface{}
+    )
+    for i, r := range flows {
+        if r.FlowID == "" {
+            r.FlowID = NewFlowID()
+        }
+        rows[i] = row
+        args = append(args, insertValues(r)...)
+        if r.Body != nil || r.RequestBody != nil || r.RawBody != nil {
+            bodies = append(bodies, bodyRow)
+            bodyArgs = append(bodyArgs, r.FlowID, r.Body, r.RequestBody, r.RawBody)
+        }
+        params := Params(r)
+        if len(params) > maxParams {
+            params = params[:maxParams]
+        }
+        for _, p := range params {
+            paramArgs = append(paramArgs, r.FlowID, p.Location, truncate(p.Name, 255), strings.ToValidUTF8(truncate(p.Value, maxParamValue), "\uFFFD"), p.Type)
+        }
+    }
+
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    if _, err := tx.Exec("INSERT INTO "+DefaultTable+" ("+insertColumns+") VALUES "+strings.Join(rows, ", "), args...); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if len(bodies) > 0 {
+        if _, err := tx.Exec("INSERT INTO "+BodyTable+" (capture_id, content, request_content, raw_content) VALUES "+strings.Join(bodies, ", "), bodyArgs...); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    // a row is 5 arguments, chunks stay well below the 65535 placeholders
+    // of a statement
+    const chunk = 5 * 1000
+    for len(paramArgs) > 0 {
+        n := len(paramArgs)
+        if n > chunk {
+            n = chunk
+        }
+        rows := strings.TrimSuffix(strings.Repeat(paramRow+", ", n/5), ", ")
+        if _, err := tx.Exec("INSERT INTO "+ParamTable+" (capture_id, location, name, value, type) VALUES "+rows, paramArgs[:n]...); err != nil {
+            tx.Rollback()
+            return err
+        }
+        paramArgs = paramArgs[n:]
+    }
+    return tx.Commit()
+}
+
+// truncate cuts s to n bytes at most, on a rune boundary.
+func truncate(s string, n int) string {
+    if len(s) <= n {
+        return s
+    }
+    for n > 0 && !utf8.RuneStart(s[n]) {
+        n--
+    }
+    return s[:n]
+}
+
+// Params reads back the parameters stored for a flow.
+func (s *MySQLSink) Params(id int64) ([]Param, error) {
+    rows, err := s.db.Query("SELECT location, name, value, type FROM "+ParamTable+" WHERE capture_id = ? ORDER BY id", id)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var params []Param
+    for rows.Next() {
+        var (
+            p     Param
+            value sql.NullString
+        )
+        if err := rows.Scan(&p.Location, &p.Name, &value, &p.Type); err != nil {
+            return params, err
+        }
+        p.Value = value.String
+        params = append(params, p)
+    }
+    return params, rows.Err()
+}
+
+func flowSize(r *Response) int {
+    return len(r.Body) + len(r.RequestBody) + len(r.URL) + 1024
+}
+
+// WriteMessages stores WebSocket messages in MessageTable.
+func (s *MySQLSink) WriteMessages(msgs []*Message) error {
+    for len(msgs) > 0 {
+        n, size := 0, 0
+        for n < len(msgs) && (n == 0 || size+len(msgs[n].Payload)+128 <= maxBatchBytes) {
+            size += len(msgs[n].Payload) + 128
+            n++
+        }
+        rows := make([]string, n)
+        var args []interface{}
+        for i, m := range msgs[:n] {
+            rows[i] = "(?, ?, ?, ?, ?, ?, ?, ?)"
+            args = append(args, m.FlowID, m.Seq, m.Direction, m.Opcode, m.Payload, m.Date, m.Truncated, m.OriginalSize)
+        }
+        if _, err := s.db.Exec("INSERT INTO "+MessageTable+" (flow_id, seq, direction, opcode, payload, date, truncated, original_size) VALUES "+strings.Join(rows, ", "), args...); err != nil {
+            return err
+        }
+        msgs = msgs[n:]
+    }
+    return nil
+}
+
+// maxEvidence bounds the bytes of evidence stored per finding.
+const maxEvidence = 4096
+
+// WriteFindings stores findings in FindingTable.
+func (s *MySQLSink) WriteFindings(findings []*Finding) error {
+    const chunk = 500
+    for len(findings) > 0 {
+        n := len(findings)
+        if n > chunk {
+            n = chunk
+        }
+        rows := make([]string, n)
+        var args []interface{}
+        for i, f := range findings[:n] {
+            rows[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+            args = append(args, f.FlowID, f.Check, f.Severity, truncate(f.Title, 255),
+                truncate(strings.ToValidUTF8(f.Evidence, "\uFFFD"), maxEvidence), f.Method, f.URL, f.Date,
+                nullString(f.Location), f.Start, f.End, nullString(strings.ToValidUTF8(f.Context, "\uFFFD")))
+        }
+        if _, err := s.db.Exec("INSERT INTO "+FindingTable+" (flow_id, check_id, severity, title, evidence, method, url, date, location, start_offset, end_offset, context) VALUES "+strings.Join(rows, ", "), args...); err != nil {
+            return err
+        }
+        findings = findings[n:]
+    }
+    return nil
+}
+
+// Findings lists the findings matching f, newest first.
+func (s *MySQLSink) Findings(f FindingFilter) ([]*Finding, error) {
+    var (
+        conds []string
+        args  []interface{}
+    )
+    if f.FlowID != "" {
+        conds, args = append(conds, "flow_id = ?"), append(args, f.FlowID)
+    }
+    if f.Check != "" {
+        conds, args = append(conds, "check_id = ?"), append(args, f.Check)
+    }
+    if f.Severity != "" {
+        var marks []string
+        for severity, rank := range severityRanks {
+            if rank >= SeverityRank(f.Severity) {
+                marks, args = append(marks, "?"), append(args, severity)
+            }
+        }
+        conds = append(conds, "severity IN ("+strings.Join(marks, ", ")+")")
+    }
+    query := "SELECT id, flow_id, check_id, severity, title, evidence, method, url, date, location, start_offset, end_offset, context FROM " + FindingTable
+    if len(conds) > 0 {
+        query += " WHERE " + strings.Join(conds, " AND ")
+    }
+    query += " ORDER BY id DESC"
+    if f.Limit > 0 {
+        query += " LIMIT ? OFFSET ?"
+        args = append(args, f.Limit, f.Offset)
+    }
+    rows, err := s.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var findings []*Finding
+    for rows.Next() {
+        var (
+            fd                                       Finding
+            evidence, method, url, location, context sql.NullString
+            start, end                               sql.NullInt64
+            date                                     mysqlTime
+        )
+        if err := rows.Scan(&fd.ID, &fd.FlowID, &fd.Check, &fd.Severity, &fd.Title, &evidence, &method, &url, &date, &location, &start, &end, &context); err != nil {
+            return findings, err
+        }
+        fd.Evidence, fd.Method, fd.URL, fd.Date = evidence.String, method.String, url.String, time.Time(date)
+        fd.Location, fd.Start, fd.End, fd.Context = location.String, int(start.Int64), int(end.Int64), context.String
+        findings = append(findings, &fd)
+    }
+    return findings, rows.Err()
+}
+
+// Messages reads back the WebSocket messages of a flow, in order.
+func (s *MySQLSink) Messages(flowID string) ([]*Message, error) {
+    rows, err := s.db.Query("SELECT flow_id, seq, direction, opcode, payload, date, truncated, original_size FROM "+MessageTable+" WHERE flow_id = ? ORDER BY seq", flowID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var msgs []*Message
+    for rows.Next() {
+        var (
+            m         Message
+            date      mysqlTime
+            truncated sql.NullBool
+            size      sql.NullInt64
+        )
+        if err := rows.Scan(&m.FlowID, &m.Seq, &m.Direction, &m.Opcode, &m.Payload, &date, &truncated, &size); err != nil {
+            return msgs, err
+        }
+        m.Date = time.Time(date)
+        m.Truncated, m.OriginalSize = truncated.Bool, size.Int64
+        msgs = append(msgs, &m)
+    }
+    return msgs, rows.Err()
+}
+
+// Flush is a no-op, every Write goes straight to the database. Wrap the sink
+// in a BatchWriter to queue and batch writes.
+func (s *MySQLSink) Flush() error {
+    return nil
+}
+
+func (s *MySQLSink) Close() error {
+    return s.db.Close()
+}
+
+// AddHits adds to the hit counters of stored signatures.
+func (s *MySQLSink) AddHits(hits map[string]int) error {
+    // in one transaction, a failed Flush adds them again
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    for sig, n := range hits {
+        if _, err := tx.Exec("UPDATE "+DefaultTable+" SET hits = hits + ? WHERE signature = ?", n, sig); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// Signatures lists the distinct signatures stored so far.
+func (s *MySQLSink) Signatures() ([]string, error) {
+    rows, err := s.db.Query("SELECT DISTINCT signature FROM " + DefaultTable + " WHERE signature IS NOT NULL")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var sigs []string
+    for rows.Next() {
+        var sig string
+        if err := rows.Scan(&sig); err != nil {
+            return sigs, err
+        }
+        sigs = append(sigs, sig)
+    }
+    return sigs, rows.Err()
+}
+
+func nullString(s string) interface{} {
+    if s == "" {
+        return nil
+    }
+    return s
+}
+
+func hitCount(r *Response) int {
+    if r.Hits < 1 {
+        return 1
+    }
+    return r.Hits
+}
+
+func toJsonHeader(v interface{}) string {
+    js, err := json.Marshal(v)
+    if err != nil {
+        return ""
+    }
+    return string(js)
+}
+
+// flowColumns are the DefaultTable columns scanFlows reads, the body
+// columns follow them.
+const flowColumns = "id, flow_id, static_resource, method, status_code, content_type, content_length, host, port, url, scheme, path, header, request_header, date_start, date_end, extension, truncated, original_size, request_truncated, request_original_size, signature, hits, error_message, error_class, remote_ip, dns_ms, connect_ms, tls_ms, send_ms, ttfb_ms, transfer_ms, tls_info, close_reason, replay_of"
+
+const (
+    selectSQL = "SELECT " + flowColumns + ", content, request_content, raw_content FROM " + DefaultTable + " LEFT JOIN " + BodyTable + " ON capture_id = id"
+    // listSQL leaves the bodies out but keeps the join, conditions may
+    // still look into them.
+    listSQL = "SELECT " + flowColumns + ", NULL, NULL, NULL FROM " + DefaultTable + " LEFT JOIN " + BodyTable + " ON capture_id = id"
+)
+
+// Select reads back the flows matching the SQL condition where, which may
+// be empty, ordered by id. The condition sees the columns of both
+// DefaultTable and BodyTable.
+func (s *MySQLSink) Select(where string, args ...interface{}) ([]*Response, error) {
+    query := selectSQL
+    if where != "" {
+        query += " WHERE " + where
+    }
+    flows, err := s.scanFlows(query+" ORDER BY id", args...)
+    if err != nil {
+        return flows, err
+    }
+    return flows, s.attachMessages(flows)
+}
+
+// Query lists the flows matching f, newest first, without their bodies.
+func (s *MySQLSink) Query(f Filter) ([]*Response, error) {
+    query := listSQL
+    where, args := f.where()
+    if where != "" {
+        query += " WHERE " + where
+    }
+    query += " ORDER BY id DESC"
+    if f.Limit > 0 {
+        query += " LIMIT ? OFFSET ?"
+        args = append(args, f.Limit, f.Offset)
+    }
+    return s.scanFlows(query, args...)
+}
+
+// Get returns the flow id with its bodies, WebSocket messages, parameters
+// and findings.
+func (s *MySQLSink) Get(id int64) (*Response, error) {
+    flows, err := s.Select("id = ?", id)
+    if err != nil {
+        return nil, err
+    }
+    if len(flows) == 0 {
+        return nil, ErrNotFound
+    }
+    if flows[0].Params, err = s.Params(id); err != nil {
+        return nil, err
+    }
+    if flows[0].FlowID != "" {
+        flows[0].Findings, err = s.Findings(FindingFilter{FlowID: flows[0].FlowID})
+    }
+    return flows[0], err
+}
+
+// Delete removes the flows matching f together with their bodies,
+// WebSocket messages and findings.
+func (s *MySQLSink) Delete(f Filter) (int64, error) {
+    query := "SELECT id, flow_id FROM " + DefaultTable + " LEFT JOIN " + BodyTable + " ON capture_id = id"
+    where, args := f.where()
+    if where != "" {
+        query += " WHERE " + where
+    }
+    tx, err := s.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    rows, err := tx.Query(query+" FOR UPDATE", args...)
+    if err != nil {
+        return 0, err
+    }
+    var ids, flowIDs []interface{}
+    for rows.Next() {
+        var (
+            id     int64
+            flowID sql.NullString
+        )
+        if err := rows.Scan(&id, &flowID); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+        if flowID.Valid {
+            flowIDs = append(flowIDs, flowID.String)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    // bodies go with their flow through the foreign key
+    if err := deleteIn(tx, MessageTable, "flow_id", flowIDs); err != nil {
+        return 0, err
+    }
+    if err := deleteIn(tx, FindingTable, "flow_id", flowIDs); err != nil {
+        return 0, err
+    }
+    if err := deleteIn(tx, DefaultTable, "id", ids); err != nil {
+        return 0, err
+    }
+    return int64(len(ids)), tx.Commit()
+}
+
+// deleteIn deletes the rows of table whose column is one of values, a
+// chunk at a time.
+func deleteIn(tx *sql.Tx, table, column string, values []interface{}) error {
+    const chunk = 1000
+    for len(values) > 0 {
+        n := len(values)
+        if n > chunk {
+            n = chunk
+        }
+        marks := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+        if _, err := tx.Exec("DELETE FROM "+table+" WHERE "+column+" IN ("+marks+")", values[:n]...); err != nil {
+            return err
+        }
+        values = values[n:]
+    }
+    return nil
+}
+
+// scanFlows runs query, which selects flowColumns then the three body
+// columns.
+func (s *MySQLSink) scanFlows(query string, args ...interface{}) ([]*Response, error) {
+    rows, err := s.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var flows []*Response
+    for rows.Next() {
+        var (
+            r                                    Response
+            static, truncated, reqTruncated      sql.NullBool
+            size, reqSize, hits                  sql.NullInt64
+            flowID, signature, errMsg, errClass  sql.NullString
+            remoteIP, tlsInfo, closeReason       sql.NullString
+            replayOf                             sql.NullString
+            phases                               [6]sql.NullFloat64
+            method, ctype, host, port, url       sql.NullString
+            scheme, path, header, reqHeader, ext sql.NullString
+            status, clength                      sql.NullInt64
+            dateStart, dateEnd                   mysqlTime
+        )
+        if err := rows.Scan(&r.ID, &flowID, &static, &method, &status, &ctype, &clength, &host, &port, &url, &scheme, &path, &header, &reqHeader, &dateStart, &dateEnd, &ext, &truncated, &size, &reqTruncated, &reqSize, &signature, &hits, &errMsg, &errClass, &remoteIP, &phases[0], &phases[1], &phases[2], &phases[3], &phases[4], &phases[5], &tlsInfo, &closeReason, &replayOf, &r.Body, &r.RequestBody, &r.RawBody); err != nil {
+            return flows, err
+        }
+        r.Static = static.Bool
+        r.Truncated, r.OriginalSize = truncated.Bool, size.Int64
+        r.RequestTruncated, r.RequestOriginalSize = reqTruncated.Bool, reqSize.Int64
+        r.FlowID, r.Signature, r.Hits = flowID.String, signature.String, int(hits.Int64)
+        r.Error, r.ErrorClass = errMsg.String, errClass.String
+        r.RemoteIP, r.Timing = remoteIP.String, scanTiming(phases)
+        r.CloseReason, r.ReplayOf = closeReason.String, replayOf.String
+        r.Method, r.ContentType, r.Host, r.Port = method.String, ctype.String, host.String, port.String
+        r.URL, r.Scheme, r.Path, r.Extension = url.String, scheme.String, path.String, ext.String
+        r.Status, r.ContentLength = int(status.Int64), uint(clength.Int64)
+        r.DateStart, r.DateEnd = time.Time(dateStart), time.Time(dateEnd)
+        json.Unmarshal([]byte(header.String), &r.Header)
+        json.Unmarshal([]byte(reqHeader.String), &r.RequestHeader)
+        if tlsInfo.Valid {
+            r.TLS = new(TLSInfo)
+            json.Unmarshal([]byte(tlsInfo.String), r.TLS)
+        }
+        flows = append(flows, &r)
+    }
+    return flows, rows.Err()
+}
+
+// attachMessages reads the WebSocket messages of the upgraded flows.
+func (s *MySQLSink) attachMessages(flows []*Response) (err error) {
+    for _, r := range flows {
+        if r.Status != 101 || r.FlowID == "" {
+            continue
+        }
+        if r.Messages, err = s.Messages(r.FlowID); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// scanTiming rebuilds a Timing from its columns, nil when none is set.
+func scanTiming(phases [6]sql.NullFloat64) *Timing {
+    ms := make([]float64, len(phases))
+    measured := false
+    for i, p := range phases {
+        ms[i] = -1
+        if p.Valid {
+            ms[i], measured = p.Float64, true
+        }
+    }
+    if !measured {
+        return nil
+    }
+    return &Timing{DNS: ms[0], Connect: ms[1], TLS: ms[2], Send: ms[3], TTFB: ms[4], Transfer: ms[5]}
+}
+
+// mysqlTime scans DATETIME columns whether or not the DSN sets parseTime.
+// Without parseTime values are taken as UTC, the driver's default loc.
+type mysqlTime time.Time
+
+func (t *mysqlTime) Scan(v interface{}) error {
+    switch v := v.(type) {
+    case nil:
+        *t = mysqlTime{}
+    case time.Time:
+        *t = mysqlTime(v)
+    case []byte:
+        return t.parse(string(v))
+    case string:
+        return t.parse(v)
+    default:
+        return fmt.Errorf("capture: cannot scan %T into time", v)
+    }
+    return nil
+}
+
+func (t *mysqlTime) parse(s string) error {
+    if s == "" || strings.HasPrefix(s, "0000-00-00") {
+        *t = mysqlTime{}
+        return nil
+    }
+    pt, err := time.ParseInLocation("2006-01-02 15:04:05.999999", s, time.UTC)
+    if err != nil {
+        return err
+    }
+    *t = mysqlTime(pt)
+    return nil
+}
@@ -0,0 +1,219 @@
+package capture
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/url"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Parameter types inferred by Params.
+const (
+    ParamEmpty    = "empty"
+    ParamInt      = "int"
+    ParamFloat    = "float"
+    ParamBool     = "bool"
+    ParamNull     = "null"
+    ParamUUID     = "uuid"
+    ParamEmail    = "email"
+    ParamURL      = "url"
+    ParamDatetime = "datetime"
+    ParamJSON     = "json"
+    ParamFile     = "file"
+    ParamString   = "string"
+)
+
+// Param is a parameter of a request.
+type Param struct {
+    // Location is query, form, multipart, json or cookie.
+    Location string `json:"location"`
+    // Name is a dotted path for JSON, user.address.zip.
+    Name  string `json:"name"`
+    Value string `json:"value"`
+    // Type is one of the Param* constants.
+    Type string `json:"type"`
+}
+
+// Params lists the parameters of a request: its query string, cookies and
+// urlencoded, multipart or JSON body. JSON arrays give one parameter per
+// element, under the same name.
+func Params(r *Response) []Param {
+    var params []Param
+    if u, err := url.Parse(r.URL); err == nil {
+        for name, values := range u.Query() {
+            for _, v := range values {
+                params = append(params, Param{"query", name, v, InferType(v)})
+            }
+        }
+    }
+    for _, c := range (&http.Request{Header: r.RequestHeader}).Cookies() {
+        params = append(params, Param{"cookie", c.Name, c.Value, InferType(c.Value)})
+    }
+    params = append(params, bodyParams(r)...)
+    sort.SliceStable(params, func(i, j int) bool {
+        if params[i].Location != params[j].Location {
+            return params[i].Location < params[j].Location
+        }
+        return params[i].Name < params[j].Name
+    })
+    return params
+}
+
+var (
+    emailValue    = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+    datetimeValue = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?)?$`)
+)
+
+// InferType guesses the type of a parameter value given as text.
+func InferType(v string) string {
+    switch {
+    case v == "":
+        return ParamEmpty
+    case v == "true" || v == "false":
+        return ParamBool
+    case v == "null":
+        return ParamNull
+    }
+    if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+        return ParamInt
+    }
+    if _, err := strconv.ParseFloat(v, 64); err == nil && strings.ContainsAny(v, ".eE") {
+        return ParamFloat
+    }
+    switch {
+    case uuidSegment.MatchString(v):
+        return ParamUUID
+    case emailValue.MatchString(v):
+        return ParamEmail
+    case datetimeValue.MatchString(v):
+        return ParamDatetime
+    case strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://"):
+        return ParamURL
+    case (v[0] == '{' || v[0] == '[') && json.Valid([]byte(v)):
+        return ParamJSON
+    }
+    return ParamString
+}
+
+// jsonType is the type of a scalar decoded from JSON, strings are
+// inferred as if they were text.
+func jsonType(v interface{}) string {
+    switch v := v.(type) {
+    case nil:
+        return ParamNull
+    case bool:
+        return ParamBool
+    case float64:
+        if v == float64(int64(v)) {
+            return ParamInt
+        }
+        return ParamFloat
+    case string:
+        return InferType(v)
+    }
+    return ParamString
+}
+
+// bodyParams lists the parameters of a request body, see Params.
+func bodyParams(r *Response) []Param {
+    if len(r.RequestBody) == 0 {
+        return nil
+    }
+    var params []Param
+    mediatype, mparams, _ := mime.ParseMediaType(r.RequestHeader.Get("Content-Type"))
+    switch {
+    case mediatype == "application/x-www-form-urlencoded":
+        form, _ := url.ParseQuery(string(r.RequestBody))
+        for name, values := range form {
+            for _, v := range values {
+                params = append(params, Param{"form", name, v, InferType(v)})
+            }
+        }
+    case strings.HasPrefix(mediatype, "multipart/"):
+        for _, part := range multipartParts(r.RequestBody, mparams["boundary"]) {
+            typ := InferType(part.value)
+            if part.file {
+                typ = ParamFile
+            }
+            params = append(params, Param{"multipart", part.name, part.value, typ})
+        }
+    case strings.Contains(mediatype, "json"):
+        var v interface{}
+        if json.Unmarshal(r.RequestBody, &v) == nil {
+            flattenJSON("", v, func(path string, value interface{}) {
+                params = append(params, Param{"json", path, jsonScalar(value), jsonType(value)})
+            })
+        }
+    }
+    return params
+}
+
+// flattenJSON calls fn for every scalar in v with its dotted path.
+func flattenJSON(prefix string, v interface{}, fn func(path string, value interface{})) {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for k, vv := range v {
+            path := k
+            if prefix != "" {
+                path = prefix + "." + k
+            }
+            flattenJSON(path, vv, fn)
+        }
+    case []interface{}:
+        for _, vv := range v {
+            flattenJSON(prefix, vv, fn)
+        }
+    default:
+        fn(prefix, v)
+    }
+}
+
+func jsonScalar(v interface{}) string {
+    switch v := v.(type) {
+    case nil:
+        return ""
+    case string:
+        return v
+    }
+    js, _ := json.Marshal(v)
+    return string(js)
+}
+
+type formPart struct {
+    name, value string
+    file        bool
+}
+
+// multipartParts lists the fields of a multipart body, file fields have the
+// file name as value.
+func multipartParts(body []byte, boundary string) []formPart {
+    if boundary == "" {
+        return nil
+    }
+    var parts []formPart
+    mr := multipart.NewReader(bytes.NewReader(body), boundary)
+    for {
+        p, err := mr.NextPart()
+        if err != nil {
+            // io.EOF, or a body cut short by the recording cap
+            return parts
+        }
+        if p.FormName() == "" {
+            continue
+        }
+        value := p.FileName()
+        if value == "" {
+            b, _ := ioutil.ReadAll(io.LimitReader(p, 4096))
+            value = string(b)
+        }
+        parts = append(parts, formPart{p.FormName(), value, p.FileName() != ""})
+    }
+}
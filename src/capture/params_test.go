@@ -0,0 +1,53 @@
+package capture_test
+
+import (
+    . "capture"
+    "net/http"
+    "reflect"
+    "testing"
+)
+
+func TestInferType(t *testing.T) {
+    for value, expected := range map[string]string{
+        "":                                     ParamEmpty,
+        "42":                                   ParamInt,
+        "-3.5":                                 ParamFloat,
+        "1e3":                                  ParamFloat,
+        "true":                                 ParamBool,
+        "3f2504e0-4f89-11d3-9a0c-0305e82c3301": ParamUUID,
+        "me@example.com":                       ParamEmail,
+        "2024-05-01T10:00:00Z":                 ParamDatetime,
+        "https://example.com/":                 ParamURL,
+        `{"a": 1}`:                             ParamJSON,
+        "hello":                                ParamString,
+    } {
+        if actual := InferType(value); actual != expected {
+            t.Errorf("InferType(%q) = %q, expected %q", value, actual, expected)
+        }
+    }
+}
+
+func TestParams(t *testing.T) {
+    r := &Response{
+        URL: "http://example.com/item?id=12&q=",
+        RequestHeader: http.Header{
+            "Cookie":       {"session=abc; admin=false"},
+            "Content-Type": {"application/json"},
+        },
+        RequestBody: []byte(`{"user": {"address": {"zip": "75001"}, "tags": ["a", 2]}, "price": 1.5, "note": null}`),
+    }
+    expected := []Param{
+        {"cookie", "admin", "false", ParamBool},
+        {"cookie", "session", "abc", ParamString},
+        {"json", "note", "", ParamNull},
+        {"json", "price", "1.5", ParamFloat},
+        {"json", "user.address.zip", "75001", ParamInt},
+        {"json", "user.tags", "a", ParamString},
+        {"json", "user.tags", "2", ParamInt},
+        {"query", "id", "12", ParamInt},
+        {"query", "q", "", ParamEmpty},
+    }
+    if params := Params(r); !reflect.DeepEqual(params, expected) {
+        t.Errorf("Expected %v, got %v", expected, params)
+    }
+}
@@ -0,0 +1,111 @@
+package capture
+
+import (
+    "errors"
+    "strings"
+    "time"
+)
+
+// ErrNotFound is returned by FlowStore.Get for an id that is not stored.
+var ErrNotFound = errors.New("capture: flow not found")
+
+// Filter selects stored flows, its zero fields match everything.
+type Filter struct {
+    ID int64
+    // Host is a host name, or *.example.com for example.com and its
+    // subdomains.
+    Host   string
+    Method string
+    // Flows whose status is within StatusMin and StatusMax, either bound
+    // zero for no bound.
+    StatusMin, StatusMax int
+    // ContentType matches the start of the response content type.
+    ContentType string
+    // Since and Until bound the start of the flows.
+    Since, Until time.Time
+    // Param selects the flows having a request parameter of that name, *
+    // matches any characters: id, *.id, *_id.
+    Param string
+    // ReplayOf selects the replays of a flow, by FlowID.
+    ReplayOf string
+    // Search is looked for in the URL, the headers and the bodies.
+    Search string
+    // Limit and Offset page through the results of Query, newest first.
+    // Delete ignores them.
+    Limit, Offset int
+}
+
+// Empty tells if f matches every flow.
+func (f Filter) Empty() bool {
+    f.Limit, f.Offset = 0, 0
+    return f == Filter{}
+}
+
+// FlowStore is implemented by sinks whose flows can be queried back.
+type FlowStore interface {
+    // Query lists the flows matching f, without bodies nor WebSocket
+    // messages.
+    Query(f Filter) ([]*Response, error)
+    // Get returns a flow with everything stored about it.
+    Get(id int64) (*Response, error)
+    // Delete removes the flows matching f and returns how many there were.
+    Delete(f Filter) (int64, error)
+}
+
+// where renders f as a SQL condition on DefaultTable and BodyTable, ""
+// when it matches everything.
+func (f Filter) where() (string, []interface{}) {
+    var (
+        conds []string
+        args  []interface{}
+    )
+    add := func(cond string, a ...interface{}) {
+        conds = append(conds, cond)
+        args = append(args, a...)
+    }
+    if f.ID != 0 {
+        add("id = ?", f.ID)
+    }
+    if strings.HasPrefix(f.Host, "*.") {
+        add("(host = ? OR host LIKE ?)", f.Host[2:], "%."+likeEscape(f.Host[2:]))
+    } else if f.Host != "" {
+        add("host = ?", f.Host)
+    }
+    if f.Method != "" {
+        add("method = ?", strings.ToUpper(f.Method))
+    }
+    if f.StatusMin != 0 {
+        add("status_code >= ?", f.StatusMin)
+    }
+    if f.StatusMax != 0 {
+        add("status_code <= ?", f.StatusMax)
+    }
+    if f.ContentType != "" {
+        add("content_type LIKE ?", likeEscape(f.ContentType)+"%")
+    }
+    if !f.Since.IsZero() {
+        add("date_start >= ?", f.Since)
+    }
+    if !f.Until.IsZero() {
+        add("date_start < ?", f.Until)
+    }
+    if f.Param != "" {
+        add("id IN (SELECT capture_id FROM "+ParamTable+" WHERE name LIKE ?)", strings.Replace(likeEscape(f.Param), "*", "%", -1))
+    }
+    if f.ReplayOf != "" {
+        add("replay_of = ?", f.ReplayOf)
+    }
+    if f.Search != "" {
+        pattern := "%" + likeEscape(f.Search) + "%"
+        add("(url LIKE ? OR header LIKE ? OR request_header LIKE ? OR content LIKE ? OR request_content LIKE ?)",
+            pattern, pattern, pattern, pattern, pattern)
+    }
+    return strings.Join(conds, " AND "), args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likeEscape quotes the wildcards of s for a LIKE pattern.
+func likeEscape(s string) string {
+    return likeEscaper.Replace(s)
+}
@@ -0,0 +1,82 @@
+package capture
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// ReadJSONL loads every flow stored in a JSONLSink segment. Segments ending
+// in .gz are decompressed on the fly.
+func ReadJSONL(path string) ([]*Response, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    var r io.Reader = f
+    if strings.HasSuffix(path, ".gz") {
+        zr, err := gzip.NewReader(f)
+        if err != nil {
+            return nil, err
+        }
+        defer zr.Close()
+        r = zr
+    }
+    return DecodeJSONL(r)
+}
+
+// DecodeJSONL reads one JSON encoded Response per line from r. WebSocket
+// message and finding lines are attached to the Messages and Findings of
+// their flow.
+func DecodeJSONL(r io.Reader) ([]*Response, error) {
+    var flows []*Response
+    byID := make(map[string]*Response)
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 1<<30)
+    for line := 1; scanner.Scan(); line++ {
+        if len(strings.TrimSpace(scanner.Text())) == 0 {
+            continue
+        }
+        var kind struct {
+            Type string `json:"type"`
+        }
+        if err := json.Unmarshal(scanner.Bytes(), &kind); err != nil {
+            return flows, fmt.Errorf("capture: line %d: %v", line, err)
+        }
+        if kind.Type == messageLineType {
+            m := new(Message)
+            if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+                return flows, fmt.Errorf("capture: line %d: %v", line, err)
+            }
+            // messages of a flow in another segment are left out
+            if resp := byID[m.FlowID]; resp != nil {
+                resp.Messages = append(resp.Messages, m)
+            }
+            continue
+        }
+        if kind.Type == findingLineType {
+            f := new(Finding)
+            if err := json.Unmarshal(scanner.Bytes(), f); err != nil {
+                return flows, fmt.Errorf("capture: line %d: %v", line, err)
+            }
+            if resp := byID[f.FlowID]; resp != nil {
+                resp.Findings = append(resp.Findings, f)
+            }
+            continue
+        }
+        resp := new(Response)
+        if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+            return flows, fmt.Errorf("capture: line %d: %v", line, err)
+        }
+        if resp.FlowID != "" {
+            byID[resp.FlowID] = resp
+        }
+        flows = append(flows, resp)
+    }
+    return flows, scanner.Err()
+}
@@ -0,0 +1,56 @@
+package capture
+
+// TeeSink writes every flow to several sinks, such as the database and
+// the in-memory Live buffer of the web UI.
+type TeeSink struct {
+    sinks []CaptureSink
+}
+
+// NewTeeSink writes to sinks in order.
+func NewTeeSink(sinks ...CaptureSink) *TeeSink {
+    return &TeeSink{sinks: sinks}
+}
+
+// Write hands r to every sink, even after one failed, and returns the
+// first error.
+func (t *TeeSink) Write(r *Response) error {
+    return t.each(func(s CaptureSink) error { return s.Write(r) })
+}
+
+// WriteMessages hands msgs to the sinks that are MessageSinks.
+func (t *TeeSink) WriteMessages(msgs []*Message) error {
+    return t.each(func(s CaptureSink) error {
+        if ms, ok := s.(MessageSink); ok {
+            return ms.WriteMessages(msgs)
+        }
+        return nil
+    })
+}
+
+// WriteFindings hands findings to the sinks that are FindingSinks.
+func (t *TeeSink) WriteFindings(findings []*Finding) error {
+    return t.each(func(s CaptureSink) error {
+        if fs, ok := s.(FindingSink); ok {
+            return fs.WriteFindings(findings)
+        }
+        return nil
+    })
+}
+
+func (t *TeeSink) Flush() error {
+    return t.each(CaptureSink.Flush)
+}
+
+func (t *TeeSink) Close() error {
+    return t.each(CaptureSink.Close)
+}
+
+func (t *TeeSink) each(f func(CaptureSink) error) error {
+    var first error
+    for _, s := range t.sinks {
+        if err := f(s); err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
@@ -0,0 +1,132 @@
+package capture
+
+import (
+    "crypto/tls"
+    "net"
+    "net/http"
+    "net/http/httptrace"
+    "sync"
+    "time"
+)
+
+// Timing breaks the duration of a flow down by phase, in milliseconds. A
+// phase that did not take place, such as DNS and connect on a reused
+// connection, is -1.
+type Timing struct {
+    // DNS is the name lookup.
+    DNS float64 `json:"dns"`
+    // Connect is the TCP connect, without the TLS handshake.
+    Connect float64 `json:"connect"`
+    TLS     float64 `json:"tls"`
+    // Send is writing the request, its body included.
+    Send float64 `json:"send"`
+    // TTFB is the wait between the request written and the first byte of
+    // the response.
+    TTFB float64 `json:"ttfb"`
+    // Transfer is reading the response body, from the first byte on.
+    Transfer float64 `json:"transfer"`
+}
+
+// Tracer measures the phases of a round trip with net/http/httptrace. It
+// also learns the address of the server the request went to, which is
+// what transport.RoundTripDetails exposes for goproxy's own transport.
+type Tracer struct {
+    mu         sync.Mutex
+    start      time.Time
+    dnsStart   time.Time
+    dnsDone    time.Time
+    connStart  time.Time
+    connDone   time.Time
+    tlsStart   time.Time
+    tlsDone    time.Time
+    gotConn    time.Time
+    wrote      time.Time
+    firstByte  time.Time
+    remoteAddr string
+}
+
+// NewTracer starts measuring at start.
+func NewTracer(start time.Time) *Tracer {
+    return &Tracer{start: start}
+}
+
+// WithTrace returns a shallow copy of req whose round trip t measures.
+func (t *Tracer) WithTrace(req *http.Request) *http.Request {
+    return req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace()))
+}
+
+func (t *Tracer) clientTrace() *httptrace.ClientTrace {
+    // set records the first time of an event only; dialing may try
+    // several addresses and a retried request runs the hooks again
+    set := func(at *time.Time) {
+        t.mu.Lock()
+        if at.IsZero() {
+            *at = time.Now()
+        }
+        t.mu.Unlock()
+    }
+    return &httptrace.ClientTrace{
+        DNSStart: func(httptrace.DNSStartInfo) { set(&t.dnsStart) },
+        DNSDone:  func(httptrace.DNSDoneInfo) { set(&t.dnsDone) },
+        ConnectStart: func(network, addr string) {
+            set(&t.connStart)
+        },
+        ConnectDone: func(network, addr string, err error) {
+            if err == nil {
+                set(&t.connDone)
+            }
+        },
+        TLSHandshakeStart: func() { set(&t.tlsStart) },
+        TLSHandshakeDone:  func(tls.ConnectionState, error) { set(&t.tlsDone) },
+        GotConn: func(info httptrace.GotConnInfo) {
+            set(&t.gotConn)
+            t.mu.Lock()
+            if addr := info.Conn.RemoteAddr(); addr != nil {
+                t.remoteAddr = addr.String()
+            }
+            t.mu.Unlock()
+        },
+        WroteRequest:         func(httptrace.WroteRequestInfo) { set(&t.wrote) },
+        GotFirstResponseByte: func() { set(&t.firstByte) },
+    }
+}
+
+// RemoteIP is the address of the server the request was sent to, "" if no
+// connection was made.
+func (t *Tracer) RemoteIP() string {
+    if t == nil {
+        return ""
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    host, _, err := net.SplitHostPort(t.remoteAddr)
+    if err != nil {
+        return t.remoteAddr
+    }
+    return host
+}
+
+// Timing returns the phases measured so far, the transfer lasting until
+// end.
+func (t *Tracer) Timing(end time.Time) *Timing {
+    if t == nil {
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return &Timing{
+        DNS:      span(t.dnsStart, t.dnsDone),
+        Connect:  span(t.connStart, t.connDone),
+        TLS:      span(t.tlsStart, t.tlsDone),
+        Send:     span(t.gotConn, t.wrote),
+        TTFB:     span(t.wrote, t.firstByte),
+        Transfer: span(t.firstByte, end),
+    }
+}
+
+func span(from, to time.Time) float64 {
+    if from.IsZero() || to.IsZero() || to.Before(from) {
+        return -1
+    }
+    return float64(to.Sub(from)) / float64(time.Millisecond)
+}
@@ -0,0 +1,109 @@
+package capture
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "time"
+)
+
+// TLSInfo describes both legs of an intercepted TLS connection.
+type TLSInfo struct {
+    Client   *TLSClient   `json:"client,omitempty"`
+    Upstream *TLSUpstream `json:"upstream,omitempty"`
+}
+
+// TLSClient is what the client offered in its ClientHello and what it
+// negotiated with the proxy.
+type TLSClient struct {
+    SNI             string   `json:"sni,omitempty"`
+    OfferedALPN     []string `json:"offered_alpn,omitempty"`
+    OfferedVersions []string `json:"offered_versions,omitempty"`
+    Version         string   `json:"version,omitempty"`
+    CipherSuite     string   `json:"cipher_suite,omitempty"`
+    ALPN            string   `json:"alpn,omitempty"`
+}
+
+// TLSUpstream is what the server negotiated with the proxy, and the chain
+// it presented, leaf first.
+type TLSUpstream struct {
+    Version      string           `json:"version"`
+    CipherSuite  string           `json:"cipher_suite"`
+    ALPN         string           `json:"alpn,omitempty"`
+    Certificates []TLSCertificate `json:"certificates,omitempty"`
+}
+
+type TLSCertificate struct {
+    Subject   string    `json:"subject"`
+    SANs      []string  `json:"sans,omitempty"`
+    Issuer    string    `json:"issuer"`
+    NotBefore time.Time `json:"not_before"`
+    NotAfter  time.Time `json:"not_after"`
+    SHA256    string    `json:"sha256"`
+}
+
+// NewTLSClient describes the client leg, hello and state may each be nil;
+// it returns nil when both are.
+func NewTLSClient(hello *tls.ClientHelloInfo, state *tls.ConnectionState) *TLSClient {
+    if hello == nil && state == nil {
+        return nil
+    }
+    c := new(TLSClient)
+    if hello != nil {
+        c.SNI = hello.ServerName
+        c.OfferedALPN = hello.SupportedProtos
+        for _, v := range hello.SupportedVersions {
+            c.OfferedVersions = append(c.OfferedVersions, tls.VersionName(v))
+        }
+    }
+    if state != nil {
+        c.Version = tls.VersionName(state.Version)
+        c.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+        c.ALPN = state.NegotiatedProtocol
+        if c.SNI == "" {
+            c.SNI = state.ServerName
+        }
+    }
+    return c
+}
+
+// NewTLSUpstream describes the server leg, nil for a plain connection.
+func NewTLSUpstream(state *tls.ConnectionState) *TLSUpstream {
+    if state == nil {
+        return nil
+    }
+    u := &TLSUpstream{
+        Version:     tls.VersionName(state.Version),
+        CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+        ALPN:        state.NegotiatedProtocol,
+    }
+    for _, cert := range state.PeerCertificates {
+        u.Certificates = append(u.Certificates, newTLSCertificate(cert))
+    }
+    return u
+}
+
+func newTLSCertificate(cert *x509.Certificate) TLSCertificate {
+    sum := sha256.Sum256(cert.Raw)
+    c := TLSCertificate{
+        Subject:   cert.Subject.String(),
+        SANs:      cert.DNSNames,
+        Issuer:    cert.Issuer.String(),
+        NotBefore: cert.NotBefore.UTC(),
+        NotAfter:  cert.NotAfter.UTC(),
+        SHA256:    hex.EncodeToString(sum[:]),
+    }
+    for _, ip := range cert.IPAddresses {
+        c.SANs = append(c.SANs, ip.String())
+    }
+    return c
+}
+
+// Leaf returns the server certificate, nil if there is none.
+func (u *TLSUpstream) Leaf() *TLSCertificate {
+    if u == nil || len(u.Certificates) == 0 {
+        return nil
+    }
+    return &u.Certificates[0]
+}
@@ -0,0 +1,444 @@
+// Package config holds wyproxy's settings, read from a JSON file and
+// overridden by command line flags.
+//
+// A complete file with the default values:
+//
+//	{
+//	    "listen": ":8080",
+//	    "log": {"file": "", "verbose": false},
+//	    "ca": {"cert": "", "key": "", "host": "wyproxy.cert"},
+//	    "sink": {
+//	        "type": "mysql", "dsn": "",
+//	        "queue": 4096, "batch": 100, "flush_interval": "1s",
+//	        "drop": false, "dedup": false
+//	    },
+//	    "capture": {
+//	        "max_body": "1M", "decode": true, "keep_raw": false,
+//	        "record_static": true,
+//	        "static_extensions": ["js", "css", "ico"],
+//	        "static_types": ["text/css", "application/msword", ...],
+//	        "media_types": ["image", "video", "audio"]
+//	    },
+//	    "api": {"enabled": false, "token": ""},
+//	    "ui": {"enabled": false, "host": "wyproxy", "buffer": 1000},
+//	    "analysis": {
+//	        "enabled": false, "checks": [], "workers": 2,
+//	        "rules_file": "", "rules": null
+//	    },
+//	    "scope_file": "",
+//	    "scope": {"include": [], "exclude": [], "tunnel": []},
+//	    "redact_file": "",
+//	    "redact": null
+//	}
+//
+// A sink dsn left empty by the file and the flags falls back to the WYDSN
+// environment variable, see Validate.
+package config
+
+import (
+    "analysis"
+    "capture"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "redact"
+    "scope"
+    "strings"
+    "time"
+)
+
+type Config struct {
+    // Listen is a comma separated list of proxy listen addresses.
+    Listen  string        `json:"listen"`
+    Log     LogConfig     `json:"log"`
+    CA      CAConfig      `json:"ca"`
+    Sink    SinkConfig    `json:"sink"`
+    Capture CaptureConfig `json:"capture"`
+    API     APIConfig     `json:"api"`
+    UI      UIConfig      `json:"ui"`
+    // Analysis runs the passive checks of package analysis on every flow.
+    Analysis AnalysisConfig `json:"analysis"`
+    // ScopeFile is loaded into Scope by Validate when set.
+    ScopeFile string       `json:"scope_file"`
+    Scope     *scope.Scope `json:"scope"`
+    // RedactFile is loaded into Redact by Validate when set.
+    RedactFile string        `json:"redact_file"`
+    Redact     *redact.Rules `json:"redact"`
+}
+
+type LogConfig struct {
+    // File receives the log instead of stderr when set.
+    File    string `json:"file"`
+    Verbose bool   `json:"verbose"`
+}
+
+// CAConfig points at the PEM files of the CA signing MITM certificates,
+// the CA built into goproxy is used when both are empty.
+type CAConfig struct {
+    Cert string `json:"cert"`
+    Key  string `json:"key"`
+    // Host is answered by the proxy itself with a page offering the CA
+    // certificate to install, none when empty. The page is also served
+    // under /cert/ on the proxy port.
+    Host string `json:"host"`
+}
+
+type SinkConfig struct {
+    Type          string   `json:"type"`
+    DSN           string   `json:"dsn"`
+    Queue         int      `json:"queue"`
+    Batch         int      `json:"batch"`
+    FlushInterval Duration `json:"flush_interval"`
+    Drop          bool     `json:"drop"`
+    Dedup         bool     `json:"dedup"`
+}
+
+type CaptureConfig struct {
+    MaxBody          string   `json:"max_body"`
+    Decode           bool     `json:"decode"`
+    KeepRaw          bool     `json:"keep_raw"`
+    RecordStatic     bool     `json:"record_static"`
+    StaticExtensions []string `json:"static_extensions"`
+    StaticTypes      []string `json:"static_types"`
+    MediaTypes       []string `json:"media_types"`
+}
+
+// APIConfig enables the JSON API over the captured flows, served on the
+// proxy port to requests that are not proxied. See package api.
+type APIConfig struct {
+    Enabled bool `json:"enabled"`
+    // Token must be sent as a bearer token. When it is empty and the proxy
+    // listens beyond loopback, wyproxy makes one up at startup and logs it,
+    // as the API serves the captured credentials.
+    Token string `json:"token"`
+}
+
+// UIConfig enables the web UI, served under /ui/ on the proxy port and at
+// the root of Host when browsing through the proxy. The UI also enables the
+// API it relies on, protected by the API token.
+type UIConfig struct {
+    Enabled bool   `json:"enabled"`
+    Host    string `json:"host"`
+    // Buffer is the number of flows kept in memory for the live view, fewer
+    // when their bodies come to more than capture.MaxLiveBytes.
+    Buffer int `json:"buffer"`
+}
+
+type AnalysisConfig struct {
+    Enabled bool `json:"enabled"`
+    // Checks are the ids of the checks to run, all of them when empty.
+    Checks  []string `json:"checks"`
+    Workers int      `json:"workers"`
+    // RulesFile is loaded into Rules by Validate when set, the rules of
+    // the secrets and pii checks. The default rules apply when both are
+    // empty.
+    RulesFile string          `json:"rules_file"`
+    Rules     *analysis.Rules `json:"rules"`
+}
+
+// Duration is a time.Duration written as "1s" or "500ms" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+        return fmt.Errorf("duration must be a string such as \"1s\": %s", b)
+    }
+    v, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = Duration(v)
+    return nil
+}
+
+// Default returns the settings wyproxy runs with when nothing is configured.
+func Default() *Config {
+    return &Config{
+        Listen: ":8080",
+        CA: CAConfig{
+            Host: "wyproxy.cert",
+        },
+        Sink: SinkConfig{
+            Type:          "mysql",
+            Queue:         capture.DefaultQueueSize,
+            Batch:         capture.DefaultBatchSize,
+            FlushInterval: Duration(capture.DefaultFlushInterval),
+        },
+        Capture: CaptureConfig{
+            MaxBody:          "1M",
+            Decode:           true,
+            RecordStatic:     true,
+            StaticExtensions: []string{"js", "css", "ico"},
+            StaticTypes: []string{
+                "text/css",
+                // "application/javascript",
+                // "application/x-javascript",
+                "application/msword",
+                "application/vnd.ms-excel",
+                "application/vnd.ms-powerpoint",
+                "application/x-ms-wmd",
+                "application/x-shockwave-flash",
+            },
+            MediaTypes: []string{"image", "video", "audio"},
+        },
+        UI: UIConfig{
+            Host:   "wyproxy",
+            Buffer: capture.DefaultLiveSize,
+        },
+        Analysis: AnalysisConfig{
+            Workers: analysis.DefaultWorkers,
+        },
+    }
+}
+
+// Load reads a JSON file over the values already in c, so fields missing
+// from the file keep their current value.
+func (c *Config) Load(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    dec := json.NewDecoder(f)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(c); err != nil {
+        return fmt.Errorf("config: %s: %v", path, err)
+    }
+    return nil
+}
+
+// RegisterFlags binds command line flags to the fields of c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+    fs.StringVar(&c.Listen, "addr", c.Listen, "proxy listen address, several may be comma separated")
+    fs.BoolVar(&c.Log.Verbose, "v", c.Log.Verbose, "should every proxy request be logged to stdout")
+    fs.StringVar(&c.Log.File, "log", c.Log.File, "log to this file instead of stderr")
+    fs.StringVar(&c.CA.Cert, "ca-cert", c.CA.Cert, "PEM certificate of the CA signing intercepted hosts")
+    fs.StringVar(&c.CA.Key, "ca-key", c.CA.Key, "PEM private key of the CA signing intercepted hosts")
+    fs.StringVar(&c.CA.Host, "ca-host", c.CA.Host, "host name reserved for the CA certificate page when browsing through the proxy, none when empty")
+    fs.StringVar(&c.Sink.Type, "sink", c.Sink.Type, "capture sink, one of "+strings.Join(capture.Sinks(), ", "))
+    fs.StringVar(&c.Sink.DSN, "dsn", c.Sink.DSN, "capture sink data source, defaults to $WYDSN (mysql: DSN, jsonl: path?max_size=100M&rotate=hourly&gzip=true)")
+    fs.IntVar(&c.Sink.Queue, "queue", c.Sink.Queue, "capture queue length")
+    fs.IntVar(&c.Sink.Batch, "batch", c.Sink.Batch, "flows per sink write")
+    fs.Var((*durationFlag)(&c.Sink.FlushInterval), "flush", "longest time a flow waits in the queue")
+    fs.BoolVar(&c.Sink.Drop, "drop", c.Sink.Drop, "drop flows when the queue is full instead of slowing down the proxy")
+    fs.BoolVar(&c.Sink.Dedup, "dedup", c.Sink.Dedup, "store one flow per method, host, path template and parameter names, counting repeats")
+    fs.StringVar(&c.Capture.MaxBody, "max-body", c.Capture.MaxBody, "bytes of each body to keep, per content type, e.g. 1M,image=0,video=0,text/html=4M (-1 keeps everything)")
+    fs.BoolVar(&c.Capture.Decode, "decode", c.Capture.Decode, "store bodies decompressed and converted to UTF-8")
+    fs.BoolVar(&c.Capture.KeepRaw, "keep-raw", c.Capture.KeepRaw, "also store bodies as received when -decode changed them")
+    fs.BoolVar(&c.Capture.RecordStatic, "record-static", c.Capture.RecordStatic, "record static resources, without their body")
+    fs.BoolVar(&c.API.Enabled, "api", c.API.Enabled, "serve the JSON flow API under /api/ on the proxy port (mysql sink)")
+    fs.StringVar(&c.API.Token, "api-token", c.API.Token, "bearer token the flow API and the web UI require, generated and logged at startup when empty unless the proxy only listens on loopback")
+    fs.BoolVar(&c.UI.Enabled, "ui", c.UI.Enabled, "serve the web UI under /ui/ on the proxy port and at http://<ui-host>/ through the proxy")
+    fs.StringVar(&c.UI.Host, "ui-host", c.UI.Host, "host name reserved for the web UI when browsing through the proxy")
+    fs.BoolVar(&c.Analysis.Enabled, "analyze", c.Analysis.Enabled, "run passive checks on every flow and store their findings")
+    fs.Var((*listFlag)(&c.Analysis.Checks), "checks", "comma separated checks -analyze runs, all when empty: "+strings.Join(analysis.Checks(), ", "))
+    fs.StringVar(&c.Analysis.RulesFile, "rules", c.Analysis.RulesFile, "JSON file with the patterns of the secrets and pii checks, see package analysis")
+    fs.StringVar(&c.ScopeFile, "scope", c.ScopeFile, "JSON file with include, exclude and tunnel rules, see package scope")
+    fs.StringVar(&c.RedactFile, "redact", c.RedactFile, "JSON file with the headers, JSON paths, form fields and patterns to redact before storage, see package redact")
+}
+
+type durationFlag Duration
+
+func (d *durationFlag) String() string {
+    return time.Duration(*d).String()
+}
+
+func (d *durationFlag) Set(s string) error {
+    v, err := time.ParseDuration(s)
+    *d = durationFlag(v)
+    return err
+}
+
+// listFlag is a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+    *l = nil
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            *l = append(*l, item)
+        }
+    }
+    return nil
+}
+
+// Addrs returns the listen addresses.
+func (c *Config) Addrs() []string {
+    var addrs []string
+    for _, addr := range strings.Split(c.Listen, ",") {
+        if addr = strings.TrimSpace(addr); addr != "" {
+            addrs = append(addrs, addr)
+        }
+    }
+    return addrs
+}
+
+// Loopback tells if every listen address is a loopback one, reachable only
+// from this host.
+func (c *Config) Loopback() bool {
+    for _, addr := range c.Addrs() {
+        host, _, err := net.SplitHostPort(addr)
+        if err != nil {
+            return false
+        }
+        if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+            return false
+        }
+    }
+    return len(c.Addrs()) > 0
+}
+
+// BodyLimits parses Capture.MaxBody.
+func (c *Config) BodyLimits() (capture.BodyLimits, error) {
+    return capture.ParseBodyLimits(c.Capture.MaxBody)
+}
+
+// BatchOptions returns the queue settings of the sink.
+func (c *Config) BatchOptions() capture.BatchOptions {
+    opts := capture.BatchOptions{
+        QueueSize:     c.Sink.Queue,
+        BatchSize:     c.Sink.Batch,
+        FlushInterval: time.Duration(c.Sink.FlushInterval),
+    }
+    if c.Sink.Drop {
+        opts.Policy = capture.Drop
+    }
+    return opts
+}
+
+// LoadCA reads the configured CA, nil when none is configured.
+func (c *Config) LoadCA() (*tls.Certificate, error) {
+    if c.CA.Cert == "" && c.CA.Key == "" {
+        return nil, nil
+    }
+    ca, err := tls.LoadX509KeyPair(c.CA.Cert, c.CA.Key)
+    if err != nil {
+        return nil, err
+    }
+    return &ca, nil
+}
+
+// Validate checks every setting, loading the scope file on the way, and
+// reports all the problems it finds at once. It is called once the file
+// and the flags are read, and fills in the sink dsn from WYDSN when they
+// leave it empty.
+func (c *Config) Validate() error {
+    var problems []string
+    add := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    if len(c.Addrs()) == 0 {
+        add("listen: no address")
+    }
+    if c.Log.File != "" {
+        if f, err := os.OpenFile(c.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+            add("log.file: %v", err)
+        } else {
+            f.Close()
+        }
+    }
+    if (c.CA.Cert == "") != (c.CA.Key == "") {
+        add("ca: cert and key must be given together")
+    } else if _, err := c.LoadCA(); err != nil {
+        add("ca: %v", err)
+    }
+
+    if strings.ContainsAny(c.CA.Host, ":/ ") {
+        add("ca.host: %q is not a host name", c.CA.Host)
+    }
+
+    known := false
+    for _, name := range capture.Sinks() {
+        known = known || name == c.Sink.Type
+    }
+    if !known {
+        add("sink.type: unknown sink %q, expected one of %s", c.Sink.Type, strings.Join(capture.Sinks(), ", "))
+    }
+    if c.Sink.DSN == "" {
+        c.Sink.DSN = os.Getenv("WYDSN")
+    }
+    if c.Sink.Queue < 1 {
+        add("sink.queue: must be at least 1")
+    }
+    if c.Sink.Batch < 1 {
+        add("sink.batch: must be at least 1")
+    }
+    if c.Sink.FlushInterval <= 0 {
+        add("sink.flush_interval: must be positive")
+    }
+
+    if c.UI.Buffer < 1 {
+        add("ui.buffer: must be at least 1")
+    }
+    if strings.ContainsAny(c.UI.Host, ":/ ") {
+        add("ui.host: %q is not a host name", c.UI.Host)
+    }
+
+    if c.Analysis.Workers < 1 {
+        add("analysis.workers: must be at least 1")
+    }
+    if err := analysis.Validate(c.Analysis.Checks); err != nil {
+        add("analysis.checks: %v", err)
+    }
+    if c.Analysis.RulesFile != "" {
+        r, err := analysis.LoadRules(c.Analysis.RulesFile)
+        if err != nil {
+            add("analysis.rules_file: %v", err)
+        } else {
+            c.Analysis.Rules = r
+        }
+    } else if c.Analysis.Rules != nil {
+        if err := c.Analysis.Rules.Compile(); err != nil {
+            add("analysis.rules: %v", err)
+        }
+    }
+
+    if _, err := c.BodyLimits(); err != nil {
+        add("capture.max_body: %v", err)
+    }
+
+    if c.ScopeFile != "" {
+        s, err := scope.Load(c.ScopeFile)
+        if err != nil {
+            add("scope_file: %v", err)
+        } else {
+            c.Scope = s
+        }
+    } else if c.Scope != nil {
+        if err := c.Scope.Compile(); err != nil {
+            add("scope: %v", err)
+        }
+    }
+
+    if c.RedactFile != "" {
+        r, err := redact.Load(c.RedactFile)
+        if err != nil {
+            add("redact_file: %v", err)
+        } else {
+            c.Redact = r
+        }
+    } else if c.Redact != nil {
+        if err := c.Redact.Compile(); err != nil {
+            add("redact: %v", err)
+        }
+    }
+
+    if len(problems) > 0 {
+        return errors.New("invalid configuration:\n    " + strings.Join(problems, "\n    "))
+    }
+    return nil
+}
@@ -0,0 +1,396 @@
+// Package diff compares the responses of two flows: status, headers and
+// body. JSON bodies are compared by structure, as sorted path = value
+// lines, so that key order and formatting do not show up as changes;
+// other text bodies are compared line by line.
+package diff
+
+import (
+    "bytes"
+    "capture"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// Body modes of a Result.
+const (
+    JSON   = "json"
+    Text   = "text"
+    Binary = "binary"
+)
+
+// DefaultContext is the number of unchanged lines shown around changes.
+const DefaultContext = 3
+
+// DefaultIgnoreHeaders change from one response to the next whatever the
+// request.
+var DefaultIgnoreHeaders = []string{"Date", "Age", "Expires"}
+
+// maxCells bounds the work of the line diff, larger changes are shown as
+// a whole block replaced.
+const maxCells = 4 << 20
+
+type Options struct {
+    // IgnoreHeaders are left out of the comparison, DefaultIgnoreHeaders
+    // when nil.
+    IgnoreHeaders []string
+    // Context lines around changes, DefaultContext when zero, none when
+    // negative.
+    Context int
+    // Text compares JSON bodies line by line as well.
+    Text bool
+}
+
+// ContextLines turns a number of context lines as users give it, where 0
+// means none as in diff -U 0, into an Options.Context.
+func ContextLines(n int) int {
+    if n <= 0 {
+        return -1
+    }
+    return n
+}
+
+// Flow identifies a compared flow.
+type Flow struct {
+    ID     int64  `json:"id"`
+    FlowID string `json:"flow_id"`
+    Method string `json:"method"`
+    URL    string `json:"url"`
+    Status int    `json:"status"`
+}
+
+// HeaderChange is a response header added, removed or changed from A to B.
+type HeaderChange struct {
+    Name string `json:"name"`
+    // Op is "added", "removed" or "changed".
+    Op   string   `json:"op"`
+    From []string `json:"from,omitempty"`
+    To   []string `json:"to,omitempty"`
+}
+
+// Line is a line of the body diff, Op is " " when both bodies have it,
+// "-" when only A has it and "+" when only B has it.
+type Line struct {
+    Op   string `json:"op"`
+    Text string `json:"text"`
+}
+
+// Hunk is a run of changes with its context, starts count from 1.
+type Hunk struct {
+    AStart int    `json:"a_start"`
+    ALines int    `json:"a_lines"`
+    BStart int    `json:"b_start"`
+    BLines int    `json:"b_lines"`
+    Lines  []Line `json:"lines"`
+}
+
+// Result is the comparison of two flows.
+type Result struct {
+    A             Flow           `json:"a"`
+    B             Flow           `json:"b"`
+    StatusChanged bool           `json:"status_changed"`
+    Headers       []HeaderChange `json:"headers"`
+    BodyMode      string         `json:"body_mode"`
+    BodyEqual     bool           `json:"body_equal"`
+    // Body holds the hunks of text and JSON bodies.
+    Body []Hunk `json:"body"`
+    // Truncated tells that a body was not recorded in full, the
+    // comparison only covers what was.
+    Truncated bool `json:"truncated"`
+}
+
+// Equal tells if no difference was found.
+func (r *Result) Equal() bool {
+    return !r.StatusChanged && len(r.Headers) == 0 && r.BodyEqual
+}
+
+// Flows compares the responses of a and b.
+func Flows(a, b *capture.Response, opts Options) *Result {
+    if opts.IgnoreHeaders == nil {
+        opts.IgnoreHeaders = DefaultIgnoreHeaders
+    }
+    if opts.Context == 0 {
+        opts.Context = DefaultContext
+    }
+    r := &Result{
+        A:             flowOf(a),
+        B:             flowOf(b),
+        StatusChanged: a.Status != b.Status,
+        Headers:       Headers(a.Header, b.Header, opts.IgnoreHeaders),
+        BodyEqual:     bytes.Equal(a.Body, b.Body),
+        Truncated:     a.Truncated || b.Truncated,
+    }
+    var la, lb []string
+    switch {
+    case !utf8.Valid(a.Body) || !utf8.Valid(b.Body):
+        r.BodyMode = Binary
+    case !opts.Text && jsonLines(a.Body, &la) && jsonLines(b.Body, &lb):
+        r.BodyMode = JSON
+        r.BodyEqual = strings.Join(la, "\n") == strings.Join(lb, "\n")
+    default:
+        r.BodyMode = Text
+        la, lb = textLines(a.Body), textLines(b.Body)
+    }
+    if r.BodyMode != Binary && !r.BodyEqual {
+        r.Body = Hunks(Lines(la, lb), opts.Context)
+    }
+    return r
+}
+
+func flowOf(r *capture.Response) Flow {
+    return Flow{ID: r.ID, FlowID: r.FlowID, Method: r.Method, URL: r.URL, Status: r.Status}
+}
+
+// Headers compares two sets of headers, leaving out those in ignore.
+func Headers(a, b http.Header, ignore []string) []HeaderChange {
+    skip := make(map[string]bool)
+    for _, name := range ignore {
+        skip[http.CanonicalHeaderKey(name)] = true
+    }
+    names := make(map[string]bool)
+    for name := range a {
+        names[http.CanonicalHeaderKey(name)] = true
+    }
+    for name := range b {
+        names[http.CanonicalHeaderKey(name)] = true
+    }
+    sorted := make([]string, 0, len(names))
+    for name := range names {
+        if !skip[name] {
+            sorted = append(sorted, name)
+        }
+    }
+    sort.Strings(sorted)
+    changes := []HeaderChange{}
+    for _, name := range sorted {
+        from, to := a.Values(name), b.Values(name)
+        switch {
+        case len(from) == 0:
+            changes = append(changes, HeaderChange{Name: name, Op: "added", To: to})
+        case len(to) == 0:
+            changes = append(changes, HeaderChange{Name: name, Op: "removed", From: from})
+        case strings.Join(from, "\n") != strings.Join(to, "\n"):
+            changes = append(changes, HeaderChange{Name: name, Op: "changed", From: from, To: to})
+        }
+    }
+    return changes
+}
+
+func textLines(body []byte) []string {
+    if len(body) == 0 {
+        return nil
+    }
+    return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+}
+
+// jsonLines flattens a JSON body into sorted path = value lines, it
+// returns false when body is not JSON.
+func jsonLines(body []byte, lines *[]string) bool {
+    dec := json.NewDecoder(bytes.NewReader(body))
+    dec.UseNumber()
+    var v interface{}
+    if len(bytes.TrimSpace(body)) == 0 || dec.Decode(&v) != nil || dec.More() {
+        return false
+    }
+    flatten("", v, lines)
+    sort.Strings(*lines)
+    return true
+}
+
+// flatten lists the scalars of v with paths such as user.roles[0].name.
+func flatten(path string, v interface{}, lines *[]string) {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        if len(v) == 0 {
+            *lines = append(*lines, line(path, "{}"))
+        }
+        for k, vv := range v {
+            p := k
+            if path != "" {
+                p = path + "." + k
+            }
+            flatten(p, vv, lines)
+        }
+    case []interface{}:
+        if len(v) == 0 {
+            *lines = append(*lines, line(path, "[]"))
+        }
+        for i, vv := range v {
+            flatten(path+"["+strconv.Itoa(i)+"]", vv, lines)
+        }
+    default:
+        js, _ := json.Marshal(v)
+        *lines = append(*lines, line(path, string(js)))
+    }
+}
+
+func line(path, value string) string {
+    if path == "" {
+        return value
+    }
+    return path + " = " + value
+}
+
+// Lines returns the edit script turning a into b, every line of both
+// appearing once.
+func Lines(a, b []string) []Line {
+    // common ends are cheap, only the middle goes through the LCS
+    pre := 0
+    for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+        pre++
+    }
+    suf := 0
+    for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+        suf++
+    }
+    var out []Line
+    for _, s := range a[:pre] {
+        out = append(out, Line{" ", s})
+    }
+    out = append(out, middle(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+    for _, s := range a[len(a)-suf:] {
+        out = append(out, Line{" ", s})
+    }
+    return out
+}
+
+// middle diffs with a longest common subsequence table.
+func middle(a, b []string) []Line {
+    var out []Line
+    if len(a)*len(b) > maxCells {
+        for _, s := range a {
+            out = append(out, Line{"-", s})
+        }
+        for _, s := range b {
+            out = append(out, Line{"+", s})
+        }
+        return out
+    }
+    // lcs[i][j] is the LCS length of a[i:] and b[j:]
+    lcs := make([][]int32, len(a)+1)
+    for i := range lcs {
+        lcs[i] = make([]int32, len(b)+1)
+    }
+    for i := len(a) - 1; i >= 0; i-- {
+        for j := len(b) - 1; j >= 0; j-- {
+            if a[i] == b[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+    i, j := 0, 0
+    for i < len(a) || j < len(b) {
+        switch {
+        case i < len(a) && j < len(b) && a[i] == b[j]:
+            out = append(out, Line{" ", a[i]})
+            i, j = i+1, j+1
+        case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+            out = append(out, Line{"-", a[i]})
+            i++
+        default:
+            out = append(out, Line{"+", b[j]})
+            j++
+        }
+    }
+    return out
+}
+
+// Hunks groups the changes of an edit script with context unchanged lines
+// around them, changes closer than twice the context share a hunk.
+func Hunks(lines []Line, context int) []Hunk {
+    if context < 0 {
+        context = 0
+    }
+    // aBefore[k] and bBefore[k] count the lines of a and b before lines[k]
+    aBefore, bBefore := make([]int, len(lines)+1), make([]int, len(lines)+1)
+    var changes []int
+    for k, l := range lines {
+        aBefore[k+1], bBefore[k+1] = aBefore[k], bBefore[k]
+        if l.Op != "+" {
+            aBefore[k+1]++
+        }
+        if l.Op != "-" {
+            bBefore[k+1]++
+        }
+        if l.Op != " " {
+            changes = append(changes, k)
+        }
+    }
+    var hunks []Hunk
+    for i := 0; i < len(changes); {
+        // extend the group while the next change is close enough
+        j := i
+        for j+1 < len(changes) && changes[j+1]-changes[j]-1 <= 2*context {
+            j++
+        }
+        start, end := changes[i]-context, changes[j]+context+1
+        if start < 0 {
+            start = 0
+        }
+        if end > len(lines) {
+            end = len(lines)
+        }
+        h := Hunk{
+            AStart: aBefore[start] + 1,
+            ALines: aBefore[end] - aBefore[start],
+            BStart: bBefore[start] + 1,
+            BLines: bBefore[end] - bBefore[start],
+            Lines:  lines[start:end],
+        }
+        // an empty side starts at the line before, as in unified diffs
+        if h.ALines == 0 {
+            h.AStart--
+        }
+        if h.BLines == 0 {
+            h.BStart--
+        }
+        hunks = append(hunks, h)
+        i = j + 1
+    }
+    return hunks
+}
+
+// WriteText writes r in a form close to a unified diff.
+func (r *Result) WriteText(w io.Writer) error {
+    var b strings.Builder
+    fmt.Fprintf(&b, "--- flow %d %s %s\n", r.A.ID, r.A.Method, r.A.URL)
+    fmt.Fprintf(&b, "+++ flow %d %s %s\n", r.B.ID, r.B.Method, r.B.URL)
+    if r.StatusChanged {
+        fmt.Fprintf(&b, "status %d -> %d\n", r.A.Status, r.B.Status)
+    }
+    for _, h := range r.Headers {
+        for _, v := range h.From {
+            fmt.Fprintf(&b, "-%s: %s\n", h.Name, v)
+        }
+        for _, v := range h.To {
+            fmt.Fprintf(&b, "+%s: %s\n", h.Name, v)
+        }
+    }
+    switch {
+    case r.BodyEqual:
+    case r.BodyMode == Binary:
+        b.WriteString("binary bodies differ\n")
+    default:
+        fmt.Fprintf(&b, "body (%s):\n", r.BodyMode)
+        for _, h := range r.Body {
+            fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", h.AStart, h.ALines, h.BStart, h.BLines)
+            for _, l := range h.Lines {
+                b.WriteString(l.Op + l.Text + "\n")
+            }
+        }
+    }
+    if r.Truncated {
+        b.WriteString("(a body was truncated when recorded, only the recorded part is compared)\n")
+    }
+    _, err := io.WriteString(w, b.String())
+    return err
+}
@@ -0,0 +1,76 @@
+package diff_test
+
+import (
+    "capture"
+    . "diff"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func flow(status int, header http.Header, body string) *capture.Response {
+    return &capture.Response{Status: status, Header: header, Body: []byte(body)}
+}
+
+func TestHeaders(t *testing.T) {
+    a := http.Header{"Server": {"nginx"}, "X-Admin": {"1"}, "Date": {"Mon"}, "Content-Length": {"10"}}
+    b := http.Header{"Server": {"nginx"}, "Set-Cookie": {"a=1"}, "Date": {"Tue"}, "Content-Length": {"12"}}
+    expected := []HeaderChange{
+        {Name: "Content-Length", Op: "changed", From: []string{"10"}, To: []string{"12"}},
+        {Name: "Set-Cookie", Op: "added", To: []string{"a=1"}},
+        {Name: "X-Admin", Op: "removed", From: []string{"1"}},
+    }
+    if changes := Headers(a, b, DefaultIgnoreHeaders); !reflect.DeepEqual(changes, expected) {
+        t.Errorf("Expected %+v, got %+v", expected, changes)
+    }
+}
+
+func TestJSONBodiesIgnoreKeyOrder(t *testing.T) {
+    r := Flows(flow(200, nil, `{"user": {"name": "a", "admin": true}, "items": [1, 2]}`),
+        flow(200, nil, `{"items":[1,2],"user":{"admin":true,"name":"a"}}`), Options{})
+    if r.BodyMode != JSON || !r.Equal() {
+        t.Errorf("Expected equal JSON bodies, got %+v", r)
+    }
+}
+
+func TestJSONBodyChanges(t *testing.T) {
+    r := Flows(flow(200, nil, `{"user": {"name": "a", "admin": true, "id": 1}}`),
+        flow(403, nil, `{"user": {"name": "a", "admin": false, "id": 1}}`), Options{Context: -1})
+    if !r.StatusChanged || r.BodyMode != JSON || len(r.Body) != 1 {
+        t.Fatalf("Unexpected result %+v", r)
+    }
+    expected := []Line{{"-", "user.admin = true"}, {"+", "user.admin = false"}}
+    if !reflect.DeepEqual(r.Body[0].Lines, expected) {
+        t.Errorf("Expected %v, got %v", expected, r.Body[0].Lines)
+    }
+}
+
+func TestTextHunks(t *testing.T) {
+    var a, b []string
+    for i := 0; i < 20; i++ {
+        a = append(a, string(rune('a'+i)))
+    }
+    b = append(b, a...)
+    b[2] = "C"
+    b = append(b[:15], b[16:]...)
+    r := Flows(flow(200, nil, strings.Join(a, "\n")), flow(200, nil, strings.Join(b, "\n")), Options{Context: 2})
+    if r.BodyMode != Text || len(r.Body) != 2 {
+        t.Fatalf("Expected 2 hunks, got %+v", r.Body)
+    }
+    h := r.Body[0]
+    if h.AStart != 1 || h.ALines != 5 || h.BStart != 1 || h.BLines != 5 {
+        t.Errorf("Unexpected first hunk %+v", h)
+    }
+    h = r.Body[1]
+    if h.AStart != 14 || h.ALines != 5 || h.BStart != 14 || h.BLines != 4 || h.Lines[2] != (Line{"-", "p"}) {
+        t.Errorf("Unexpected second hunk %+v", h)
+    }
+}
+
+func TestBinaryBodies(t *testing.T) {
+    r := Flows(flow(200, nil, "\xff\x00"), flow(200, nil, "\xff\x01"), Options{})
+    if r.BodyMode != Binary || r.BodyEqual || r.Body != nil {
+        t.Errorf("Unexpected result %+v", r)
+    }
+}
@@ -1,6 +1,7 @@
 package goproxy
 
 import (
+	"crypto/tls"
 	"net/http"
 	"regexp"
 )
@@ -18,6 +19,10 @@ type ProxyCtx struct {
 	// A handle for the user to keep data in the context, from the call of ReqHandler to the
 	// call of RespHandler
 	UserData interface{}
+	// What the client offered and negotiated when its connection is a MITM'd
+	// TLS tunnel, nil otherwise. Shared by all the requests of the tunnel.
+	ClientHello *tls.ClientHelloInfo
+	ClientTLS   *tls.ConnectionState
 	// Will connect a request to a response
 	Session int64
 	proxy   *ProxyHttpServer
@@ -15,6 +15,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ConnectActionLiteral int
@@ -94,29 +95,39 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
+		tunnel := &Tunnel{Host: host, ClientAddr: r.RemoteAddr, Start: time.Now()}
 		targetSiteCon, err := proxy.connectDial("tcp", host)
 		if err != nil {
+			tunnel.Err = err
+			proxy.tunnelDone(tunnel, ctx)
 			httpError(proxyClient, ctx, err)
 			return
 		}
+		tunnel.RemoteAddr = targetSiteCon.RemoteAddr().String()
 		ctx.Logf("Accepting CONNECT to %s", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 
 		targetTCP, targetOK := targetSiteCon.(*net.TCPConn)
 		proxyClientTCP, clientOK := proxyClient.(*net.TCPConn)
 		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
+			go func() {
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go copyAndClose(ctx, targetTCP, proxyClientTCP, tunnel, true, &wg)
+				go copyAndClose(ctx, proxyClientTCP, targetTCP, tunnel, false, &wg)
+				wg.Wait()
+				proxy.tunnelDone(tunnel, ctx)
+			}()
 		} else {
 			go func() {
 				var wg sync.WaitGroup
 				wg.Add(2)
-				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg)
-				go copyOrWarn(ctx, proxyClient, targetSiteCon, &wg)
+				go copyOrWarn(ctx, targetSiteCon, proxyClient, tunnel, true, &wg)
+				go copyOrWarn(ctx, proxyClient, targetSiteCon, tunnel, false, &wg)
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
-
+				proxy.tunnelDone(tunnel, ctx)
 			}()
 		}
 
@@ -145,11 +156,15 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			req, resp := proxy.filterRequest(req, ctx)
 			if resp == nil {
 				if err := req.Write(targetSiteCon); err != nil {
+					ctx.Error = err
+					proxy.filterResponse(nil, ctx)
 					httpError(proxyClient, ctx, err)
 					return
 				}
 				resp, err = http.ReadResponse(remote, req)
 				if err != nil {
+					ctx.Error = err
+					proxy.filterResponse(nil, ctx)
 					httpError(proxyClient, ctx, err)
 					return
 				}
@@ -177,6 +192,19 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				return
 			}
 		}
+		// remember what the client offered, GetConfigForClient returning
+		// nil keeps tlsConfig as it is
+		var clientHello *tls.ClientHelloInfo
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			clientHello = &tls.ClientHelloInfo{
+				ServerName:        hello.ServerName,
+				SupportedProtos:   hello.SupportedProtos,
+				SupportedVersions: hello.SupportedVersions,
+				CipherSuites:      hello.CipherSuites,
+			}
+			return nil, nil
+		}
 		go func() {
 			//TODO: cache connections to the remote website
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
@@ -185,10 +213,12 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				return
 			}
 			defer rawClientTls.Close()
+			clientState := rawClientTls.ConnectionState()
 			clientTlsReader := bufio.NewReader(rawClientTls)
 			for !isEof(clientTlsReader) {
 				req, err := http.ReadRequest(clientTlsReader)
-				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy}
+				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy,
+					ClientHello: clientHello, ClientTLS: &clientState}
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -208,6 +238,8 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				ctx.Req = req
 
 				req, resp := proxy.filterRequest(req, ctx)
+				// the response handlers run once, on the failure when there is one
+				filtered := false
 				if resp == nil {
 					if err != nil {
 						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
@@ -217,13 +249,35 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					resp, err = ctx.RoundTrip(req)
 					if err != nil {
 						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-						return
+						// let the response handlers see the failure, as ServeHTTP does
+						ctx.Error = err
+						resp, filtered = proxy.filterResponse(nil, ctx), true
+						if resp == nil {
+							httpError(rawClientTls, ctx, err)
+							return
+						}
 					}
 					ctx.Logf("resp %v", resp.Status)
 				}
-				resp = proxy.filterResponse(resp, ctx)
+				if !filtered {
+					resp = proxy.filterResponse(resp, ctx)
+				}
 				defer resp.Body.Close()
 
+				if isWebSocketResponse(resp) {
+					upstream, ok := resp.Body.(io.ReadWriteCloser)
+					if !ok {
+						ctx.Warnf("Cannot relay WebSocket of %v, no upstream connection", r.Host)
+						return
+					}
+					if err := writeResponseHead(rawClientTls, resp); err != nil {
+						ctx.Warnf("Cannot write WebSocket handshake to mitm'd client: %v", err)
+						return
+					}
+					proxy.relayWebSocket(ctx, clientTlsReader, rawClientTls, upstream)
+					return
+				}
+
 				text := resp.Status
 				statusCode := strconv.Itoa(resp.StatusCode) + " "
 				if strings.HasPrefix(text, statusCode) {
@@ -284,20 +338,25 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	}
 }
 
-func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, tunnel *Tunnel, fromClient bool, wg *sync.WaitGroup) {
+	n, err := io.Copy(dst, src)
+	if err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
+	tunnel.copied(fromClient, n, err)
 	wg.Done()
 }
 
-func copyAndClose(ctx *ProxyCtx, dst, src *net.TCPConn) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyAndClose(ctx *ProxyCtx, dst, src *net.TCPConn, tunnel *Tunnel, fromClient bool, wg *sync.WaitGroup) {
+	n, err := io.Copy(dst, src)
+	if err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
+	tunnel.copied(fromClient, n, err)
 
 	dst.CloseWrite()
 	src.CloseRead()
+	wg.Done()
 }
 
 func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn, error) {
@@ -396,7 +455,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(net
 
 func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
 	return func(host string, ctx *ProxyCtx) (*tls.Config, error) {
-		config := *defaultTLSConfig
+		config := defaultTLSConfig.Clone()
 		ctx.Logf("signing for %s", stripPort(host))
 		cert, err := signHost(*ca, []string{stripPort(host)})
 		if err != nil {
@@ -404,6 +463,6 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 			return nil, err
 		}
 		config.Certificates = append(config.Certificates, cert)
-		return &config, nil
+		return config, nil
 	}
 }
@@ -23,10 +23,14 @@ type ProxyHttpServer struct {
 	reqHandlers     []ReqHandler
 	respHandlers    []RespHandler
 	httpsHandlers   []HttpsHandler
+	wsHandlers      []WebSocketHandler
 	Tr              *http.Transport
 	// ConnectDial will be used to create TCP connections for CONNECT requests
 	// if nil Tr.Dial will be used
 	ConnectDial func(network string, addr string) (net.Conn, error)
+	// TunnelDone, if not nil, is called when a CONNECT handled with
+	// ConnectAccept is over, or could not reach its host
+	TunnelDone func(t *Tunnel, ctx *ProxyCtx)
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -72,6 +76,7 @@ func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *Proxy
 }
 
 func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
+	websocket := isWebSocketRequest(r)
 	r.RequestURI = "" // this must be reset when serving a request with the client
 	ctx.Logf("Sending request %v %v", r.Method, r.URL.String())
 	// If no Accept-Encoding header exists, Transport will add the headers it can accept
@@ -89,6 +94,12 @@ func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 	//   options that are desired for that particular connection and MUST NOT
 	//   be communicated by proxies over further connections.
 	r.Header.Del("Connection")
+	if websocket {
+		// the upgrade is negotiated end to end, without compression so the
+		// proxy can read the frames
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Del("Sec-WebSocket-Extensions")
+	}
 }
 
 // Standard net/http function. Shouldn't be used directly, http.Serve will use it.
@@ -107,12 +118,14 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}
 		r, resp := proxy.filterRequest(r, ctx)
 
+		// the response handlers run once, on the failure when there is one
+		filtered := false
 		if resp == nil {
 			removeProxyHeaders(ctx, r)
 			resp, err = ctx.RoundTrip(r)
 			if err != nil {
 				ctx.Error = err
-				resp = proxy.filterResponse(nil, ctx)
+				resp, filtered = proxy.filterResponse(nil, ctx), true
 				if resp == nil {
 					ctx.Logf("error read response %v %v:", r.URL.Host, err.Error())
 					http.Error(w, err.Error(), 500)
@@ -122,8 +135,14 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			ctx.Logf("Received response %v", resp.Status)
 		}
 		origBody := resp.Body
-		resp = proxy.filterResponse(resp, ctx)
+		if !filtered {
+			resp = proxy.filterResponse(resp, ctx)
+		}
 		defer origBody.Close()
+		if isWebSocketResponse(resp) {
+			proxy.serveWebSocket(w, resp, ctx)
+			return
+		}
 		ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
 		// http.ResponseWriter will take care of filling the correct response length
 		// Setting it now, might impose wrong value, contradicting the actual new
@@ -0,0 +1,56 @@
+package goproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Tunnel describes a CONNECT handled with ConnectAccept, whose bytes the proxy
+// copies without looking at them. It is handed to ProxyHttpServer.TunnelDone
+// once both directions are closed.
+type Tunnel struct {
+	// Host is the host:port the client asked for
+	Host       string
+	ClientAddr string
+	// RemoteAddr is the address of the server, empty if it could not be dialed
+	RemoteAddr string
+	Start, End time.Time
+	// bytes copied from the client to the server and back
+	BytesToServer int64
+	BytesToClient int64
+	// ClosedBy is "client" or "server", whichever stopped sending first
+	ClosedBy string
+	// Err is the first error of the tunnel, the dial error if the server could
+	// not be reached
+	Err error
+
+	mu sync.Mutex
+}
+
+// copied records the end of one direction of the tunnel.
+func (t *Tunnel) copied(fromClient bool, n int64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if fromClient {
+		t.BytesToServer = n
+	} else {
+		t.BytesToClient = n
+	}
+	if t.ClosedBy == "" {
+		if fromClient {
+			t.ClosedBy = "client"
+		} else {
+			t.ClosedBy = "server"
+		}
+	}
+	if t.Err == nil {
+		t.Err = err
+	}
+}
+
+func (proxy *ProxyHttpServer) tunnelDone(t *Tunnel, ctx *ProxyCtx) {
+	t.End = time.Now()
+	if proxy.TunnelDone != nil {
+		proxy.TunnelDone(t, ctx)
+	}
+}
@@ -0,0 +1,284 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes
+const (
+	WebSocketContinuation = 0
+	WebSocketText         = 1
+	WebSocketBinary       = 2
+	WebSocketClose        = 8
+	WebSocketPing         = 9
+	WebSocketPong         = 10
+)
+
+// maxWebSocketMessage bounds the messages the proxy buffers, a connection
+// sending a larger one is closed.
+const maxWebSocketMessage = 64 << 20
+
+// WebSocketMessage is a complete message, or a control frame, relayed over a
+// WebSocket connection the proxy intercepted. Fragmented messages are put
+// back together before handlers see them and forwarded as a single frame.
+type WebSocketMessage struct {
+	FromClient bool
+	Opcode     int
+	Payload    []byte
+	Time       time.Time
+}
+
+// WebSocketHandler may modify a message before it is forwarded. Returning nil
+// drops it, later handlers do not see it.
+type WebSocketHandler interface {
+	HandleMessage(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage
+}
+
+// A wrapper that would convert a function to a WebSocketHandler interface type
+type FuncWebSocketHandler func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage
+
+// FuncWebSocketHandler.HandleMessage(msg,ctx) <=> FuncWebSocketHandler(msg,ctx)
+func (f FuncWebSocketHandler) HandleMessage(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage {
+	return f(msg, ctx)
+}
+
+// HandleWebSocket registers a handler for the messages of intercepted
+// WebSocket connections, handlers run in the order they were registered.
+// ctx is the context of the upgrade request.
+func (proxy *ProxyHttpServer) HandleWebSocket(h WebSocketHandler) {
+	proxy.wsHandlers = append(proxy.wsHandlers, h)
+}
+
+// HandleWebSocketFunc is HandleWebSocket for a function.
+func (proxy *ProxyHttpServer) HandleWebSocketFunc(f func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage) {
+	proxy.HandleWebSocket(FuncWebSocketHandler(f))
+}
+
+func (proxy *ProxyHttpServer) filterWebSocket(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage {
+	for _, h := range proxy.wsHandlers {
+		if msg = h.HandleMessage(msg, ctx); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocketResponse(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket completes an upgrade accepted by the server, hijacking the
+// client connection of a plain proxy request.
+func (proxy *ProxyHttpServer) serveWebSocket(w http.ResponseWriter, resp *http.Response, ctx *ProxyCtx) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	hij, hijOK := w.(http.Hijacker)
+	if !ok || !hijOK {
+		ctx.Warnf("Cannot relay WebSocket, connection cannot be taken over")
+		http.Error(w, "cannot relay WebSocket", http.StatusBadGateway)
+		return
+	}
+	client, brw, err := hij.Hijack()
+	if err != nil {
+		ctx.Warnf("Cannot hijack WebSocket client connection: %v", err)
+		return
+	}
+	defer client.Close()
+	if err := writeResponseHead(client, resp); err != nil {
+		ctx.Warnf("Cannot write WebSocket handshake to client: %v", err)
+		return
+	}
+	proxy.relayWebSocket(ctx, brw.Reader, client, upstream)
+}
+
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	resp.Header.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// relayWebSocket copies messages both ways until either side goes away.
+func (proxy *ProxyHttpServer) relayWebSocket(ctx *ProxyCtx, clientReader io.Reader, client io.Writer, upstream io.ReadWriteCloser) {
+	ctx.Logf("Relaying WebSocket")
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			upstream.Close()
+			if c, ok := client.(io.Closer); ok {
+				c.Close()
+			}
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer stop()
+		if err := proxy.relayMessages(ctx, bufio.NewReader(clientReader), upstream, true); !closedConn(err) {
+			ctx.Warnf("WebSocket from client: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer stop()
+		if err := proxy.relayMessages(ctx, bufio.NewReader(upstream), client, false); !closedConn(err) {
+			ctx.Warnf("WebSocket from server: %v", err)
+		}
+	}()
+	wg.Wait()
+	ctx.Logf("WebSocket closed")
+}
+
+// closedConn tells the errors of a relay that ended normally, when either
+// side closed the connection.
+func closedConn(err error) bool {
+	return err == nil || err == io.EOF || errors.Is(err, net.ErrClosed)
+}
+
+// relayMessages reads frames from src and forwards them to dst, frames sent
+// to the server are masked as the protocol requires.
+func (proxy *ProxyHttpServer) relayMessages(ctx *ProxyCtx, src *bufio.Reader, dst io.Writer, fromClient bool) error {
+	var pending *WebSocketMessage
+	for {
+		f, err := readFrame(src)
+		if err != nil {
+			return err
+		}
+		var msg *WebSocketMessage
+		switch {
+		case f.opcode >= WebSocketClose:
+			// control frames may come between the fragments of a message
+			msg = &WebSocketMessage{FromClient: fromClient, Opcode: f.opcode, Payload: f.payload}
+		case f.opcode == WebSocketContinuation:
+			if pending == nil {
+				return errors.New("continuation frame without a message")
+			}
+			if len(pending.Payload)+len(f.payload) > maxWebSocketMessage {
+				return errors.New("message too large")
+			}
+			pending.Payload = append(pending.Payload, f.payload...)
+		default:
+			pending = &WebSocketMessage{FromClient: fromClient, Opcode: f.opcode, Payload: f.payload}
+		}
+		if msg == nil && f.fin {
+			msg, pending = pending, nil
+		}
+		if msg == nil {
+			continue
+		}
+		msg.Time = time.Now()
+		if msg = proxy.filterWebSocket(msg, ctx); msg == nil {
+			continue
+		}
+		if err := writeFrame(dst, msg.Opcode, msg.Payload, fromClient); err != nil {
+			return err
+		}
+	}
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+func readFrame(r *bufio.Reader) (*wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &wsFrame{fin: head[0]&0x80 != 0, opcode: int(head[0] & 0x0f)}
+	masked := head[1]&0x80 != 0
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxWebSocketMessage {
+		return nil, errors.New("frame too large")
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeFrame writes payload as a single final frame.
+func writeFrame(w io.Writer, opcode int, payload []byte, mask bool) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|byte(opcode))
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		buf = append(append(buf, maskBit|127), ext[:]...)
+	}
+	if !mask {
+		_, err := w.Write(append(buf, payload...))
+		return err
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	buf = append(buf, key[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^key[i%4])
+	}
+	_, err := w.Write(buf)
+	return err
+}
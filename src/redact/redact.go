@@ -0,0 +1,545 @@
+// Package redact removes credentials and other secrets from flows before
+// they are stored. Rules are loaded from JSON:
+//
+//	{
+//	    "headers": ["Authorization", "Cookie", "Set-Cookie", "X-Api-Key"],
+//	    "json_paths": ["password", "user.*.token"],
+//	    "form_fields": ["password", "api_key"],
+//	    "patterns": ["(?i)secret=([^&\\s]+)"],
+//	    "hash": true, "salt": "..."
+//	}
+//
+// Headers are matched by name in requests and responses; only the values of
+// Cookie and Set-Cookie pairs are redacted, their names are kept. JSON paths
+// are the dotted names of package capture's Params, a * standing for one
+// key, and a path without a dot matches that key at any depth. Form fields
+// are matched in query strings, urlencoded and multipart bodies. Bodies are
+// read as JSON or forms by their content type, or by what they look like
+// when it is another; JSON that does not parse, as truncated bodies do, is
+// scanned token by token and what follows a syntax error is dropped. Patterns
+// are regular expressions applied to header values, URLs, bodies and
+// WebSocket text messages; when one has groups only the groups are
+// redacted.
+//
+// A redacted value becomes "[REDACTED]", or with hash a salted HMAC-SHA256
+// of it, "[REDACTED:1a2b...]", so that equal values can still be
+// correlated across flows without being stored.
+package redact
+
+import (
+    "bytes"
+    "capture"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "net/url"
+    "regexp"
+    "strings"
+)
+
+// Marker replaces redacted values when they are not hashed.
+const Marker = "[REDACTED]"
+
+// Rules say what to redact, a nil *Rules redacts nothing.
+type Rules struct {
+    Headers    []string `json:"headers,omitempty"`
+    JSONPaths  []string `json:"json_paths,omitempty"`
+    FormFields []string `json:"form_fields,omitempty"`
+    Patterns   []string `json:"patterns,omitempty"`
+    // Hash replaces values with a salted hash instead of Marker, Salt is
+    // then required.
+    Hash bool   `json:"hash,omitempty"`
+    Salt string `json:"salt,omitempty"`
+
+    headers  map[string]bool
+    fields   map[string]bool
+    paths    []*regexp.Regexp
+    patterns []*regexp.Regexp
+}
+
+// Load reads a JSON rules file.
+func Load(path string) (*Rules, error) {
+    b, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    r := new(Rules)
+    if err := json.Unmarshal(b, r); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if err := r.Compile(); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    return r, nil
+}
+
+// Compile checks the rules and prepares them, it must be called before
+// Flow when the rules were not loaded with Load.
+func (r *Rules) Compile() error {
+    if r.Hash && r.Salt == "" {
+        return fmt.Errorf("hash needs a salt")
+    }
+    r.headers = make(map[string]bool)
+    for _, name := range r.Headers {
+        r.headers[http.CanonicalHeaderKey(name)] = true
+    }
+    r.fields = make(map[string]bool)
+    for _, name := range r.FormFields {
+        r.fields[name] = true
+    }
+    r.paths = nil
+    for _, p := range r.JSONPaths {
+        if p == "" {
+            return fmt.Errorf("empty JSON path")
+        }
+        expr := strings.Replace(regexp.QuoteMeta(p), `\*`, `[^.]+`, -1)
+        if !strings.Contains(p, ".") {
+            expr = `(^|.*\.)` + expr
+        }
+        r.paths = append(r.paths, regexp.MustCompile("^"+expr+"$"))
+    }
+    r.patterns = nil
+    for _, p := range r.Patterns {
+        re, err := regexp.Compile(p)
+        if err != nil {
+            return fmt.Errorf("pattern %q: %v", p, err)
+        }
+        r.patterns = append(r.patterns, re)
+    }
+    return nil
+}
+
+// Empty tells if r redacts nothing.
+func (r *Rules) Empty() bool {
+    return r == nil || len(r.Headers)+len(r.JSONPaths)+len(r.FormFields)+len(r.Patterns) == 0
+}
+
+// value is what a redacted v is stored as.
+func (r *Rules) value(v string) string {
+    if !r.Hash {
+        return Marker
+    }
+    mac := hmac.New(sha256.New, []byte(r.Salt))
+    io.WriteString(mac, v)
+    return "[REDACTED:" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+}
+
+// Flow redacts f in place. RawBody is dropped, its encoding cannot be
+// redacted.
+func (r *Rules) Flow(f *capture.Response) {
+    if r.Empty() {
+        return
+    }
+    f.Header = r.header(f.Header)
+    f.RequestHeader = r.header(f.RequestHeader)
+    f.URL = r.rawURL(f.URL)
+    f.RequestBody = r.body(f.RequestBody, f.RequestHeader.Get("Content-Type"))
+    f.Body = r.body(f.Body, f.Header.Get("Content-Type"))
+    f.RawBody = nil
+    for _, m := range f.Messages {
+        r.Message(m)
+    }
+}
+
+// Message redacts the payload of a WebSocket text message.
+func (r *Rules) Message(m *capture.Message) {
+    if r.Empty() || m.Opcode != 1 {
+        return
+    }
+    // messages have no content type, what they look like decides
+    m.Payload = r.body(m.Payload, "")
+}
+
+// header returns a redacted copy of h, the flow may share h with the
+// request or response.
+func (r *Rules) header(h http.Header) http.Header {
+    if h == nil {
+        return nil
+    }
+    out := make(http.Header, len(h))
+    for name, values := range h {
+        canonical := http.CanonicalHeaderKey(name)
+        redacted := make([]string, len(values))
+        for i, v := range values {
+            switch {
+            case !r.headers[canonical]:
+                redacted[i] = r.text(v)
+            case canonical == "Cookie":
+                redacted[i] = r.cookie(v, "; ", false)
+            case canonical == "Set-Cookie":
+                redacted[i] = r.cookie(v, ";", true)
+            default:
+                redacted[i] = r.value(v)
+            }
+        }
+        out[name] = redacted
+    }
+    return out
+}
+
+// cookie redacts the values of name=value pairs separated by sep, only the
+// first one when attributes follow it as in Set-Cookie.
+func (r *Rules) cookie(v, sep string, first bool) string {
+    pairs := strings.Split(v, sep)
+    for i, pair := range pairs {
+        if first && i > 0 {
+            break
+        }
+        if eq := strings.Index(pair, "="); eq >= 0 {
+            pairs[i] = pair[:eq+1] + r.value(pair[eq+1:])
+        }
+    }
+    return strings.Join(pairs, sep)
+}
+
+// text applies the patterns to s.
+func (r *Rules) text(s string) string {
+    return string(r.patternsIn([]byte(s)))
+}
+
+func (r *Rules) patternsIn(b []byte) []byte {
+    for _, re := range r.patterns {
+        if re.NumSubexp() == 0 {
+            b = re.ReplaceAllFunc(b, func(m []byte) []byte {
+                return []byte(r.value(string(m)))
+            })
+            continue
+        }
+        // redact the groups only, keeping what surrounds them
+        var out []byte
+        last := 0
+        for _, loc := range re.FindAllSubmatchIndex(b, -1) {
+            for g := 2; g < len(loc); g += 2 {
+                if loc[g] < last || loc[g] < 0 {
+                    continue
+                }
+                out = append(out, b[last:loc[g]]...)
+                out = append(out, r.value(string(b[loc[g]:loc[g+1]]))...)
+                last = loc[g+1]
+            }
+        }
+        if out != nil {
+            b = append(out, b[last:]...)
+        }
+    }
+    return b
+}
+
+// rawURL redacts the form fields of the query string of u and applies the
+// patterns.
+func (r *Rules) rawURL(u string) string {
+    if i := strings.Index(u, "?"); i >= 0 && len(r.fields) > 0 {
+        u = u[:i+1] + r.query(u[i+1:])
+    }
+    return r.text(u)
+}
+
+// query redacts the fields of an urlencoded string, keeping their order.
+func (r *Rules) query(q string) string {
+    pairs := strings.Split(q, "&")
+    for i, pair := range pairs {
+        name, value := pair, ""
+        eq := strings.Index(pair, "=")
+        if eq >= 0 {
+            name, value = pair[:eq], pair[eq+1:]
+        }
+        if n, err := url.QueryUnescape(name); err == nil {
+            name = n
+        }
+        if eq >= 0 && r.fields[name] {
+            if v, err := url.QueryUnescape(value); err == nil {
+                value = v
+            }
+            pairs[i] = pair[:eq+1] + url.QueryEscape(r.value(value))
+        }
+    }
+    return strings.Join(pairs, "&")
+}
+
+// body redacts a body according to its content type, or to what it looks
+// like when the type does not tell, as for JSON sent as text/plain, then
+// applies the patterns to it whatever its type.
+func (r *Rules) body(b []byte, contentType string) []byte {
+    if len(b) == 0 {
+        return b
+    }
+    mediatype, params, _ := mime.ParseMediaType(contentType)
+    switch {
+    case strings.HasPrefix(mediatype, "multipart/") && len(r.fields) > 0:
+        b = r.multipart(b, params["boundary"])
+    case (strings.Contains(mediatype, "json") || looksLikeJSON(b)) && len(r.paths) > 0:
+        b = r.json(b)
+    case (mediatype == "application/x-www-form-urlencoded" || looksLikeForm(b)) && len(r.fields) > 0:
+        b = []byte(r.query(string(b)))
+    }
+    return r.patternsIn(b)
+}
+
+// looksLikeJSON tells if b starts as a JSON object or array would.
+func looksLikeJSON(b []byte) bool {
+    b = bytes.TrimLeft(b, " \t\r\n")
+    if len(b) < 2 || b[0] != '{' && b[0] != '[' {
+        return false
+    }
+    next := bytes.TrimLeft(b[1:], " \t\r\n")
+    if len(next) == 0 {
+        return true
+    }
+    if b[0] == '{' {
+        return next[0] == '"' || next[0] == '}'
+    }
+    return strings.IndexByte(`{["-0123456789tfn]`, next[0]) >= 0
+}
+
+// looksLikeForm tells if b could be an urlencoded form: name=value pairs
+// without spaces.
+func looksLikeForm(b []byte) bool {
+    return bytes.IndexByte(b, '=') > 0 && bytes.IndexAny(b, " \t\r\n{[") < 0
+}
+
+// json redacts the values at the configured paths, the body is encoded
+// again when it changed. Bodies that do not parse, truncated ones among
+// them, are scanned token by token instead.
+func (r *Rules) json(b []byte) []byte {
+    var v interface{}
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    if dec.Decode(&v) != nil {
+        return r.scanJSON(b)
+    }
+    changed := false
+    v = r.walk("", v, &changed)
+    if !changed {
+        return b
+    }
+    out, err := json.Marshal(v)
+    if err != nil {
+        return b
+    }
+    return out
+}
+
+// scanJSON redacts the values at the configured paths in place, reading b
+// a token at a time so that it can stop where b does not parse. A value
+// at a configured path that is cut by the end of b is redacted to the end;
+// what follows a syntax error cannot be told apart from a value and is
+// dropped.
+func (r *Rules) scanJSON(b []byte) []byte {
+    type frame struct {
+        object bool
+        // key is the key of the value read in an object, wantKey tells
+        // that a key comes next
+        key     string
+        wantKey bool
+    }
+    var (
+        out   []byte
+        last  int
+        stack []*frame
+        // start and depth of the object or array being redacted
+        from  = -1
+        depth int
+    )
+    replace := func(start, end int, v string) {
+        out = append(out, b[last:start]...)
+        js, _ := json.Marshal(r.value(v))
+        out = append(out, js...)
+        last = end
+    }
+    path := func() string {
+        var keys []string
+        for _, f := range stack {
+            if f.object {
+                keys = append(keys, f.key)
+            }
+        }
+        return strings.Join(keys, ".")
+    }
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    for {
+        start := int(dec.InputOffset())
+        for start < len(b) && strings.IndexByte(" \t\r\n:,", b[start]) >= 0 {
+            start++
+        }
+        tok, err := dec.Token()
+        if err != nil {
+            top := len(stack) - 1
+            switch {
+            case start >= len(b):
+            case from >= 0:
+                replace(from, len(b), string(b[from:]))
+            case top >= 0 && stack[top].object && !stack[top].wantKey && r.matchPath(path()):
+                replace(start, len(b), string(b[start:]))
+            case err != io.EOF && err != io.ErrUnexpectedEOF:
+                out = append(out, b[last:start]...)
+                out = append(out, Marker...)
+                last = len(b)
+            }
+            break
+        }
+        end := int(dec.InputOffset())
+        top := len(stack) - 1
+        if top >= 0 && stack[top].object && stack[top].wantKey {
+            if key, ok := tok.(string); ok {
+                stack[top].key, stack[top].wantKey = key, false
+                continue
+            }
+        }
+        if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+            stack = stack[:top]
+            if from >= 0 && len(stack) == depth {
+                replace(from, end, string(b[from:end]))
+                from = -1
+            }
+        } else {
+            match := from < 0 && len(stack) > 0 && r.matchPath(path())
+            if d, ok := tok.(json.Delim); ok {
+                if match {
+                    from, depth = start, len(stack)
+                }
+                stack = append(stack, &frame{object: d == '{', wantKey: d == '{'})
+                continue
+            }
+            if match {
+                v := string(b[start:end])
+                if s, ok := tok.(string); ok {
+                    v = s
+                }
+                replace(start, end, v)
+            }
+        }
+        if top := len(stack) - 1; top >= 0 && stack[top].object {
+            stack[top].wantKey = true
+        }
+    }
+    return append(out, b[last:]...)
+}
+
+func (r *Rules) walk(path string, v interface{}, changed *bool) interface{} {
+    switch vv := v.(type) {
+    case map[string]interface{}:
+        for k, child := range vv {
+            p := k
+            if path != "" {
+                p = path + "." + k
+            }
+            if r.matchPath(p) {
+                vv[k] = r.value(scalar(child))
+                *changed = true
+            } else {
+                vv[k] = r.walk(p, child, changed)
+            }
+        }
+    case []interface{}:
+        // array elements share the path of the array, as in Params
+        for i, child := range vv {
+            vv[i] = r.walk(path, child, changed)
+        }
+    }
+    return v
+}
+
+func (r *Rules) matchPath(p string) bool {
+    for _, re := range r.paths {
+        if re.MatchString(p) {
+            return true
+        }
+    }
+    return false
+}
+
+// scalar is the text a redacted JSON value is hashed from.
+func scalar(v interface{}) string {
+    if s, ok := v.(string); ok {
+        return s
+    }
+    js, _ := json.Marshal(v)
+    return string(js)
+}
+
+// multipart rewrites a multipart body with the configured fields redacted.
+// Like scanJSON it stops where b cannot be read, as when it was cut at the
+// body limit: a part cut short is kept as far as it goes, redacted if it is
+// a configured field, and what follows an error reading the next part is
+// replaced by Marker. The body is never kept as it was.
+func (r *Rules) multipart(b []byte, boundary string) []byte {
+    var out bytes.Buffer
+    mw := multipart.NewWriter(&out)
+    if boundary == "" || mw.SetBoundary(boundary) != nil {
+        return []byte(Marker)
+    }
+    mr := multipart.NewReader(bytes.NewReader(b), boundary)
+    for {
+        p, err := mr.NextRawPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            if out.Len() > 0 {
+                out.WriteString("\r\n")
+            }
+            out.WriteString(Marker)
+            return out.Bytes()
+        }
+        content, rerr := ioutil.ReadAll(p)
+        if r.fields[p.FormName()] {
+            content = []byte(r.value(string(content)))
+        }
+        w, err := mw.CreatePart(textproto.MIMEHeader(p.Header))
+        if err != nil {
+            return []byte(Marker)
+        }
+        w.Write(content)
+        if rerr != nil {
+            return out.Bytes()
+        }
+    }
+    mw.Close()
+    return out.Bytes()
+}
+
+// Sink redacts flows and messages before handing them to the next sink.
+type Sink struct {
+    rules *Rules
+    next  capture.CaptureSink
+}
+
+// NewSink wraps next, rules must be compiled.
+func NewSink(rules *Rules, next capture.CaptureSink) *Sink {
+    return &Sink{rules: rules, next: next}
+}
+
+func (s *Sink) Write(f *capture.Response) error {
+    s.rules.Flow(f)
+    return s.next.Write(f)
+}
+
+// WriteMessages redacts msgs and forwards them if the next sink is a
+// MessageSink.
+func (s *Sink) WriteMessages(msgs []*capture.Message) error {
+    ms, ok := s.next.(capture.MessageSink)
+    if !ok {
+        return nil
+    }
+    for _, m := range msgs {
+        s.rules.Message(m)
+    }
+    return ms.WriteMessages(msgs)
+}
+
+func (s *Sink) Flush() error {
+    return s.next.Flush()
+}
+
+func (s *Sink) Close() error {
+    return s.next.Close()
+}
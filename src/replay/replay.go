@@ -0,0 +1,221 @@
+// Package replay sends a stored flow again, optionally edited, through a
+// running wyproxy: its handlers, scope and upstream settings apply as for
+// any other request, and it records the result as a new flow whose
+// ReplayOf is the FlowID of the original.
+package replay
+
+import (
+    "bytes"
+    "capture"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    // Header carries the FlowID of the original flow, FlowHeader the
+    // FlowID the replay is to be recorded under and SignatureHeader proves
+    // a Replayer of the proxy's own process sent them. The proxy removes
+    // them with Take before sending the request on.
+    Header          = "X-Wyproxy-Replay-Of"
+    FlowHeader      = "X-Wyproxy-Flow"
+    SignatureHeader = "X-Wyproxy-Replay-Signature"
+)
+
+// key signs the headers of replays, it is made anew by every process so
+// that no client of the proxy can choose the flow ids it is recorded under.
+var key = func() []byte {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        panic("replay: " + err.Error())
+    }
+    return b
+}()
+
+func sign(replayOf, flowID string) string {
+    mac := hmac.New(sha256.New, key)
+    io.WriteString(mac, replayOf+" "+flowID)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Take removes the replay headers from h and returns the flow ids they
+// carry when a Replayer of this process sent them, empty strings for any
+// other request.
+func Take(h http.Header) (replayOf, flowID string) {
+    replayOf, flowID, sig := h.Get(Header), h.Get(FlowHeader), h.Get(SignatureHeader)
+    for _, name := range []string{Header, FlowHeader, SignatureHeader} {
+        h.Del(name)
+    }
+    if !IsFlowID(replayOf) || !IsFlowID(flowID) || !hmac.Equal([]byte(sig), []byte(sign(replayOf, flowID))) {
+        return "", ""
+    }
+    return replayOf, flowID
+}
+
+// MaxBody bounds the response body a Result holds.
+const MaxBody = 16 << 20
+
+// Edits overrides parts of the replayed request, its zero fields keep the
+// original.
+type Edits struct {
+    Method string `json:"method,omitempty"`
+    URL    string `json:"url,omitempty"`
+    // Header values replace the original ones of the same name, an empty
+    // list removes the header.
+    Header http.Header `json:"header,omitempty"`
+    // Body replaces the original body when not nil.
+    Body *string `json:"body,omitempty"`
+}
+
+// Result is the response to a replay.
+type Result struct {
+    ReplayOf string `json:"replay_of"`
+    // FlowID is the id the proxy records the replay under, it records
+    // nothing for hosts out of its scope.
+    FlowID string      `json:"flow_id"`
+    Status int         `json:"status"`
+    Header http.Header `json:"header"`
+    // Body is decompressed and converted to UTF-8 like stored bodies, and
+    // cut at MaxBody.
+    Body      []byte `json:"body,omitempty"`
+    Truncated bool   `json:"truncated"`
+}
+
+// IsFlowID tells if s has the form of a FlowID.
+func IsFlowID(s string) bool {
+    b, err := hex.DecodeString(s)
+    return err == nil && len(b) == 16
+}
+
+// Request rebuilds the request of flow with e applied.
+func Request(flow *capture.Response, e Edits) (*http.Request, error) {
+    switch {
+    case flow.Method == "CONNECT":
+        return nil, errors.New("replay: tunnels cannot be replayed")
+    case flow.Status == http.StatusSwitchingProtocols:
+        return nil, errors.New("replay: WebSocket flows cannot be replayed")
+    case flow.RequestTruncated && e.Body == nil:
+        return nil, fmt.Errorf("replay: only %d of the %d bytes of the request body were recorded, give the body to send", len(flow.RequestBody), flow.RequestOriginalSize)
+    }
+    method, rawurl, body := flow.Method, flow.URL, flow.RequestBody
+    if e.Method != "" {
+        method = strings.ToUpper(e.Method)
+    }
+    if e.URL != "" {
+        rawurl = e.URL
+    }
+    if e.Body != nil {
+        body = []byte(*e.Body)
+    }
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return nil, fmt.Errorf("replay: %v", err)
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return nil, fmt.Errorf("replay: cannot send %q, only http and https URLs", rawurl)
+    }
+    req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+    if err != nil {
+        return nil, fmt.Errorf("replay: %v", err)
+    }
+    req.Header = flow.RequestHeader.Clone()
+    if req.Header == nil {
+        req.Header = make(http.Header)
+    }
+    // the transport sets the framing headers for the body sent
+    for _, name := range []string{"Content-Length", "Transfer-Encoding", "Connection", Header, FlowHeader, SignatureHeader} {
+        req.Header.Del(name)
+    }
+    for name, values := range e.Header {
+        if len(values) == 0 {
+            req.Header.Del(name)
+        } else {
+            req.Header[http.CanonicalHeaderKey(name)] = values
+        }
+    }
+    if host := req.Header.Get("Host"); host != "" {
+        req.Host = host
+        req.Header.Del("Host")
+    }
+    return req, nil
+}
+
+// Replayer sends replays through a proxy, which records them as replays
+// only when it runs in the same process.
+type Replayer struct {
+    client *http.Client
+}
+
+// New sends replays through the proxy at addr, a host:port such as the
+// proxy's listen address, or a URL. An empty host means this machine.
+func New(addr string) (*Replayer, error) {
+    if !strings.Contains(addr, "://") {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil {
+            return nil, fmt.Errorf("replay: proxy address: %v", err)
+        }
+        if host == "" || host == "0.0.0.0" || host == "::" {
+            host = "127.0.0.1"
+        }
+        addr = "http://" + net.JoinHostPort(host, port)
+    }
+    proxy, err := url.Parse(addr)
+    if err != nil {
+        return nil, fmt.Errorf("replay: proxy address: %v", err)
+    }
+    return &Replayer{client: &http.Client{
+        Transport: &http.Transport{
+            Proxy: http.ProxyURL(proxy),
+            // the certificates are the proxy's own, the proxy verifies
+            // the server's as configured
+            TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+            DisableCompression: true,
+        },
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+        Timeout: 2 * time.Minute,
+    }}, nil
+}
+
+// Replay sends the request of flow with e applied.
+func (rp *Replayer) Replay(flow *capture.Response, e Edits) (*Result, error) {
+    if !IsFlowID(flow.FlowID) {
+        return nil, errors.New("replay: the flow has no flow id")
+    }
+    req, err := Request(flow, e)
+    if err != nil {
+        return nil, err
+    }
+    result := &Result{ReplayOf: flow.FlowID, FlowID: capture.NewFlowID()}
+    req.Header.Set(Header, result.ReplayOf)
+    req.Header.Set(FlowHeader, result.FlowID)
+    req.Header.Set(SignatureHeader, sign(result.ReplayOf, result.FlowID))
+    resp, err := rp.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, MaxBody+1))
+    if err != nil {
+        return nil, err
+    }
+    if len(body) > MaxBody {
+        body, result.Truncated = body[:MaxBody], true
+    }
+    decoded := capture.Response{Header: resp.Header, ContentType: resp.Header.Get("Content-Type"), Body: body}
+    capture.Decode(&decoded, "", false, MaxBody)
+    result.Truncated = result.Truncated || decoded.Truncated
+    result.Status, result.Header, result.Body = resp.StatusCode, resp.Header, decoded.Body
+    return result, nil
+}
@@ -0,0 +1,114 @@
+package replay_test
+
+import (
+    "capture"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    . "replay"
+    "strings"
+    "testing"
+)
+
+func stored() *capture.Response {
+    return &capture.Response{
+        FlowID: capture.NewFlowID(),
+        Method: "POST",
+        URL:    "http://example.com/login?next=/",
+        RequestHeader: http.Header{
+            "Content-Type":   {"application/x-www-form-urlencoded"},
+            "Content-Length": {"7"},
+            "Cookie":         {"session=1"},
+            "User-Agent":     {"test"},
+        },
+        RequestBody: []byte("user=me"),
+    }
+}
+
+func TestRequestEdits(t *testing.T) {
+    body := "user=you"
+    req, err := Request(stored(), Edits{
+        Method: "put",
+        Header: http.Header{"cookie": {"session=2"}, "User-Agent": {}, "Host": {"other.example.com"}},
+        Body:   &body,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, _ := io.ReadAll(req.Body)
+    if req.Method != "PUT" || req.URL.String() != "http://example.com/login?next=/" || string(b) != body {
+        t.Errorf("Unexpected request %s %s %q", req.Method, req.URL, b)
+    }
+    if req.Header.Get("Cookie") != "session=2" || req.Header.Get("User-Agent") != "" || req.Header.Get("Content-Length") != "" {
+        t.Errorf("Unexpected headers %v", req.Header)
+    }
+    if req.Host != "other.example.com" {
+        t.Errorf("Expected Host other.example.com, got %s", req.Host)
+    }
+}
+
+func TestRequestRefused(t *testing.T) {
+    truncated := stored()
+    truncated.RequestTruncated, truncated.RequestOriginalSize = true, 100
+    tunnel := stored()
+    tunnel.Method = "CONNECT"
+    ws := stored()
+    ws.Status = 101
+    for name, flow := range map[string]*capture.Response{"truncated": truncated, "tunnel": tunnel, "websocket": ws} {
+        if _, err := Request(flow, Edits{}); err == nil {
+            t.Errorf("Expected %s flow refused", name)
+        }
+    }
+    body := "user=me"
+    if _, err := Request(truncated, Edits{Body: &body}); err != nil {
+        t.Errorf("Expected truncated flow replayed with a new body: %v", err)
+    }
+}
+
+func TestReplayThroughProxy(t *testing.T) {
+    flow := stored()
+    var got *http.Request
+    proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r
+        w.Header().Set("Content-Type", "text/plain")
+        w.WriteHeader(201)
+        io.WriteString(w, "replayed")
+    }))
+    defer proxy.Close()
+
+    rp, err := New(strings.TrimPrefix(proxy.URL, "http://"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    result, err := rp.Replay(flow, Edits{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.URL.String() != flow.URL || got.Header.Get(Header) != flow.FlowID || got.Header.Get(FlowHeader) != result.FlowID {
+        t.Errorf("Unexpected request through the proxy: %s %v", got.URL, got.Header)
+    }
+    if result.ReplayOf != flow.FlowID || !IsFlowID(result.FlowID) || result.Status != 201 || string(result.Body) != "replayed" {
+        t.Errorf("Unexpected result %+v", result)
+    }
+    if replayOf, flowID := Take(got.Header); replayOf != flow.FlowID || flowID != result.FlowID {
+        t.Errorf("Expected the proxy to take the replay headers, got %q %q", replayOf, flowID)
+    }
+    if got.Header.Get(Header) != "" || got.Header.Get(SignatureHeader) != "" {
+        t.Errorf("Expected the replay headers removed, got %v", got.Header)
+    }
+}
+
+func TestTakeForged(t *testing.T) {
+    for name, header := range map[string]http.Header{
+        "unsigned": {Header: {capture.NewFlowID()}, FlowHeader: {capture.NewFlowID()}},
+        "forged":   {Header: {capture.NewFlowID()}, FlowHeader: {capture.NewFlowID()}, SignatureHeader: {strings.Repeat("0", 64)}},
+        "not ids":  {Header: {"a"}, FlowHeader: {"b"}},
+    } {
+        if replayOf, flowID := Take(header); replayOf != "" || flowID != "" {
+            t.Errorf("%s: expected the headers ignored, got %q %q", name, replayOf, flowID)
+        }
+        if len(header) != 0 {
+            t.Errorf("%s: expected the headers removed, got %v", name, header)
+        }
+    }
+}
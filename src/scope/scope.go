@@ -0,0 +1,235 @@
+// Package scope decides which traffic wyproxy intercepts and records.
+//
+// A Scope is a list of include and exclude rules loaded from JSON:
+//
+//	{
+//	    "include": [{"host": "*.example.com"}, {"host": "10.0.0.0/8", "ports": "80,443,8000-8100"}],
+//	    "exclude": [{"host": "telemetry.example.com"}, {"path": "^/static/"}],
+//	    "tunnel":  [{"host": "pinned.example.com"}]
+//	}
+//
+// Traffic is in scope when it matches an include rule, or there are no
+// include rules at all, and no exclude rule. In scope CONNECT requests are
+// intercepted unless they match a tunnel rule, out of scope ones are passed
+// through untouched and nothing about them is recorded.
+package scope
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Action is what the proxy does with a CONNECT request.
+type Action int
+
+const (
+    // Ignore passes the tunnel through and records nothing.
+    Ignore Action = iota
+    // Intercept MITMs the tunnel and records its requests.
+    Intercept
+    // Tunnel passes the tunnel through but it is still in scope.
+    Tunnel
+)
+
+func (a Action) String() string {
+    switch a {
+    case Intercept:
+        return "intercept"
+    case Tunnel:
+        return "tunnel"
+    }
+    return "ignore"
+}
+
+// Rule matches a host, port and path. Empty fields match anything.
+type Rule struct {
+    // Host is a name, a wildcard such as *.example.com which also matches
+    // example.com itself, an IP address or a CIDR block. Addresses only
+    // match requests made to IP literals, names are not resolved.
+    Host string `json:"host,omitempty"`
+    // Ports is a comma separated list of ports and ranges, e.g. 80,8000-8100.
+    Ports string `json:"ports,omitempty"`
+    // Path is a regular expression matched against the request path.
+    Path string `json:"path,omitempty"`
+
+    network *net.IPNet
+    ports   [][2]int
+    path    *regexp.Regexp
+}
+
+// Scope holds the compiled rules, the zero value has everything in scope.
+type Scope struct {
+    Include []*Rule `json:"include,omitempty"`
+    Exclude []*Rule `json:"exclude,omitempty"`
+    Tunnel  []*Rule `json:"tunnel,omitempty"`
+}
+
+// Load reads a JSON scope file.
+func Load(path string) (*Scope, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    s := new(Scope)
+    if err := json.NewDecoder(f).Decode(s); err != nil {
+        return nil, fmt.Errorf("scope: %s: %v", path, err)
+    }
+    if err := s.Compile(); err != nil {
+        return nil, fmt.Errorf("scope: %s: %v", path, err)
+    }
+    return s, nil
+}
+
+// Compile checks and prepares the rules, it must be called before using a
+// Scope that was not returned by Load.
+func (s *Scope) Compile() error {
+    for _, list := range [][]*Rule{s.Include, s.Exclude, s.Tunnel} {
+        for _, r := range list {
+            if err := r.compile(); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func (r *Rule) compile() error {
+    r.Host = strings.ToLower(strings.TrimSpace(r.Host))
+    if strings.Contains(r.Host, "/") {
+        _, network, err := net.ParseCIDR(r.Host)
+        if err != nil {
+            return fmt.Errorf("invalid CIDR %q", r.Host)
+        }
+        r.network = network
+    }
+    r.ports = nil
+    for _, p := range strings.Split(r.Ports, ",") {
+        if p = strings.TrimSpace(p); p == "" {
+            continue
+        }
+        lo, hi := p, p
+        if i := strings.IndexByte(p, '-'); i >= 0 {
+            lo, hi = p[:i], p[i+1:]
+        }
+        from, err1 := strconv.Atoi(strings.TrimSpace(lo))
+        to, err2 := strconv.Atoi(strings.TrimSpace(hi))
+        if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+            return fmt.Errorf("invalid port range %q", p)
+        }
+        r.ports = append(r.ports, [2]int{from, to})
+    }
+    r.path = nil
+    if r.Path != "" {
+        re, err := regexp.Compile(r.Path)
+        if err != nil {
+            return fmt.Errorf("invalid path pattern %q: %v", r.Path, err)
+        }
+        r.path = re
+    }
+    return nil
+}
+
+func (r *Rule) matchHost(host string) bool {
+    switch {
+    case r.Host == "" || r.Host == "*":
+        return true
+    case r.network != nil:
+        ip := net.ParseIP(host)
+        return ip != nil && r.network.Contains(ip)
+    case strings.HasPrefix(r.Host, "*."):
+        return host == r.Host[2:] || strings.HasSuffix(host, r.Host[1:])
+    }
+    return host == r.Host
+}
+
+func (r *Rule) matchPort(port int) bool {
+    if len(r.ports) == 0 {
+        return true
+    }
+    for _, pr := range r.ports {
+        if port >= pr[0] && port <= pr[1] {
+            return true
+        }
+    }
+    return false
+}
+
+// match reports whether the rule matches, a rule with a path pattern never
+// matches when the path is not known yet.
+func (r *Rule) match(host string, port int, path string, knownPath bool) bool {
+    if !r.matchHost(host) || !r.matchPort(port) {
+        return false
+    }
+    if r.path == nil {
+        return true
+    }
+    return knownPath && r.path.MatchString(path)
+}
+
+func matchAny(rules []*Rule, host string, port int, path string, knownPath bool) bool {
+    for _, r := range rules {
+        if r.match(host, port, path, knownPath) {
+            return true
+        }
+    }
+    return false
+}
+
+// Connect decides what to do with a CONNECT to hostport. Include rules
+// with a path still allow the host, since its paths can only be checked
+// once the tunnel is intercepted.
+func (s *Scope) Connect(hostport string) Action {
+    host, port := splitHostPort(hostport, 443)
+    if s == nil {
+        return Intercept
+    }
+    included := len(s.Include) == 0
+    for _, r := range s.Include {
+        if r.matchHost(host) && r.matchPort(port) {
+            included = true
+            break
+        }
+    }
+    if !included || matchAny(s.Exclude, host, port, "", false) {
+        return Ignore
+    }
+    if matchAny(s.Tunnel, host, port, "", false) {
+        return Tunnel
+    }
+    return Intercept
+}
+
+// Captures reports whether a request to u is in scope.
+func (s *Scope) Captures(u *url.URL) bool {
+    if s == nil {
+        return true
+    }
+    defport := 80
+    if u.Scheme == "https" {
+        defport = 443
+    }
+    host, port := splitHostPort(u.Host, defport)
+    if len(s.Include) > 0 && !matchAny(s.Include, host, port, u.Path, true) {
+        return false
+    }
+    return !matchAny(s.Exclude, host, port, u.Path, true)
+}
+
+func splitHostPort(hostport string, defport int) (string, int) {
+    host, portStr, err := net.SplitHostPort(hostport)
+    if err != nil {
+        return strings.ToLower(strings.Trim(hostport, "[]")), defport
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        port = defport
+    }
+    return strings.ToLower(host), port
+}
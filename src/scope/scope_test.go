@@ -0,0 +1,73 @@
+package scope_test
+
+import (
+    "net/url"
+    . "scope"
+    "testing"
+)
+
+func mustScope(t *testing.T, s *Scope) *Scope {
+    if err := s.Compile(); err != nil {
+        t.Fatal(err)
+    }
+    return s
+}
+
+func TestEmptyScopeCapturesEverything(t *testing.T) {
+    var s *Scope
+    u, _ := url.Parse("http://anything.com/x")
+    if !s.Captures(u) || s.Connect("anything.com:443") != Intercept {
+        t.Error("Empty scope should capture everything")
+    }
+}
+
+func TestConnect(t *testing.T) {
+    s := mustScope(t, &Scope{
+        Include: []*Rule{{Host: "*.example.com"}, {Host: "10.0.0.0/8", Ports: "443,8000-8100"}},
+        Exclude: []*Rule{{Host: "telemetry.example.com"}, {Host: "*.example.com", Path: "^/static/"}},
+        Tunnel:  []*Rule{{Host: "pinned.example.com"}},
+    })
+    for hostport, expected := range map[string]Action{
+        "example.com:443":           Intercept,
+        "www.example.com:443":       Intercept,
+        "wwwexample.com:443":        Ignore,
+        "telemetry.example.com:443": Ignore,
+        "pinned.example.com:443":    Tunnel,
+        "10.1.2.3:8080":             Intercept,
+        "10.1.2.3:22":               Ignore,
+        "10.1.2.3":                  Intercept,
+        "11.1.2.3:443":              Ignore,
+    } {
+        if actual := s.Connect(hostport); actual != expected {
+            t.Errorf("Connect(%q) = %v, expected %v", hostport, actual, expected)
+        }
+    }
+}
+
+func TestCaptures(t *testing.T) {
+    s := mustScope(t, &Scope{
+        Include: []*Rule{{Host: "*.example.com", Path: "^/api/"}, {Host: "static.example.com"}},
+        Exclude: []*Rule{{Path: `\.png$`}},
+    })
+    for rawurl, expected := range map[string]bool{
+        "https://www.example.com/api/users":   true,
+        "https://www.example.com/login":       false,
+        "http://static.example.com/x.css":     true,
+        "http://static.example.com/x.png":     false,
+        "https://other.com/api/users":         false,
+        "https://www.example.com:8443/api/v1": true,
+    } {
+        u, _ := url.Parse(rawurl)
+        if actual := s.Captures(u); actual != expected {
+            t.Errorf("Captures(%q) = %v, expected %v", rawurl, actual, expected)
+        }
+    }
+}
+
+func TestInvalidRules(t *testing.T) {
+    for _, r := range []*Rule{{Host: "10.0.0.0/33"}, {Ports: "0"}, {Ports: "90-80"}, {Path: "("}} {
+        if err := (&Scope{Include: []*Rule{r}}).Compile(); err == nil {
+            t.Errorf("Rule %+v should not compile", *r)
+        }
+    }
+}
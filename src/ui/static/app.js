@@ -0,0 +1,527 @@
+// wyproxy web UI: lists live flows from /api/live and stored ones from
+// /api/flows, and shows the selected flow in detail.
+(function () {
+  "use strict";
+
+  var POLL_MS = 1000;
+  var PAGE = 100;
+  var HEX_LIMIT = 64 * 1024;
+  var LIVE_KEEP = 1000;
+
+  var $ = function (id) { return document.getElementById(id); };
+  var state = {
+    mode: "live",
+    live: [],        // flows polled so far, oldest first
+    last: 0,         // id of the newest live flow seen
+    stored: [],
+    offset: 0,
+    filters: {},
+    selected: null,  // flow shown in the detail pane
+    selectedId: 0,
+    token: localStorage.getItem("wyproxy-token") || ""
+  };
+
+  function api(path) {
+    var headers = {};
+    if (state.token) {
+      headers.Authorization = "Bearer " + state.token;
+    }
+    return fetch(path, {headers: headers}).then(function (resp) {
+      if (resp.status === 401) {
+        var token = prompt("API token");
+        if (token === null) {
+          throw new Error("unauthorized");
+        }
+        state.token = token;
+        localStorage.setItem("wyproxy-token", token);
+        return api(path);
+      }
+      return resp.json().then(function (body) {
+        if (!resp.ok) {
+          throw new Error(body.error || resp.statusText);
+        }
+        return body;
+      });
+    });
+  }
+
+  function setStatus(text, isError) {
+    var el = $("status");
+    el.textContent = text;
+    el.className = isError ? "error" : "";
+  }
+
+  // Live mode
+
+  function poll() {
+    api("/api/live?after=" + state.last).then(function (body) {
+      if (body.last < state.last) {
+        // the proxy restarted, its ids start over
+        state.live = [];
+      }
+      state.last = body.last;
+      if (body.flows.length) {
+        state.live = state.live.concat(body.flows).slice(-LIVE_KEEP);
+        if (state.mode === "live") {
+          render();
+        }
+      }
+      if (state.mode === "live") {
+        setStatus(state.live.length + " live flows");
+      }
+    }).catch(function (err) {
+      setStatus("live: " + err.message, true);
+    }).then(function () {
+      setTimeout(poll, POLL_MS);
+    });
+  }
+
+  // matches applies the filters to a live flow the way the API does for
+  // stored ones.
+  function matches(flow, f) {
+    if (f.host) {
+      if (f.host.indexOf("*.") === 0) {
+        var domain = f.host.slice(2);
+        if (flow.host !== domain && !endsWith(flow.host, "." + domain)) {
+          return false;
+        }
+      } else if (flow.host !== f.host) {
+        return false;
+      }
+    }
+    if (f.method && flow.method !== f.method.toUpperCase()) {
+      return false;
+    }
+    if (f.status) {
+      var s = String(flow.status);
+      if (/^[1-5]xx$/i.test(f.status) ? s[0] !== f.status[0] || s.length !== 3 : s !== f.status) {
+        return false;
+      }
+    }
+    if (f.content_type && flow.content_type.indexOf(f.content_type) !== 0) {
+      return false;
+    }
+    if (f.q) {
+      var text = flow.url + JSON.stringify(flow.header || {}) + JSON.stringify(flow.request_header || {});
+      if (text.indexOf(f.q) < 0) {
+        return false;
+      }
+    }
+    return true;
+  }
+
+  function endsWith(s, suffix) {
+    return s.length >= suffix.length && s.slice(s.length - suffix.length) === suffix;
+  }
+
+  // Stored mode
+
+  function loadStored() {
+    var params = ["limit=" + PAGE, "offset=" + state.offset];
+    Object.keys(state.filters).forEach(function (name) {
+      var v = state.filters[name];
+      if (name === "since" || name === "until") {
+        v = new Date(v).toISOString().replace(/\.\d+Z$/, "Z");
+      }
+      params.push(name + "=" + encodeURIComponent(v));
+    });
+    setStatus("loading...");
+    api("/api/flows?" + params.join("&")).then(function (body) {
+      state.stored = body.flows;
+      setStatus("stored flows " + (state.offset + 1) + "-" + (state.offset + body.flows.length));
+      render();
+    }).catch(function (err) {
+      setStatus("stored: " + err.message, true);
+    });
+  }
+
+  // Rendering
+
+  function render() {
+    var flows;
+    if (state.mode === "live") {
+      flows = state.live.filter(function (flow) { return matches(flow, state.filters); }).reverse();
+    } else {
+      flows = state.stored;
+    }
+    var tbody = $("flows");
+    tbody.textContent = "";
+    flows.forEach(function (flow) {
+      var tr = document.createElement("tr");
+      if (flow.id === state.selectedId) {
+        tr.className = "selected";
+      }
+      var status = flow.status ? String(flow.status) : (flow.error_class || "error");
+      cells(tr, [
+        flow.id,
+        flow.method,
+        flow.host,
+        flow.path || flow.url,
+        status,
+        flow.content_type,
+        size(flow.original_size || flow.content_length),
+        time(flow.date_start)
+      ]);
+      tr.children[3].className = "path";
+      tr.children[3].title = flow.url;
+      tr.children[4].className = flow.status ? "s" + String(flow.status)[0] : "error";
+      tr.onclick = function () { select(flow.id); };
+      tbody.appendChild(tr);
+    });
+  }
+
+  function cells(tr, values) {
+    values.forEach(function (v) {
+      var td = document.createElement("td");
+      td.textContent = v === undefined || v === null ? "" : v;
+      tr.appendChild(td);
+    });
+  }
+
+  function size(n) {
+    if (!n) {
+      return "";
+    }
+    if (n < 1024) {
+      return n + " B";
+    }
+    if (n < 1024 * 1024) {
+      return (n / 1024).toFixed(1) + " KB";
+    }
+    return (n / 1024 / 1024).toFixed(1) + " MB";
+  }
+
+  function time(s) {
+    if (!s) {
+      return "";
+    }
+    var d = new Date(s);
+    return isNaN(d) ? s : d.toLocaleTimeString();
+  }
+
+  function select(id) {
+    state.selectedId = id;
+    render();
+    var path = (state.mode === "live" ? "/api/live/" : "/api/flows/") + id;
+    api(path).then(function (flow) {
+      state.selected = flow;
+      showDetail();
+    }).catch(function (err) {
+      setStatus("flow " + id + ": " + err.message, true);
+    });
+  }
+
+  function showDetail() {
+    var flow = state.selected;
+    $("detail").hidden = false;
+
+    var summary = [flow.method + " " + flow.url];
+    if (flow.status) {
+      summary.push("status " + flow.status);
+    }
+    if (flow.error) {
+      summary.push("error (" + flow.error_class + "): " + flow.error);
+    }
+    if (flow.remote_ip) {
+      summary.push("server " + flow.remote_ip);
+    }
+    if (flow.timing) {
+      summary.push("timing " + Object.keys(flow.timing).filter(function (k) {
+        return flow.timing[k] >= 0;
+      }).map(function (k) {
+        return k + " " + flow.timing[k].toFixed(1) + "ms";
+      }).join(", "));
+    }
+    if (flow.tls && flow.tls.upstream) {
+      summary.push("tls " + flow.tls.upstream.version + " " + flow.tls.upstream.cipher_suite);
+    }
+    var el = $("summary");
+    el.textContent = "";
+    summary.forEach(function (line) {
+      var div = document.createElement("div");
+      div.textContent = line;
+      el.appendChild(div);
+    });
+
+    $("request-head").textContent = headers(flow.request_header);
+    $("response-head").textContent = headers(flow.header);
+    showBody($("request-body"), flow.request_body, flow.request_header, flow.request_truncated, flow.request_original_size,
+      marks(flow.findings, "request_body"));
+    showBody($("response-body"), flow.body, flow.header, flow.truncated, flow.original_size,
+      marks(flow.findings, "response_body"));
+    showMessages(flow.messages);
+    showFindings(flow.findings);
+  }
+
+  function headers(h) {
+    if (!h) {
+      return "";
+    }
+    return Object.keys(h).sort().map(function (name) {
+      return h[name].map(function (v) { return name + ": " + v; }).join("\n");
+    }).join("\n");
+  }
+
+  function view() {
+    return document.querySelector("input[name=view]:checked").value;
+  }
+
+  // decode turns a base64 body from the JSON encoding of []byte into bytes.
+  function decode(b64) {
+    var bin = atob(b64 || "");
+    var bytes = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) {
+      bytes[i] = bin.charCodeAt(i);
+    }
+    return bytes;
+  }
+
+  // marks are the findings located in a body, with their index in the list
+  // of the flow's findings.
+  function marks(findings, location) {
+    return (findings || []).map(function (f, i) {
+      return {start: f.start || 0, end: f.end || 0, title: f.title, index: i, location: f.location, context: f.context};
+    }).filter(function (m) {
+      // the offsets of findings with a context are in the context
+      return m.location === location && m.end > m.start && !m.context;
+    }).sort(function (a, b) {
+      return a.start - b.start;
+    });
+  }
+
+  function showBody(el, b64, h, truncated, originalSize, found) {
+    var bytes = decode(b64);
+    el.className = "body";
+    if (!bytes.length) {
+      el.innerHTML = '<span class="note">no body recorded</span>';
+      return;
+    }
+    var text;
+    switch (view()) {
+    case "hex":
+      el.className = "body hex";
+      text = hexdump(bytes.subarray(0, HEX_LIMIT));
+      if (bytes.length > HEX_LIMIT) {
+        text += "\n... " + (bytes.length - HEX_LIMIT) + " more bytes";
+      }
+      break;
+    case "pretty":
+      text = pretty(utf8(bytes), contentType(h));
+      break;
+    default:
+      if (found && found.length) {
+        // offsets are in bytes, the text around the matches is decoded
+        // piece by piece
+        el.textContent = "";
+        var pos = 0;
+        found.forEach(function (m) {
+          if (m.start < pos || m.end > bytes.length) {
+            return;
+          }
+          el.appendChild(document.createTextNode(utf8(bytes.subarray(pos, m.start))));
+          var mark = document.createElement("mark");
+          mark.id = "finding-" + m.index;
+          mark.title = m.title;
+          mark.textContent = utf8(bytes.subarray(m.start, m.end));
+          el.appendChild(mark);
+          pos = m.end;
+        });
+        text = utf8(bytes.subarray(pos));
+        if (truncated) {
+          text += "\n\n[truncated, " + originalSize + " bytes on the wire]";
+        }
+        el.appendChild(document.createTextNode(text));
+        return;
+      }
+      text = utf8(bytes);
+    }
+    if (truncated) {
+      text += "\n\n[truncated, " + originalSize + " bytes on the wire]";
+    }
+    el.textContent = text;
+  }
+
+  function utf8(bytes) {
+    return new TextDecoder("utf-8").decode(bytes);
+  }
+
+  function contentType(h) {
+    var v = h && (h["Content-Type"] || h["content-type"]);
+    return v && v.length ? v[0].toLowerCase() : "";
+  }
+
+  function pretty(text, ctype) {
+    try {
+      return JSON.stringify(JSON.parse(text), null, 2);
+    } catch (e) {
+      // not JSON
+    }
+    if (ctype.indexOf("application/x-www-form-urlencoded") === 0) {
+      return text.split("&").map(function (pair) {
+        var kv = pair.split("=");
+        return decodeParam(kv[0]) + " = " + decodeParam(kv.slice(1).join("="));
+      }).join("\n");
+    }
+    if (/html|xml/.test(ctype)) {
+      return text.replace(/>\s*</g, ">\n<");
+    }
+    return text;
+  }
+
+  function decodeParam(s) {
+    try {
+      return decodeURIComponent(s.replace(/\+/g, " "));
+    } catch (e) {
+      return s;
+    }
+  }
+
+  function hexdump(bytes) {
+    var lines = [];
+    for (var off = 0; off < bytes.length; off += 16) {
+      var row = bytes.subarray(off, off + 16);
+      var hex = "", ascii = "";
+      for (var i = 0; i < 16; i++) {
+        if (i < row.length) {
+          hex += (row[i] < 16 ? "0" : "") + row[i].toString(16) + " ";
+          ascii += row[i] >= 32 && row[i] < 127 ? String.fromCharCode(row[i]) : ".";
+        } else {
+          hex += "   ";
+        }
+        if (i === 7) {
+          hex += " ";
+        }
+      }
+      lines.push(("0000000" + off.toString(16)).slice(-8) + "  " + hex + " " + ascii);
+    }
+    return lines.join("\n");
+  }
+
+  function showMessages(msgs) {
+    var box = $("messages");
+    box.hidden = !msgs || !msgs.length;
+    var tbody = box.querySelector("tbody");
+    tbody.textContent = "";
+    (msgs || []).forEach(function (m) {
+      var tr = document.createElement("tr");
+      var payload = decode(m.payload);
+      var text = m.opcode === 1 ? utf8(payload) : payload.length + " bytes";
+      if (m.truncated) {
+        text += " [truncated, " + m.original_size + " bytes sent]";
+      }
+      cells(tr, [
+        m.seq,
+        m.direction === "client" ? "↑ client" : "↓ server",
+        opcode(m.opcode),
+        time(m.date),
+        text
+      ]);
+      tbody.appendChild(tr);
+    });
+  }
+
+  function showFindings(findings) {
+    var box = $("findings");
+    box.hidden = !findings || !findings.length;
+    var tbody = box.querySelector("tbody");
+    tbody.textContent = "";
+    (findings || []).forEach(function (f, i) {
+      var tr = document.createElement("tr");
+      tr.className = "sev-" + f.severity;
+      cells(tr, [f.severity, f.check, f.title, f.evidence || ""]);
+      if (f.context) {
+        // the body is not stored, the context stands in for it
+        tr.lastChild.textContent = "";
+        var bytes = new TextEncoder().encode(f.context);
+        var mark = document.createElement("mark");
+        mark.textContent = utf8(bytes.subarray(f.start || 0, f.end || 0));
+        tr.lastChild.appendChild(document.createTextNode(utf8(bytes.subarray(0, f.start || 0))));
+        tr.lastChild.appendChild(mark);
+        tr.lastChild.appendChild(document.createTextNode(utf8(bytes.subarray(f.end || 0))));
+      } else if (f.location) {
+        // matches are highlighted in the text view of the body
+        tr.className += " located";
+        tr.onclick = function () {
+          var mark = $("finding-" + i);
+          if (mark) {
+            mark.scrollIntoView({block: "center"});
+          }
+        };
+      }
+      tbody.appendChild(tr);
+    });
+  }
+
+  function opcode(op) {
+    return {0: "continuation", 1: "text", 2: "binary", 8: "close", 9: "ping", 10: "pong"}[op] || "opcode " + op;
+  }
+
+  // Controls
+
+  function switchMode(mode) {
+    state.mode = mode;
+    state.selectedId = 0;
+    $("detail").hidden = true;
+    $("tab-live").className = mode === "live" ? "active" : "";
+    $("tab-stored").className = mode === "stored" ? "active" : "";
+    Array.prototype.forEach.call(document.querySelectorAll(".stored-only"), function (el) {
+      el.hidden = mode !== "stored";
+    });
+    if (mode === "stored") {
+      state.offset = 0;
+      loadStored();
+    } else {
+      setStatus(state.live.length + " live flows");
+      render();
+    }
+  }
+
+  $("tab-live").onclick = function () { switchMode("live"); };
+  $("tab-stored").onclick = function () { switchMode("stored"); };
+
+  $("filters").onsubmit = function (e) {
+    e.preventDefault();
+    state.filters = {};
+    Array.prototype.forEach.call(this.elements, function (input) {
+      if (input.name && input.value) {
+        state.filters[input.name] = input.value;
+      }
+    });
+    if (state.mode === "stored") {
+      state.offset = 0;
+      loadStored();
+    } else {
+      render();
+    }
+  };
+  $("filters").onreset = function () {
+    var form = this;
+    setTimeout(function () { form.onsubmit(new Event("submit")); }, 0);
+  };
+
+  $("prev").onclick = function () {
+    state.offset = Math.max(0, state.offset - PAGE);
+    loadStored();
+  };
+  $("next").onclick = function () {
+    if (state.stored.length === PAGE) {
+      state.offset += PAGE;
+      loadStored();
+    }
+  };
+
+  Array.prototype.forEach.call(document.querySelectorAll("input[name=view]"), function (input) {
+    input.onchange = function () {
+      if (state.selected) {
+        showDetail();
+      }
+    };
+  });
+
+  // the stored tab is only offered when the sink can be queried
+  api("/api/flows?limit=1").then(function () {
+    $("tab-stored").hidden = false;
+  }).catch(function () {});
+
+  poll();
+})();
@@ -0,0 +1,25 @@
+// Package ui is wyproxy's web UI, a single page browsing the flows through
+// the JSON API of package api: the latest ones as they arrive, and those
+// stored in a queryable sink. Its assets are embedded in the binary.
+package ui
+
+import (
+    "embed"
+    "io/fs"
+    "net/http"
+)
+
+// Prefix is the path under which Handler serves the UI.
+const Prefix = "/ui/"
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the assets of the UI under Prefix.
+func Handler() http.Handler {
+    assets, err := fs.Sub(static, "static")
+    if err != nil {
+        panic(err)
+    }
+    return http.StripPrefix(Prefix, http.FileServer(http.FS(assets)))
+}
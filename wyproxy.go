@@ -1,124 +1,82 @@
 package main
 
 import (
+    "analysis"
+    "api"
     "bytes"
+    "cacert"
+    "capture"
+    "config"
+    "crypto/rand"
     "database/sql"
+    "diff"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
     "goproxy"
-    "io/ioutil"
+    "io"
     "log"
-    _ "mysql"
+    "net"
     "net/http"
+    "net/http/httptest"
     "os"
+    "os/signal"
+    "redact"
+    "replay"
     "runtime"
+    "scope"
     "strconv"
     "strings"
+    "sync/atomic"
+    "syscall"
     "time"
+    "ui"
 )
 
 const (
-    version            = "0.1"
-    default_mysql_conn = "root:@tcp(localhost:3306)/test?charset=utf8"
-    default_table      = `capture`
-    record_static      = true // Save static res request record.
+    version = "0.1"
+
+    certPrefix = "/cert/"
 )
 
 var (
-    // save to mysql database DSN
-    mysql_conn = os.Getenv("WYDSN")
+    // Save static res request record.
+    record_static = true
 
-    // request.Body temp var
-    RequestBodyMap = make(map[int64][]byte)
+    // where captured flows are written, see capture.OpenSink
+    sink capture.CaptureSink
 
-    // http static resource file extension
-    static_ext []string = []string{
-        "js",
-        "css",
-        "ico",
-    }
+    // how much of each body is kept, see config.CaptureConfig
+    bodyLimits = capture.BodyLimits{Default: capture.DefaultBodyLimit}
 
-    // media resource files type
-    media_types []string = []string{
-        "image",
-        "video",
-        "audio",
-    }
+    // what gets intercepted and recorded, everything unless configured
+    targetScope *scope.Scope
 
-    // http static resource files
-    static_types []string = []string{
-        "text/css",
-        // "application/javascript",
-        // "application/x-javascript",
-        "application/msword",
-        "application/vnd.ms-excel",
-        "application/vnd.ms-powerpoint",
-        "application/x-ms-wmd",
-        "application/x-shockwave-flash",
-    }
-)
+    // decompress and transcode bodies to UTF-8 before storing them,
+    // optionally keeping the bytes as received
+    decodeBodies = true
+    keepRawBody  = false
 
-const tableCreateSQL = `CREATE TABLE if not exists ` + default_table + ` (
-    id int(10) unsigned NOT NULL AUTO_INCREMENT,
-    static_resource tinyint(1) DEFAULT NULL,
-    method char(10) DEFAULT NULL,
-    status_code int(6) DEFAULT NULL,
-    content_type varchar(50) DEFAULT NULL,
-    content_length int(11) DEFAULT NULL,
-    host varchar(255) DEFAULT NULL,
-    port char(6) DEFAULT NULL,
-    url text,
-    scheme char(10) DEFAULT NULL,
-    path text,
-    header mediumtext,
-    content mediumblob,
-    request_header mediumtext,
-    request_content mediumblob,
-    date_start datetime DEFAULT NULL,
-    date_end datetime DEFAULT NULL,
-    extension char(32) DEFAULT NULL,
-    PRIMARY KEY (id)
-) ENGINE=MyISAM DEFAULT CHARSET=utf8`
-
-type Response struct {
-    Origin        string      `json:"origin" db:",json"`
-    Method        string      `json:"method" db:",json"`
-    Status        int         `json:"status" db:",json"`
-    ContentType   string      `json:"content_type" db:",json"`
-    ContentLength uint        `json:"content_length" db:",json"`
-    Host          string      `json:"host" db:",json"`
-    Port          string      `json:"port" db:",json"`
-    URL           string      `json:"url" db:",json"`
-    Scheme        string      `json:"scheme" db:",json"`
-    Path          string      `json:"path" db:",path"`
-    Extension     string      `json:"ext" db:",path"`
-    Header        http.Header `json:"header,omitempty" db:",json"`
-    Body          []byte      `json:"body,omitempty" db:",json"`
-    RequestHeader http.Header `json:"request_header,omitempty" db:",json"`
-    RequestBody   []byte      `json:"request_body,omitempty" db:",json"`
-    DateStart     time.Time   `json:"date_start" db:",json"`
-    DateEnd       time.Time   `json:"date_end" db:",json"`
-}
-
-func init() {
-    if mysql_conn == "" {
-        mysql_conn = default_mysql_conn
-    }
-    dbsetup()
-}
-
-func dbsetup() {
-    db, err := sql.Open("mysql", mysql_conn)
-    checkErr(err)
+    // static resource classification: file extensions, media types and
+    // top level types, see config.CaptureConfig
+    static_ext   []string
+    static_types []string
+    media_types  []string
 
-    if err == nil {
-        defer db.Close()
-    }
+    // host name the proxy answers itself with the web UI, empty when the UI
+    // is disabled
+    uiHost string
 
-    _, err = db.Query(tableCreateSQL)
-    checkErr(err)
-}
+    // host name the proxy answers itself with the CA certificate, which
+    // is also served under certPrefix on the proxy port
+    certHost string
+
+    // record the bodies of static scripts for the passive checks, keys
+    // leak in bundles, see analysis.Analyzer
+    analyzeScripts bool
+)
 
 func checkErr(err error) {
     if err != nil {
@@ -133,7 +91,7 @@ type ParserHTTP struct {
     s        time.Time
 }
 
-func (parser *ParserHTTP) Parser() Response {
+func (parser *ParserHTTP) Parser() capture.Response {
 
     var (
         ctype   string
@@ -164,7 +122,7 @@ func (parser *ParserHTTP) Parser() Response {
 
     now := time.Now()
 
-    r := Response{
+    r := capture.Response{
         Origin:        parser.r.Request.RemoteAddr,
         Method:        parser.r.Request.Method,
         Status:        parser.r.StatusCode,
@@ -186,8 +144,8 @@ func (parser *ParserHTTP) Parser() Response {
     return r
 }
 
-func New(resp *http.Response, reqbody []byte, respbody []byte) *ParserHTTP {
-    return &ParserHTTP{r: resp, reqbody: reqbody, respbody: respbody, s: time.Now()}
+func New(resp *http.Response, reqbody []byte, respbody []byte, start time.Time) *ParserHTTP {
+    return &ParserHTTP{r: resp, reqbody: reqbody, respbody: respbody, s: start}
 }
 
 type ResType struct {
@@ -237,116 +195,712 @@ func NewResType(ext string, ctype string) *ResType {
     return &ResType{ext, ctype, mtype}
 }
 
-func RequestBody(res *http.Request) ([]byte, error) {
-    buf, err := ioutil.ReadAll(res.Body)
-    if err != nil {
-        return nil, err
+func printHeader(header http.Header) {
+    var headers string
+    for k, v := range header {
+        headers = headers + fmt.Sprintf("    %s: %s\n", k, v)
     }
-    res.Body = ioutil.NopCloser(bytes.NewReader(buf))
-    return buf, nil
+    log.Printf("headers:\n%s", headers)
 }
 
-func ResponseBody(res *http.Response) ([]byte, error) {
-    buf, err := ioutil.ReadAll(res.Body)
-    if err != nil {
-        return nil, err
+// flowState is what handleRequest leaves for handleResponse. It lives in
+// ctx.UserData, so it belongs to a single request and goes away with its
+// ProxyCtx whether or not a response ever arrives.
+type flowState struct {
+    id      string
+    req     *http.Request
+    reqbody *capture.BodyRecorder
+    trace   *capture.Tracer
+    start   time.Time
+    // replayOf is the flow a replay sent with package replay repeats
+    replayOf string
+}
+
+// takeFlowState returns the state stored by handleRequest, if any, and
+// detaches it from ctx.
+func takeFlowState(ctx *goproxy.ProxyCtx) *flowState {
+    state, _ := ctx.UserData.(*flowState)
+    if state != nil {
+        ctx.UserData = nil
     }
-    res.Body = ioutil.NopCloser(bytes.NewReader(buf))
-    return buf, nil
+    return state
 }
 
-func printHeader(header http.Header) {
-    var headers string
-    for k, v := range header {
-        headers = headers + fmt.Sprintf("    %s: %s\n", k, v)
+// handleConnect intercepts in scope tunnels and passes the others through.
+// Tunnels passed through but in scope are marked for recordTunnel.
+func handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+    if isUIHost(host) || isCertHost(host) {
+        // intercepted whatever the scope, serveLocal answers their requests
+        return goproxy.MitmConnect, host
     }
-    log.Printf("headers:\n%s", headers)
+    if action := targetScope.Connect(host); action != scope.Intercept {
+        ctx.Logf("Not intercepting %s: %s", host, action)
+        ctx.UserData = action
+        return goproxy.OkConnect, host
+    }
+    return goproxy.MitmConnect, host
 }
 
-func toJsonHeader(header http.Header) string {
-    js, err := json.Marshal(header)
-    checkErr(err)
-    return string(js)
+// isUIHost tells if host, with or without a port, is the reserved UI host.
+func isUIHost(host string) bool {
+    return isHost(host, uiHost)
+}
+
+// isCertHost tells if host is the reserved host serving the CA.
+func isCertHost(host string) bool {
+    return isHost(host, certHost)
+}
+
+func isHost(host, reserved string) bool {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    return reserved != "" && strings.EqualFold(host, reserved)
+}
+
+// randomToken makes up an API token.
+func randomToken() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        log.Fatalf("Cannot make up an API token: %v", err)
+    }
+    return hex.EncodeToString(b)
+}
+
+// serveLocal answers requests for a reserved host with h, they never
+// reach the network nor the capture.
+func serveLocal(h http.Handler) goproxy.FuncReqHandler {
+    return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        return req, rec.Result()
+    }
+}
+
+// recordTunnel stores what is known of a tunnel passed through: its ends,
+// duration and the bytes sent each way.
+func recordTunnel(t *goproxy.Tunnel, ctx *goproxy.ProxyCtx) {
+    if ctx.UserData != scope.Tunnel {
+        return
+    }
+    host, port, _ := net.SplitHostPort(t.Host)
+    remoteIP, _, _ := net.SplitHostPort(t.RemoteAddr)
+    // no Signature, deduplication would lose the byte counts
+    RespCapture := capture.Response{
+        FlowID:              capture.NewFlowID(),
+        Origin:              t.ClientAddr,
+        Method:              "CONNECT",
+        Host:                host,
+        Port:                port,
+        URL:                 t.Host,
+        RemoteIP:            remoteIP,
+        OriginalSize:        t.BytesToClient,
+        RequestOriginalSize: t.BytesToServer,
+        CloseReason:         t.ClosedBy,
+        DateStart:           t.Start,
+        DateEnd:             t.End,
+    }
+    RespCapture.SetError(t.Err)
+    checkErr(sink.Write(&RespCapture))
 }
 
 func handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-    reqbody, err := RequestBody(req)
-    checkErr(err)
-    RequestBodyMap[ctx.Session] = reqbody
-    return req, nil
+    replayOf, replayID := replay.Take(req.Header)
+    if !targetScope.Captures(req.URL) {
+        // no flow state, handleResponse will not record it
+        return req, nil
+    }
+    state := &flowState{id: capture.NewFlowID(), start: time.Now()}
+    if replayOf != "" {
+        state.id, state.replayOf = replayID, replayOf
+    }
+    if req.Body != nil {
+        ctype := GetContentType(req.Header.Get("Content-Type"))
+        state.reqbody = capture.NewBodyRecorder(req.Body, bodyLimits.For(ctype), nil)
+        req.Body = state.reqbody
+    }
+    state.trace = capture.NewTracer(state.start)
+    state.req = state.trace.WithTrace(req)
+    ctx.UserData = state
+    return state.req, nil
 }
 
 func handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
     
-    // Getting the Body
-    reqbody := RequestBodyMap[ctx.Session]
-    respbody, err := ResponseBody(resp)
-    checkErr(err)
-    delete(RequestBodyMap, ctx.Session)
-
-    // Attaching capture tool.
-    RespCapture := New(resp, reqbody, respbody).Parser()
+    state := takeFlowState(ctx)
+    if state == nil {
+        // out of scope, or already recorded as failed
+        return resp
+    }
+    if resp == nil {
+        recordFailure(state, ctx)
+        return nil
+    }
+    if resp.StatusCode == http.StatusSwitchingProtocols {
+        // the body is the upgraded connection, the handshake is recorded
+        // now and the messages by handleWebSocket. No Signature, the
+        // messages would lose their flow to deduplication.
+        RespCapture := state.flow(ctx, resp, nil)
+        checkErr(sink.Write(&RespCapture))
+        ctx.UserData = &wsState{flowID: state.id}
+        return resp
+    }
 
-    // Saving to MYSQL with a goroutine.
-    go func() {
-        var static_resource int = 0
-        static := NewResType(
-            RespCapture.Extension,
-            RespCapture.ContentType).isStatic()
-        if static {
-            if record_static {
-                static_resource = 1
-                RespCapture.Body = []byte(nil)
-
-                db, err := sql.Open("mysql", mysql_conn)
-                checkErr(err)
-                if err == nil {
-                    defer db.Close()
-
-                    stmt, err := db.Prepare("INSERT capture SET content_length=?, static_resource=?, extension=?, url=?, status_code=?, host=?, port=?, content=?, header=?, content_type=?, path=?, scheme=?, method=?, request_content=?, request_header=?, date_start=?, date_end=?")
-                    checkErr(err)
-
-                    _, err = stmt.Exec(RespCapture.ContentLength, static_resource, RespCapture.Extension, RespCapture.URL, RespCapture.Status, RespCapture.Host, RespCapture.Port, RespCapture.Body, toJsonHeader(RespCapture.Header), RespCapture.ContentType, RespCapture.Path, RespCapture.Scheme, RespCapture.Method, RespCapture.RequestBody, toJsonHeader(RespCapture.RequestHeader), RespCapture.DateStart, RespCapture.DateEnd)
-                    checkErr(err)
-                }
+    ctype := GetContentType(resp.Header.Get("Content-Type"))
+    static := NewResType(GetExtension(resp.Request.URL.Path), ctype).isStatic()
+    if static && !record_static {
+        return resp
+    }
+    limit := bodyLimits.For(ctype)
+    if static && !(analyzeScripts && isScript(resp.Request.URL.Path, ctype)) {
+        limit = 0
+    }
+    charset := ctx.Charset()
+
+    // The body streams to the client, the flow is handed over to the sink
+    // once it has gone through.
+    resp.Body = capture.NewBodyRecorder(resp.Body, limit, func(body *capture.BodyRecorder) {
+        RespCapture := state.flow(ctx, resp, body.Bytes())
+        RespCapture.Static = static
+        RespCapture.Truncated, RespCapture.OriginalSize = body.Truncated(), body.Size()
+        if err := body.Err(); err != nil && !(err == capture.ErrBodyAborted && bodyless(resp)) {
+            RespCapture.SetError(err)
+        }
+        if decodeBodies {
+            if err := capture.Decode(&RespCapture, charset, keepRawBody, limit); err != nil {
+                ctx.Logf("Cannot decode body of %s: %v", RespCapture.URL, err)
             }
-        } else {
-            db, err := sql.Open("mysql", mysql_conn)
-            checkErr(err)
+        }
+        state.signature(&RespCapture)
+        checkErr(sink.Write(&RespCapture))
+    })
 
-            if err == nil {
-                defer db.Close()
+    return resp
+}
 
-                stmt, err := db.Prepare("INSERT capture SET content_length=?, static_resource=?, extension=?, url=?, status_code=?, host=?, port=?, content=?, header=?, content_type=?, path=?, scheme=?, method=?, request_content=?, request_header=?, date_start=?, date_end=?")
-                checkErr(err)
+// isScript tells if a response is JavaScript, by type or extension.
+func isScript(path, ctype string) bool {
+    return strings.Contains(ctype, "javascript") || GetExtension(path) == "js"
+}
 
-                _, err = stmt.Exec(RespCapture.ContentLength, static_resource, RespCapture.Extension, RespCapture.URL, RespCapture.Status, RespCapture.Host, RespCapture.Port, RespCapture.Body, toJsonHeader(RespCapture.Header), RespCapture.ContentType, RespCapture.Path, RespCapture.Scheme, RespCapture.Method, RespCapture.RequestBody, toJsonHeader(RespCapture.RequestHeader), RespCapture.DateStart, RespCapture.DateEnd)
-                checkErr(err)
-            }
+// tlsInfo describes the TLS legs of a flow, nil when neither is TLS. resp
+// is nil when the upstream was never reached.
+func tlsInfo(ctx *goproxy.ProxyCtx, resp *http.Response) *capture.TLSInfo {
+    info := &capture.TLSInfo{Client: capture.NewTLSClient(ctx.ClientHello, ctx.ClientTLS)}
+    if resp != nil {
+        info.Upstream = capture.NewTLSUpstream(resp.TLS)
+    }
+    if info.Client == nil && info.Upstream == nil {
+        return nil
+    }
+    return info
+}
+
+// flow builds the record of resp with what handleRequest measured.
+func (state *flowState) flow(ctx *goproxy.ProxyCtx, resp *http.Response, body []byte) capture.Response {
+    RespCapture := New(resp, state.reqbody.Bytes(), body, state.start).Parser()
+    RespCapture.FlowID = state.id
+    RespCapture.RemoteIP, RespCapture.Timing = state.trace.RemoteIP(), state.trace.Timing(RespCapture.DateEnd)
+    RespCapture.TLS = tlsInfo(ctx, resp)
+    RespCapture.RequestTruncated, RespCapture.RequestOriginalSize = state.reqbody.Truncated(), state.reqbody.Size()
+    RespCapture.ReplayOf = state.replayOf
+    return RespCapture
+}
+
+// signature sets the Signature of a flow, except for replays which would
+// otherwise be taken for repeats of the original by deduplication.
+func (state *flowState) signature(RespCapture *capture.Response) {
+    if state.replayOf == "" {
+        RespCapture.Signature = capture.Signature(RespCapture)
+    }
+}
+
+// recordFailure stores a flow that got no response, with the request that
+// caused it and the error of the round trip.
+func recordFailure(state *flowState, ctx *goproxy.ProxyCtx) {
+    err := ctx.Error
+    if err == nil {
+        err = errors.New("no response")
+    }
+    RespCapture := state.flow(ctx, &http.Response{Request: state.req, Header: make(http.Header)}, nil)
+    RespCapture.SetError(err)
+    state.signature(&RespCapture)
+    checkErr(sink.Write(&RespCapture))
+}
+
+// wsState is left in ctx.UserData by an upgrade, for handleWebSocket.
+type wsState struct {
+    flowID string
+    seq    int32
+}
+
+// handleWebSocket records the messages of an upgraded flow as they are
+// relayed, payloads capped like bodies.
+func handleWebSocket(msg *goproxy.WebSocketMessage, ctx *goproxy.ProxyCtx) *goproxy.WebSocketMessage {
+    ws, ok := ctx.UserData.(*wsState)
+    ms, isMessageSink := sink.(capture.MessageSink)
+    if !ok || !isMessageSink {
+        return msg
+    }
+    m := &capture.Message{
+        FlowID:    ws.flowID,
+        Seq:       int(atomic.AddInt32(&ws.seq, 1)),
+        Direction: "server",
+        Opcode:    msg.Opcode,
+        Payload:   msg.Payload,
+        Date:      msg.Time,
+    }
+    if msg.FromClient {
+        m.Direction = "client"
+    }
+    if limit := bodyLimits.Default; limit >= 0 && int64(len(m.Payload)) > limit {
+        m.Payload, m.Truncated, m.OriginalSize = m.Payload[:limit], true, int64(len(m.Payload))
+    }
+    checkErr(ms.WriteMessages([]*capture.Message{m}))
+    return msg
+}
+
+// bodyless reports whether resp cannot have a body, so the proxy closing it
+// unread is not an abort.
+func bodyless(resp *http.Response) bool {
+    return resp.Request.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 ||
+        (resp.StatusCode >= 100 && resp.StatusCode < 200)
+}
+
+// exportHar implements `wyproxy export-har`, writing stored flows as HAR 1.2.
+func exportHar(args []string) {
+    fs := flag.NewFlagSet("export-har", flag.ExitOnError)
+    sinkName := fs.String("sink", "mysql", "where the flows are stored, mysql or jsonl")
+    dsn := fs.String("dsn", os.Getenv("WYDSN"), "mysql DSN or jsonl file (.gz allowed), defaults to $WYDSN")
+    where := fs.String("where", "", "SQL condition selecting the flows to export (mysql only)")
+    out := fs.String("o", "-", "output file, - for stdout")
+    fs.Parse(args)
+
+    var (
+        flows []*capture.Response
+        err   error
+    )
+    switch *sinkName {
+    case "mysql":
+        var db *capture.MySQLSink
+        if db, err = capture.NewMySQLSink(*dsn); err == nil {
+            flows, err = db.Select(*where)
+            db.Close()
         }
-    }()
+    case "jsonl":
+        if *dsn == "" {
+            *dsn = capture.DefaultJSONLPath
+        }
+        flows, err = capture.ReadJSONL(*dsn)
+    default:
+        err = fmt.Errorf("cannot export from %s sink", *sinkName)
+    }
+    if err != nil {
+        log.Fatal(err)
+    }
 
-    return resp
+    w := os.Stdout
+    if *out != "-" {
+        if w, err = os.Create(*out); err != nil {
+            log.Fatal(err)
+        }
+        defer w.Close()
+    }
+    if err := capture.WriteHAR(w, flows, version); err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Exported %d flows", len(flows))
+}
+
+// migrate implements `wyproxy migrate`, upgrading a MySQL capture database
+// without starting the proxy.
+func migrate(args []string) {
+    fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+    dsn := fs.String("dsn", os.Getenv("WYDSN"), "mysql DSN, defaults to $WYDSN")
+    status := fs.Bool("status", false, "only print the schema version")
+    fs.Parse(args)
+
+    if *dsn == "" {
+        *dsn = capture.DefaultMySQLDSN
+    }
+    db, err := sql.Open("mysql", *dsn)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer db.Close()
+
+    from, err := capture.CurrentSchemaVersion(db)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if *status || from == capture.SchemaVersion {
+        log.Printf("Schema version %d, latest is %d", from, capture.SchemaVersion)
+        return
+    }
+    if _, err := capture.Migrate(db); err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Migrated schema from version %d to %d", from, capture.SchemaVersion)
+}
+
+// headerFlag collects repeated -H "Name: value" flags, "Name:" removes
+// the header.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+    return ""
+}
+
+func (h headerFlag) Set(s string) error {
+    i := strings.Index(s, ":")
+    if i <= 0 {
+        return fmt.Errorf("header %q is not Name: value", s)
+    }
+    name, value := http.CanonicalHeaderKey(strings.TrimSpace(s[:i])), strings.TrimSpace(s[i+1:])
+    if value == "" {
+        h[name] = []string{}
+    } else {
+        h[name] = append(h[name], value)
+    }
+    return nil
+}
+
+// replayFlow implements `wyproxy replay`, asking a running proxy through
+// its API to send a stored flow again. The proxy records the result as a
+// replay of the flow.
+func replayFlow(args []string) {
+    fs := flag.NewFlagSet("replay", flag.ExitOnError)
+    proxyAddr := fs.String("proxy", "127.0.0.1:8080", "address of the running proxy, its API must be enabled")
+    token := fs.String("token", os.Getenv("WYTOKEN"), "API token of the proxy, defaults to $WYTOKEN")
+    method := fs.String("X", "", "method replacing the original")
+    rawurl := fs.String("url", "", "URL replacing the original")
+    body := fs.String("d", "", "body replacing the original")
+    bodyFile := fs.String("body-file", "", "file whose content replaces the original body")
+    edits := replay.Edits{Header: make(http.Header)}
+    fs.Var(headerFlag(edits.Header), "H", "header replacing the original ones of its name, \"Name:\" removes it, may be repeated")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "usage: wyproxy replay [flags] <id>\n")
+        fs.PrintDefaults()
+    }
+    fs.Parse(args)
+
+    id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+    if fs.NArg() != 1 || err != nil {
+        fs.Usage()
+        os.Exit(2)
+    }
+    edits.Method, edits.URL = *method, *rawurl
+    fs.Visit(func(f *flag.Flag) {
+        if f.Name == "d" {
+            edits.Body = body
+        }
+    })
+    if *bodyFile != "" {
+        b, err := os.ReadFile(*bodyFile)
+        if err != nil {
+            log.Fatal(err)
+        }
+        s := string(b)
+        edits.Body = &s
+    }
+
+    payload, err := json.Marshal(edits)
+    if err != nil {
+        log.Fatal(err)
+    }
+    base := *proxyAddr
+    if !strings.Contains(base, "://") {
+        base = "http://" + base
+    }
+    req, err := http.NewRequest("POST", fmt.Sprintf("%s%sflows/%d/replay", strings.TrimSuffix(base, "/"), api.Prefix, id), bytes.NewReader(payload))
+    if err != nil {
+        log.Fatal(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if *token != "" {
+        req.Header.Set("Authorization", "Bearer "+*token)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        var apiErr struct {
+            Error string `json:"error"`
+        }
+        if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+            log.Fatalf("The proxy at %s answered %s, is its API enabled?", *proxyAddr, resp.Status)
+        }
+        log.Fatalf("Flow %d: %s", id, apiErr.Error)
+    }
+    var result replay.Result
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Replayed flow %d (%s) as flow %s", id, result.ReplayOf, result.FlowID)
+    fmt.Printf("HTTP %d %s\n", result.Status, http.StatusText(result.Status))
+    result.Header.Write(os.Stdout)
+    fmt.Println()
+    os.Stdout.Write(result.Body)
+}
+
+// diffFlows implements `wyproxy diff`, comparing the responses of two
+// stored flows. It exits with status 1 when they differ, like diff(1).
+func diffFlows(args []string) {
+    fs := flag.NewFlagSet("diff", flag.ExitOnError)
+    dsn := fs.String("dsn", os.Getenv("WYDSN"), "mysql DSN, defaults to $WYDSN")
+    context := fs.Int("U", diff.DefaultContext, "lines of context around changes")
+    text := fs.Bool("text", false, "compare JSON bodies line by line instead of by structure")
+    ignore := fs.String("ignore", strings.Join(diff.DefaultIgnoreHeaders, ","), "comma separated headers left out of the comparison")
+    asJSON := fs.Bool("json", false, "print the comparison as JSON")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "usage: wyproxy diff [flags] <id> <id>\n")
+        fs.PrintDefaults()
+    }
+    fs.Parse(args)
+    if fs.NArg() != 2 {
+        fs.Usage()
+        os.Exit(2)
+    }
+
+    db, err := capture.NewMySQLSink(*dsn)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer db.Close()
+    var flows [2]*capture.Response
+    for i, arg := range fs.Args() {
+        id, err := strconv.ParseInt(arg, 10, 64)
+        if err != nil {
+            log.Fatalf("%q is not a flow id", arg)
+        }
+        if flows[i], err = db.Get(id); err != nil {
+            log.Fatalf("Flow %d: %v", id, err)
+        }
+    }
+
+    opts := diff.Options{Context: diff.ContextLines(*context), Text: *text, IgnoreHeaders: []string{}}
+    for _, name := range strings.Split(*ignore, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            opts.IgnoreHeaders = append(opts.IgnoreHeaders, name)
+        }
+    }
+    result := diff.Flows(flows[0], flows[1], opts)
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        err = enc.Encode(result)
+    } else {
+        err = result.WriteText(os.Stdout)
+    }
+    if err != nil {
+        log.Fatal(err)
+    }
+    if !result.Equal() {
+        db.Close()
+        os.Exit(1)
+    }
 }
 
 func main() {
     // maxout concurrency
     runtime.GOMAXPROCS(runtime.NumCPU())
 
-    verbose := flag.Bool("v", false, "should every proxy request be logged to stdout")
-    addr := flag.String("addr", ":8080", "proxy listen address")
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "export-har":
+            exportHar(os.Args[2:])
+            return
+        case "migrate":
+            migrate(os.Args[2:])
+            return
+        case "replay":
+            replayFlow(os.Args[2:])
+            return
+        case "diff":
+            diffFlows(os.Args[2:])
+            return
+        }
+    }
+
+    cfg := config.Default()
+    configFile := flag.String("config", "", "JSON configuration file, flags override its values")
+    cfg.RegisterFlags(flag.CommandLine)
     flag.Parse()
 
+    if *configFile != "" {
+        // flags given on the command line win over the file
+        given := make(map[string]string)
+        flag.Visit(func(f *flag.Flag) {
+            given[f.Name] = f.Value.String()
+        })
+        if err := cfg.Load(*configFile); err != nil {
+            log.Fatal(err)
+        }
+        for name, value := range given {
+            flag.Set(name, value)
+        }
+    }
+    if err := cfg.Validate(); err != nil {
+        log.Fatal(err)
+    }
+
+    var logOutput io.Writer = os.Stderr
+    if cfg.Log.File != "" {
+        logFile, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+        if err != nil {
+            log.Fatal(err)
+        }
+        logOutput = logFile
+        log.SetOutput(logOutput)
+    }
+
+    ca, err := cfg.LoadCA()
+    if err != nil {
+        log.Fatal(err)
+    }
+    if ca != nil {
+        goproxy.GoproxyCa = *ca
+    }
+
+    targetScope = cfg.Scope
+    bodyLimits, _ = cfg.BodyLimits()
+    decodeBodies, keepRawBody = cfg.Capture.Decode, cfg.Capture.KeepRaw
+    record_static = cfg.Capture.RecordStatic
+    static_ext = cfg.Capture.StaticExtensions
+    static_types = cfg.Capture.StaticTypes
+    media_types = cfg.Capture.MediaTypes
+
+    backend, err := capture.OpenSink(cfg.Sink.Type, cfg.Sink.DSN)
+    if err != nil {
+        log.Fatalf("Cannot open %s sink: %v", cfg.Sink.Type, err)
+    }
+    store, queryable := backend.(capture.FlowStore)
+    if cfg.Sink.Dedup {
+        if backend, err = capture.NewDedupSink(backend); err != nil {
+            log.Fatalf("Cannot load stored signatures: %v", err)
+        }
+    }
+    writer := capture.NewBatchWriter(backend, cfg.BatchOptions())
+    sink = writer
+    var live *capture.Live
+    if cfg.UI.Enabled {
+        live = capture.NewLive(cfg.UI.Buffer)
+        sink = capture.NewTeeSink(writer, live)
+    }
+    var analyzer *analysis.Analyzer
+    if cfg.Analysis.Enabled {
+        // after the tee, the live view shows the findings too
+        analyzer = analysis.New(sink, analysis.Options{
+            Checks:  cfg.Analysis.Checks,
+            Workers: cfg.Analysis.Workers,
+            Rules:   cfg.Analysis.Rules,
+        })
+        sink = analyzer
+        analyzeScripts = true
+    }
+    if !cfg.Redact.Empty() {
+        // before anything is queued or kept in memory
+        sink = redact.NewSink(cfg.Redact, sink)
+    }
+
+    go func() {
+        var dropped, skipped uint64
+        for range time.Tick(time.Minute) {
+            if stats := writer.Stats(); stats.Dropped != dropped {
+                log.Printf("Capture queue full, dropped %d flows so far", stats.Dropped)
+                dropped = stats.Dropped
+            }
+            if analyzer != nil && analyzer.Skipped() != skipped {
+                skipped = analyzer.Skipped()
+                log.Printf("Analysis queue full, %d flows left unchecked so far", skipped)
+            }
+        }
+    }()
+
+    // Buffered sinks lose their tail unless closed before exiting.
+    go func() {
+        c := make(chan os.Signal, 1)
+        signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+        <-c
+        checkErr(sink.Close())
+        stats := writer.Stats()
+        log.Printf("Captured %d flows, %d dropped, %d failed", stats.Written, stats.Dropped, stats.Failed)
+        os.Exit(0)
+    }()
+
     proxy := goproxy.NewProxyHttpServer()
+    proxy.Logger = log.New(logOutput, "", log.LstdFlags)
     log.Printf("wyproxy Start success... \n")
-    log.Printf("Listening %s \n", *addr)
 
-    proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+    // requests made to the proxy itself rather than through it
+    mux := http.NewServeMux()
+
+    certHandler, err := cacert.Handler(goproxy.GoproxyCa.Certificate[0])
+    if err != nil {
+        log.Fatal(err)
+    }
+    mux.Handle(certPrefix, http.StripPrefix(strings.TrimSuffix(certPrefix, "/"), certHandler))
+    if cfg.CA.Host != "" {
+        // registered before handleRequest like the UI
+        certHost = cfg.CA.Host
+        proxy.OnRequest(goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+            return isCertHost(req.URL.Host)
+        })).Do(serveLocal(certHandler))
+        log.Printf("Serving the CA certificate at %s and http://%s/ \n", certPrefix, certHost)
+    }
+
+    if cfg.API.Enabled || cfg.UI.Enabled {
+        if !queryable {
+            log.Printf("The %s sink cannot be queried, only live flows are served", cfg.Sink.Type)
+        }
+        token := cfg.API.Token
+        if token == "" && !cfg.Loopback() {
+            // anyone reaching the proxy could read the captured credentials
+            token = randomToken()
+            log.Printf("The flow API and web UI require the token %s, set api.token to choose one \n", token)
+        }
+        apiHandler := api.New(store, live, token)
+        if apiHandler.Replayer, err = replay.New(cfg.Addrs()[0]); err != nil {
+            log.Printf("Replays disabled: %v", err)
+        }
+        mux.Handle(api.Prefix, apiHandler)
+        log.Printf("Serving the flow API at %s \n", api.Prefix)
+        if cfg.UI.Enabled {
+            mux.Handle(ui.Prefix, ui.Handler())
+            mux.Handle("/", http.RedirectHandler(ui.Prefix, http.StatusFound))
+            // registered before handleRequest, UI requests are not recorded
+            uiHost = cfg.UI.Host
+            apiHandler.UIHost = uiHost
+            proxy.OnRequest(goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+                return isUIHost(req.URL.Host)
+            })).Do(serveLocal(mux))
+            log.Printf("Serving the web UI at %s and http://%s/ \n", ui.Prefix, uiHost)
+        } else {
+            mux.Handle("/", proxy.NonproxyHandler)
+        }
+    } else {
+        mux.Handle("/", proxy.NonproxyHandler)
+    }
+    proxy.NonproxyHandler = mux
+
+    proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(handleConnect))
+    proxy.TunnelDone = recordTunnel
+    proxy.HandleWebSocketFunc(handleWebSocket)
 
     proxy.OnRequest().DoFunc(handleRequest)
     proxy.OnResponse().DoFunc(handleResponse)
 
-    proxy.Verbose = *verbose
-    log.Fatal(http.ListenAndServe(*addr, proxy))
+    proxy.Verbose = cfg.Log.Verbose
+    addrs := cfg.Addrs()
+    for _, addr := range addrs[1:] {
+        go func(addr string) {
+            log.Printf("Listening %s \n", addr)
+            log.Fatal(http.ListenAndServe(addr, proxy))
+        }(addr)
+    }
+    log.Printf("Listening %s \n", addrs[0])
+    log.Fatal(http.ListenAndServe(addrs[0], proxy))
 }
 